@@ -0,0 +1,112 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AcceptRate limits the rate at which the listener accepts connections to
+// rate per second, with bursts of up to burst connections (at least one), so
+// that an accept storm or SYN flood is absorbed by the kernel's backlog
+// instead of turning into a goroutine for every connection.  Connections
+// beyond the rate wait to be accepted; each connection which has to wait is
+// counted in a metric.  The rate can be changed while the listener is running
+// with SetAcceptRate.
+func AcceptRate(rate float64, burst int) ListenOption {
+	return func(c *listenConfig) {
+		c.acceptRate, c.acceptBurst = rate, burst
+	}
+}
+
+// parseAcceptRate parses the value of the "rate" spec key, R[:BURST].
+func parseAcceptRate(val string) (ListenOption, error) {
+	rs, bs, hasBurst := cut(val, ":")
+	rate, err := strconv.ParseFloat(rs, 64)
+	if err != nil {
+		return nil, err
+	}
+	burst := 1
+	if hasBurst {
+		if burst, err = strconv.Atoi(bs); err != nil {
+			return nil, err
+		}
+	}
+	if rate <= 0 || burst < 1 {
+		return nil, fmt.Errorf("rate %q must be positive, with a burst of at least 1", val)
+	}
+	return AcceptRate(rate, burst), nil
+}
+
+// rateState is the token bucket of a listener with AcceptRate.
+type rateState struct {
+	lock   sync.Mutex
+	rate   float64 // tokens per second; 0 for no limit
+	burst  float64
+	tokens float64 // negative while connections wait for tokens
+	last   time.Time
+}
+
+// SetAcceptRate changes the listener's AcceptRate while it is running.  A
+// rate of 0 removes the limit.
+func (w *WaitListener) SetAcceptRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	w.rate.lock.Lock()
+	defer w.rate.lock.Unlock()
+	if w.rate.rate == 0 {
+		w.rate.tokens, w.rate.last = float64(burst), now()
+	}
+	w.rate.rate, w.rate.burst = rate, float64(burst)
+	if w.rate.tokens > w.rate.burst {
+		w.rate.tokens = w.rate.burst
+	}
+}
+
+// limitRate waits, if the listener has an AcceptRate, until it may accept
+// another connection, or until it is stopped.
+func (w *WaitListener) limitRate() {
+	r := &w.rate
+	r.lock.Lock()
+	if r.rate <= 0 {
+		r.lock.Unlock()
+		return
+	}
+	now := now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	// Take the token now, so that concurrent shards queue up behind it.
+	r.tokens--
+	wait := time.Duration(-r.tokens / r.rate * float64(time.Second))
+	r.lock.Unlock()
+	if wait <= 0 {
+		return
+	}
+
+	w.metrics.rateLimited.Add(1)
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-w.stop:
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// CommonAccessFormat is the default format of access logs, modeled on the
+// Apache common log format: the remote host, two placeholders (for the ident
+// and user fields), the time the connection was accepted, a "request" made of
+// the listener name and local address, and then the bytes received, bytes
+// sent, and duration in microseconds.
+const CommonAccessFormat = `%h - - %t "%n %l" %I %O %D`
+
+// AccessLog causes a line to be written to w, in the given format, for each
+// connection accepted by the listener when it is closed.  Lines are queued
+// and written by their own goroutine (like the daemon's own logs; see
+// LogSinkBuffer), so a slow writer never holds up Close; lines dropped when it
+// falls behind are counted in LogSinks.  Untracked listeners do not support
+// access logs.
+//
+// The format is text with the following directives:
+//
+//	%h  remote IP           %r  remote address (ip:port)
+//	%l  local address       %n  listener name
+//	%t  accept time, as [02/Jan/2006:15:04:05 -0700]
+//	%T  duration in seconds %D  duration in microseconds
+//	%I  bytes received      %O  bytes sent
+//	%v  TLS version         %c  TLS cipher suite
+//	%s  TLS server name     %P  negotiated (ALPN) protocol
+//	%x  correlation ID      %%  a literal %
+//
+// Fields which are unknown, such as TLS fields on a plain connection, are
+// written as "-".
+func AccessLog(w io.Writer, format string) ListenOption {
+	a := &accessLog{format: format, sink: newRawSink("access log", w)}
+	return func(c *listenConfig) {
+		c.access = a
+	}
+}
+
+// accessLog is the access log of a listener.
+type accessLog struct {
+	format string
+	sink   *logSink
+}
+
+// accessRecord is what an access log records about a connection.
+type accessRecord struct {
+	in, out uint64 // atomic
+	start   time.Time
+}
+
+type tlsStateKey struct{}
+
+// write formats and queues the line for a closed connection.
+func (a *accessLog) write(c *waitConn) {
+	var buf bytes.Buffer
+	now := now()
+	var state *tls.ConnectionState
+	if s, ok := c.meta.Get(tlsStateKey{}).(tls.ConnectionState); ok {
+		state = &s
+	}
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	for i := 0; i < len(a.format); i++ {
+		ch := a.format[i]
+		if ch != '%' || i+1 == len(a.format) {
+			buf.WriteByte(ch)
+			continue
+		}
+		i++
+		switch a.format[i] {
+		case 'h':
+			host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+			buf.WriteString(dash(host))
+		case 'r':
+			buf.WriteString(c.RemoteAddr().String())
+		case 'l':
+			buf.WriteString(c.LocalAddr().String())
+		case 'n':
+			buf.WriteString(c.listener.name())
+		case 't':
+			buf.WriteString(c.access.start.Format("[02/Jan/2006:15:04:05 -0700]"))
+		case 'T':
+			buf.WriteString(strconv.FormatFloat(now.Sub(c.access.start).Seconds(), 'f', 3, 64))
+		case 'D':
+			buf.WriteString(strconv.FormatInt(int64(now.Sub(c.access.start)/time.Microsecond), 10))
+		case 'I':
+			buf.WriteString(strconv.FormatUint(atomic.LoadUint64(&c.access.in), 10))
+		case 'O':
+			buf.WriteString(strconv.FormatUint(atomic.LoadUint64(&c.access.out), 10))
+		case 'x':
+			buf.WriteString(c.id)
+		case 'v', 'c', 's', 'P':
+			buf.WriteString(dash(tlsField(state, a.format[i])))
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(a.format[i])
+		}
+	}
+	buf.WriteByte('\n')
+	a.sink.send(buf.Bytes())
+}
+
+// tlsField returns a TLS directive of an access log format, or "".
+func tlsField(state *tls.ConnectionState, directive byte) string {
+	if state == nil {
+		return ""
+	}
+	switch directive {
+	case 'v':
+		return tlsVersions[state.Version]
+	case 'c':
+		return tls.CipherSuiteName(state.CipherSuite)
+	case 's':
+		return state.ServerName
+	case 'P':
+		return state.NegotiatedProtocol
+	}
+	return ""
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// openAccessLog opens an access log file for the "accesslog" listener spec
+// key.
+func openAccessLog(name string) (io.Writer, error) {
+	f, err := os.OpenFile(name, logOpenFlags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("access log: %s", err)
+	}
+	return f, nil
+}
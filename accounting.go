@@ -0,0 +1,190 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Accounting causes the listener to account for the wall-clock and CPU time
+// of each of its connections, so that the heaviest of them can be found with
+// TopConns or the "topconns" control command.  Wall time runs from when the
+// connection was accepted.  CPU time is that of the goroutine serving the
+// connection with Serve (or ServeWith), which is locked to its thread while
+// it runs so that the thread's clock can be read.  It is unlocked while it
+// waits in Read, so that idle connections do not each hold a thread (of
+// which a process may have at most 10000; see debug.SetMaxThreads), but a
+// handler which blocks elsewhere keeps its thread.  CPU time does not
+// include any goroutines which the handler starts, and is only measured on
+// Linux.
+func Accounting() ListenOption {
+	return func(c *listenConfig) {
+		c.accounting = true
+	}
+}
+
+// A connAccount accumulates the time used by a connection.
+type connAccount struct {
+	start time.Time
+
+	lock sync.Mutex
+	tid  int           // thread serving the connection, while it is measured
+	base time.Duration // CPU time of tid when measuring began
+	cpu  time.Duration // CPU time measured before the current span
+}
+
+// begin starts measuring the CPU time of the calling goroutine, which is
+// locked to its thread until end (or pause) is called.
+func (a *connAccount) begin() {
+	if !cpuAccounting {
+		return
+	}
+	runtime.LockOSThread()
+	tid := gettid()
+	cpu, _ := threadCPU(tid)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.tid, a.base = tid, cpu
+}
+
+// end stops measuring the CPU time of the calling goroutine.
+func (a *connAccount) end() {
+	a.pause()
+}
+
+// pause stops measuring the CPU time of the calling goroutine, and unlocks
+// it from its thread, if it is the goroutine being measured.  It returns
+// whether it was, in which case measuring resumes with begin.  Since the
+// measured goroutine is alone on its thread, it is recognized by the thread.
+func (a *connAccount) pause() bool {
+	if !cpuAccounting {
+		return false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.tid == 0 || a.tid != gettid() {
+		return false
+	}
+	if cpu, ok := threadCPU(a.tid); ok {
+		a.cpu += cpu - a.base
+	}
+	a.tid = 0
+	runtime.UnlockOSThread()
+	return true
+}
+
+// usage returns the time the connection has used so far.
+func (a *connAccount) usage() (wall, cpu time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	cpu = a.cpu
+	if a.tid != 0 {
+		if now, ok := threadCPU(a.tid); ok && now > a.base {
+			cpu += now - a.base
+		}
+	}
+	return since(a.start), cpu
+}
+
+// accountOf returns the account of a connection accepted from a listener
+// with Accounting, unwrapping it as Meta does, or nil.
+func accountOf(conn net.Conn) *connAccount {
+	for conn != nil {
+		if wc, ok := conn.(*waitConn); ok {
+			return wc.account
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil
+}
+
+// A ConnUsage is the time used by an open connection, as accounted by
+// Accounting.
+type ConnUsage struct {
+	Listener string
+	Remote   string
+	ID       string `json:",omitempty"` // Correlation ID
+	Wall     time.Duration
+	CPU      time.Duration // Zero if it is not measured
+}
+
+// TopConns returns the n open connections, of the listeners with
+// Accounting, which have used the most CPU time (or wall-clock time, if
+// byWall is true), in decreasing order of use.  If n is not positive, every
+// such connection is returned.
+func TopConns(n int, byWall bool) []ConnUsage {
+	var usage []ConnUsage
+	for _, w := range activeListeners() {
+		if !w.config.accounting {
+			continue
+		}
+		for _, conn := range w.Conns() {
+			wc, ok := conn.(*waitConn)
+			if !ok || wc.account == nil {
+				continue
+			}
+			wall, cpu := wc.account.usage()
+			usage = append(usage, ConnUsage{w.name(), conn.RemoteAddr().String(), wc.id, wall, cpu})
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if byWall || usage[i].CPU == usage[j].CPU {
+			return usage[i].Wall > usage[j].Wall
+		}
+		return usage[i].CPU > usage[j].CPU
+	})
+	if n > 0 && n < len(usage) {
+		usage = usage[:n]
+	}
+	return usage
+}
+
+// topConnsCommand implements the "topconns" control command.
+func topConnsCommand(w io.Writer, args []string) error {
+	const usage = "usage: topconns [n] [wall]"
+	n, byWall := 10, false
+	for _, arg := range args {
+		switch v, err := strconv.Atoi(arg); {
+		case arg == "wall":
+			byWall = true
+		case err == nil && v > 0:
+			n = v
+		default:
+			return fmt.Errorf(usage)
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "CPU\tWall\tListener\tRemote\tID\n")
+	for _, u := range TopConns(n, byWall) {
+		cpu := "-"
+		if cpuAccounting {
+			cpu = u.CPU.Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", cpu, u.Wall.Round(time.Millisecond), u.Listener, u.Remote, u.ID)
+	}
+	return tw.Flush()
+}
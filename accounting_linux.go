@@ -0,0 +1,40 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// cpuAccounting is true if the CPU time of a thread can be measured.
+const cpuAccounting = true
+
+func gettid() int {
+	return syscall.Gettid()
+}
+
+// threadCPU returns the CPU time used by the given thread of this process,
+// read from its clock as pthread_getcpuclockid would.
+func threadCPU(tid int) (time.Duration, bool) {
+	clock := int32(^tid<<3 | 6) // CPUCLOCK_SCHED, per thread
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, uintptr(clock), uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0, false
+	}
+	return time.Duration(ts.Nano()), true
+}
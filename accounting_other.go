@@ -0,0 +1,33 @@
+// +build !linux
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"time"
+)
+
+// cpuAccounting is false, since the CPU time of a thread cannot be measured
+// on this platform.
+const cpuAccounting = false
+
+func gettid() int {
+	return 0
+}
+
+func threadCPU(tid int) (time.Duration, bool) {
+	return 0, false
+}
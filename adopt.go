@@ -0,0 +1,72 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// adoptListener creates a listener from an inherited descriptor, which it
+// closes (the listener has its own copy).
+func adoptListener(fd int) (net.Listener, error) {
+	if err := checkListenFD(fd); err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("&%d", fd))
+	defer f.Close() // FileListener dups the fd
+	return net.FileListener(f)
+}
+
+// FileListener adopts a listening socket which was passed to this process
+// as the given file descriptor, such as by a supervisor which passes sockets
+// by number.  The descriptor is verified to be a listening socket, and the
+// returned WaitListener tracks its connections like one created by
+// ListenFlag.  The original descriptor is closed.
+//
+// Listeners adopted this way are not passed on by Restart; use ListenFlag
+// with an "&fd" address for that.  Any error is a LifecycleError with code
+// HandoffRejected.
+func FileListener(fd int, opts ...ListenOption) (*WaitListener, error) {
+	under, err := adoptListener(fd)
+	if err != nil {
+		return nil, &LifecycleError{HandoffRejected, "adopt", fmt.Sprintf("&%d", fd), err}
+	}
+	config := new(listenConfig)
+	for _, opt := range opts {
+		opt(config)
+	}
+	Verbose.Printf("Adopted listener on: %s (from fd %d)", under.Addr(), fd)
+	return newWaitListener(under, config), nil
+}
+
+// FilePacketConn adopts a datagram socket which was passed to this process
+// as the given file descriptor.  The descriptor is verified to be a datagram
+// socket and the original descriptor is closed.  Any error is a
+// LifecycleError with code HandoffRejected.
+func FilePacketConn(fd int) (net.PacketConn, error) {
+	if err := checkPacketFD(fd); err != nil {
+		return nil, &LifecycleError{HandoffRejected, "adopt", fmt.Sprintf("&%d", fd), err}
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("&%d", fd))
+	defer f.Close() // FilePacketConn dups the fd
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, &LifecycleError{HandoffRejected, "adopt", fmt.Sprintf("&%d", fd), err}
+	}
+	Verbose.Printf("Adopted packet socket on: %s (from fd %d)", pc.LocalAddr(), fd)
+	return pc, nil
+}
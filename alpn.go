@@ -0,0 +1,119 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+// An ALPNMux is a Handler which dispatches TLS connections to other Handlers
+// based on the protocol negotiated with ALPN, so that a single TLS listener
+// can serve several protocols (e.g. "h2", "http/1.1", and a custom one).
+//
+// For protocols to be negotiated, they must be listed in the NextProtos of
+// the listener's tls.Config; see Configure.
+type ALPNMux struct {
+	// Default handles connections which negotiated no protocol or one which
+	// has no handler.  If it is nil, such connections are closed.
+	Default Handler
+
+	lock     sync.Mutex
+	protos   []string
+	handlers map[string]Handler
+	stats    map[string]*ALPNStats
+}
+
+// ALPNStats holds the connection counts for one protocol.
+type ALPNStats struct {
+	Active int64 // Connections currently being served
+	Total  int64 // Connections served, including active ones
+}
+
+// NewALPNMux returns an empty ALPNMux.
+func NewALPNMux() *ALPNMux {
+	return &ALPNMux{
+		handlers: make(map[string]Handler),
+		stats:    make(map[string]*ALPNStats),
+	}
+}
+
+// Handle registers the handler for the given protocol.  Protocols are
+// preferred in the order in which they are registered.
+func (m *ALPNMux) Handle(proto string, h Handler) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.handlers[proto]; !ok {
+		m.protos = append(m.protos, proto)
+	}
+	m.handlers[proto] = h
+}
+
+// Configure sets config.NextProtos to the registered protocols and returns
+// config, for convenience when passing it to TLS.
+func (m *ALPNMux) Configure(config *tls.Config) *tls.Config {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	config.NextProtos = append([]string(nil), m.protos...)
+	return config
+}
+
+// ServeConn dispatches conn to the handler for its negotiated protocol.
+func (m *ALPNMux) ServeConn(conn net.Conn) {
+	var proto string
+	if tconn, ok := conn.(*tls.Conn); ok {
+		proto = tconn.ConnectionState().NegotiatedProtocol
+	}
+
+	m.lock.Lock()
+	h, ok := m.handlers[proto]
+	if !ok {
+		h = m.Default
+	}
+	st := m.stats[proto]
+	if st == nil {
+		st = new(ALPNStats)
+		m.stats[proto] = st
+	}
+	st.Active++
+	st.Total++
+	m.lock.Unlock()
+
+	defer func() {
+		m.lock.Lock()
+		st.Active--
+		m.lock.Unlock()
+	}()
+
+	if h == nil {
+		Verbose.Printf("No handler for protocol %q from %s", proto, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	h.ServeConn(conn)
+}
+
+// Stats returns the connection counts for each negotiated protocol.
+// Connections which negotiated no protocol are counted under "".
+func (m *ALPNMux) Stats() map[string]ALPNStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats := make(map[string]ALPNStats, len(m.stats))
+	for proto, st := range m.stats {
+		stats[proto] = *st
+	}
+	return stats
+}
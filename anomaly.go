@@ -0,0 +1,125 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AnomalyCheck, if positive, causes Run and RunContext to look for signs of
+// trouble this often, and to write a dump of all goroutine stacks to DumpDir
+// when they see one, so that the evidence exists even if nobody was watching
+// at the time.  The anomalies are:
+//
+//   - at least AcceptErrorSpike errors from Accept across the listeners
+//     since the previous check;
+//   - the number of goroutines doubling from the lowest seen since the
+//     previous dump (and growing by at least 100);
+//   - a drain taking more than half of its timeout.
+//
+// At most one dump is written per DumpCooldown; anomalies during the cooldown
+// are only logged.
+var AnomalyCheck time.Duration
+
+// AcceptErrorSpike is the number of accept errors per AnomalyCheck which is
+// considered an anomaly.
+var AcceptErrorSpike = 10
+
+// DumpDir is the directory to which anomaly stack dumps are written.
+var DumpDir = os.TempDir()
+
+// DumpCooldown is the least time between anomaly stack dumps.
+var DumpCooldown = 10 * time.Minute
+
+// The least growth in goroutines which is considered an anomaly, so that
+// small daemons are not dumped for going from 10 goroutines to 20.
+const minGoroutineGrowth = 100
+
+var (
+	anomalyOnce sync.Once
+	anomalyLock sync.Mutex
+	lastDump    time.Time
+	lowestGs    int // lowest goroutine count since the last dump
+)
+
+// watchAnomalies checks for anomalies every AnomalyCheck.
+func watchAnomalies() {
+	var lastErrs uint64
+	for range time.Tick(AnomalyCheck) {
+		var errs uint64
+		for _, w := range activeListeners() {
+			errs += atomic.LoadUint64(&w.acceptErr)
+		}
+		if errs >= lastErrs && errs-lastErrs >= uint64(AcceptErrorSpike) {
+			anomaly("%d accept errors in %s", errs-lastErrs, AnomalyCheck)
+		}
+		lastErrs = errs
+
+		n := runtime.NumGoroutine()
+		anomalyLock.Lock()
+		if lowestGs == 0 || n < lowestGs {
+			lowestGs = n
+		}
+		low := lowestGs
+		anomalyLock.Unlock()
+		if n >= 2*low && n-low >= minGoroutineGrowth {
+			anomaly("goroutines grew from %d to %d", low, n)
+		}
+	}
+}
+
+// anomaly logs an anomaly, and writes a stack dump unless one was written
+// within DumpCooldown.
+func anomaly(format string, args ...interface{}) {
+	what := fmt.Sprintf(format, args...)
+
+	anomalyLock.Lock()
+	next := lastDump.Add(DumpCooldown)
+	cooling := !lastDump.IsZero() && time.Now().Before(next)
+	if !cooling {
+		lastDump, lowestGs = time.Now(), runtime.NumGoroutine()
+	}
+	anomalyLock.Unlock()
+	if cooling {
+		Warning.Printf("Anomaly: %s (no stack dump until %s)", what, next.Format(time.RFC3339))
+		return
+	}
+
+	name, err := writeStackDump(what)
+	if err != nil {
+		Error.Printf("Anomaly: %s; failed to write stack dump: %s", what, err)
+		return
+	}
+	Warning.Printf("Anomaly: %s; wrote stack dump to %s", what, name)
+}
+
+// writeStackDump writes the stacks of all goroutines to a new file in
+// DumpDir, headed by the reason for the dump.
+func writeStackDump(reason string) (string, error) {
+	name := filepath.Join(DumpDir, fmt.Sprintf("%s.%d.%s.stacks",
+		filepath.Base(os.Args[0]), os.Getpid(), time.Now().Format("20060102-150405")))
+	dump := fmt.Sprintf("%s\n\n%s", reason, stack())
+	if err := ioutil.WriteFile(name, []byte(dump), 0600); err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Kinds of stop recorded by beginStop.
+const (
+	stopRestart  = "restart"
+	stopShutdown = "shutdown"
+)
+
+// A HandoffPolicy says which termination signals are forwarded between the
+// generations while both are running during a Restart.
+type HandoffPolicy int
+
+// Policies which can be combined in HandoffSignals.
+const (
+	// HandoffToChild forwards a shutdown signal received by the parent
+	// during a Restart to the child, as a SIGTERM.
+	HandoffToChild HandoffPolicy = 1 << iota
+
+	// HandoffToParent forwards a shutdown signal received by the child while
+	// its parent is still running (draining) to the parent, as a SIGTERM.
+	HandoffToParent
+
+	// HandoffNone forwards nothing: a shutdown signal to the parent during a
+	// Restart only shuts down the parent, and the child continues to serve.
+	// This suits supervisors which signal the old process after a reload.
+	HandoffNone HandoffPolicy = 0
+)
+
+// HandoffSignals is the policy for forwarding termination signals during the
+// handoff window of a Restart, so that a deploy system which stops either
+// process mid-handoff does not leave the other behind.  It should be the same
+// in every generation.
+var HandoffSignals = HandoffToChild
+
+var (
+	stoppingLock sync.Mutex
+	stopping     string      // stopRestart or stopShutdown, once begun
+	stopChild    *os.Process // started by the Restart in progress
+	supersededBy *Reason     // the Shutdown which superseded the Restart
+	parentEcho   bool        // the parent may forward our shutdown back
+)
+
+// isStopping returns true once a Shutdown or Restart has begun.
+func isStopping() bool {
+	stoppingLock.Lock()
+	defer stoppingLock.Unlock()
+	return stopping != ""
+}
+
+// restartSpawned records the child started by a Restart, so that it can be
+// shut down if the Restart is superseded.
+func restartSpawned(p *os.Process) {
+	stoppingLock.Lock()
+	defer stoppingLock.Unlock()
+	stopChild = p
+	if supersededBy != nil {
+		stopChildLocked()
+	}
+}
+
+func stopChildLocked() {
+	if HandoffSignals&HandoffToChild == 0 {
+		Info.Printf("Leaving child %d running (HandoffSignals)", stopChild.Pid)
+		return
+	}
+	if err := stopChild.Signal(syscall.SIGTERM); err != nil {
+		Error.Printf("Failed to shut down child %d: %s", stopChild.Pid, err)
+		return
+	}
+	Info.Printf("Told child %d to shut down", stopChild.Pid)
+}
+
+// supersede turns a Restart in progress into a Shutdown for the given reason:
+// the child it started (if any) is told to shut down (if HandoffSignals
+// includes HandoffToChild), and the functions registered with OnShutdown are
+// called (with ChildServing set if it is not), while this process finishes
+// draining.  It returns false if there is no Restart to supersede, including
+// if it was already superseded.
+func supersede(r Reason) bool {
+	stoppingLock.Lock()
+	if stopping != stopRestart || supersededBy != nil {
+		stoppingLock.Unlock()
+		return false
+	}
+	r.ChildServing = HandoffSignals&HandoffToChild == 0
+	supersededBy = &r
+	Warning.Printf("Shutdown (%s) supersedes the Restart in progress", r)
+	if stopChild != nil {
+		stopChildLocked()
+	}
+	stoppingLock.Unlock()
+
+	shutdownHooks.run(r)
+	return true
+}
+
+// superseded returns the reason for the Shutdown which superseded the Restart
+// in progress, if any.
+func superseded() *Reason {
+	stoppingLock.Lock()
+	defer stoppingLock.Unlock()
+	return supersededBy
+}
+
+// duringStop handles a signal received while a Shutdown or Restart is in
+// progress, and reports whether the process should abort.  A shutdown signal
+// supersedes a Restart, and a restart signal is ignored during a Shutdown;
+// any other request to stop aborts.  Signals are not filtered by SignalDryRun
+// or SignalConfirm here, so that an abort is always immediate.
+func duringStop(sig os.Signal) (abort bool) {
+	switch sigAction(sig) {
+	case sigShutdown:
+		if supersede(signalReason(sig)) {
+			return false
+		}
+		stoppingLock.Lock()
+		defer stoppingLock.Unlock()
+		if parentEcho {
+			// Our own shutdown, forwarded back by the parent
+			parentEcho = false
+			Verbose.Printf("Ignoring %s forwarded by parent %d", sig, parentPID)
+			return false
+		}
+		return true
+	case sigRestart:
+		stoppingLock.Lock()
+		defer stoppingLock.Unlock()
+		if stopping == stopShutdown || supersededBy != nil {
+			Warning.Printf("Ignoring %s: already shutting down", sig)
+			return false
+		}
+		return true
+	case sigStackDump:
+		V(-5).Printf("Stack dump:\n" + stack())
+	case sigStatusDump:
+		go dumpStatus()
+	default:
+		Warning.Printf("Unknown signal: %s", sig)
+	}
+	return false
+}
+
+// forwardToParent forwards a shutdown signal to the parent which started
+// this process with Restart, if HandoffSignals includes HandoffToParent and
+// the parent is still running.
+func forwardToParent(sig os.Signal) {
+	if HandoffSignals&HandoffToParent == 0 || parentPID == 0 || os.Getppid() != parentPID {
+		return
+	}
+	stoppingLock.Lock()
+	parentEcho = HandoffSignals&HandoffToChild != 0
+	stoppingLock.Unlock()
+	if err := syscall.Kill(parentPID, syscall.SIGTERM); err != nil {
+		Warning.Printf("Failed to forward %s to parent %d: %s", sig, parentPID, err)
+		return
+	}
+	Info.Printf("Forwarded %s to parent %d", sig, parentPID)
+}
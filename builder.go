@@ -0,0 +1,62 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+)
+
+// Addr sets the address on which a listener created by NewListener listens:
+// a TCP address such as ":443", or &fd to adopt a descriptor passed by the
+// parent process.  ListenFlag takes its address as an argument instead.
+func Addr(addr string) ListenOption {
+	return func(c *listenConfig) {
+		c.addr = addr
+	}
+}
+
+// NewListener returns a Listenable configured entirely by its options, for
+// programs which do not use flags.  For example:
+//
+//	public := daemon.NewListener(daemon.Addr(":443"), daemon.TLS(cfg), daemon.Name("public"), daemon.MaxConns(1e4))
+//	admin := daemon.NewListener(daemon.Addr("127.0.0.1:8080"), daemon.Name("admin"))
+//
+// The listener is registered like those of ListenFlag: it is started by
+// ListenAll, reported by Listeners and the Status, and passed on by Restart.
+// The new generation must create it again with the same Name (which
+// defaults to the address, and must not be used by another listener),
+// so that it adopts the socket instead of binding a new one; it likewise
+// adopts a socket of the same name from systemd.  If the address cannot be
+// resolved, the error is returned by Listen.
+func NewListener(opts ...ListenOption) Listenable {
+	l := &listenFlag{mode: "tcp", net: "tcp"}
+	for _, opt := range opts {
+		opt(&l.config)
+	}
+	if l.config.name == "" {
+		l.config.name = l.config.addr
+	}
+	l.flag, l.proto, l.base = l.config.name, l.config.name, l.config
+	if findListenFlag(l.flag) != nil {
+		panic("daemon: duplicate listener " + l.flag)
+	}
+	if l.config.addr == "" {
+		l.err = fmt.Errorf("listener %q has no Addr", l.flag)
+	} else {
+		l.err = l.setAddr(l.config.addr)
+	}
+	Register(l)
+	return l
+}
@@ -0,0 +1,130 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"syscall"
+)
+
+var checkpointHooks, restoreHooks hookList
+
+// OnCheckpoint registers a function to be called by Checkpoint, after
+// accepting has been paused.
+func OnCheckpoint(fn func() error) {
+	checkpointHooks.add(fn)
+}
+
+// OnRestore registers a function to be called by Restored, before
+// accepting is resumed.  This is the place to re-arm timers and refresh
+// anything which depends on wall-clock time.
+func OnRestore(fn func() error) {
+	restoreHooks.add(fn)
+}
+
+// Checkpoint quiesces the daemon so that it can be checkpointed (e.g. by
+// CRIU): every listener stops handing out new connections (connections
+// which arrive in the meantime are held until Restored), the OnCheckpoint
+// hooks are run, and the logs are flushed.  The first hook error, if any, is
+// returned, but the daemon remains paused until Restored is called.
+func Checkpoint() error {
+	ws := activeListeners()
+	for _, w := range ws {
+		w.pause()
+	}
+	Info.Printf("Paused %d listener(s) for checkpoint", len(ws))
+	err := checkpointHooks.run("checkpoint")
+	flushLogs(true)
+	return err
+}
+
+// Restored should be called after the process has been restored from a
+// checkpoint.  It verifies that every listener's socket survived the
+// restore, runs the OnRestore hooks, and resumes accepting.  Listeners whose
+// sockets are no longer usable are reported in the returned error (with code
+// HandoffRejected) and remain paused.
+func Restored() error {
+	var errs ListenErrors
+	for _, w := range activeListeners() {
+		if err := w.validate(); err != nil {
+			errs = append(errs, &LifecycleError{HandoffRejected, "restore", w.Addr().String(), err})
+			continue
+		}
+		defer w.resume()
+	}
+	if err := restoreHooks.run("restore"); err != nil {
+		errs = append(errs, err)
+	}
+	Info.Printf("Resuming listeners after restore")
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validate checks that the listener's socket is still a listening socket.
+func (w *WaitListener) validate() error {
+	sc, ok := w.Listener.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("unknown listener type: %T", w.Listener)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var checkErr error
+	if err := raw.Control(func(fd uintptr) {
+		checkErr = checkListenFD(int(fd))
+	}); err != nil {
+		return err
+	}
+	return checkErr
+}
+
+// pause causes accepted connections to be held until resume is called.
+func (w *WaitListener) pause() {
+	w.gateLock.Lock()
+	defer w.gateLock.Unlock()
+	if w.gate == nil {
+		w.gate = make(chan bool)
+	}
+}
+
+// resume releases any connections held since pause.
+func (w *WaitListener) resume() {
+	w.gateLock.Lock()
+	defer w.gateLock.Unlock()
+	if w.gate != nil {
+		close(w.gate)
+		w.gate = nil
+	}
+}
+
+// wait blocks while the listener is paused.  It returns false if the
+// listener is stopped in the meantime.
+func (w *WaitListener) wait() bool {
+	w.gateLock.Lock()
+	gate := w.gate
+	w.gateLock.Unlock()
+	if gate == nil {
+		return true
+	}
+	select {
+	case <-gate:
+		return true
+	case <-w.stop:
+		return false
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientCAs causes the listener, which must also use TLS (see TLS and
+// TLSListenFlag), to require client certificates issued by one of the CAs in
+// the PEM file caFile and not revoked by any of the CRLs in crlFile (PEM or
+// DER), if it is not empty.  The files are loaded by Listen, and again by
+// ReloadTLS, so that the CAs can be rotated without a Restart (although the
+// process started by a Restart loads them afresh as well).
+//
+// A reload is validated before it is swapped in: the CAs must parse, and each
+// CRL must be signed by one of them and not be past its next update.  If it
+// fails, the files loaded before are kept.  Each handshake uses the files
+// which were current when it started.  The listener's TLS config should not
+// set GetConfigForClient, which ClientCAs uses to make the swap atomic.
+func ClientCAs(caFile, crlFile string) ListenOption {
+	return func(c *listenConfig) {
+		c.clientCAs = &clientCAs{caFile: caFile, crlFile: crlFile}
+	}
+}
+
+// clientCAs are the client CAs of a listener.
+type clientCAs struct {
+	caFile, crlFile string
+
+	flag    string       // for logs
+	base    *tls.Config  // the listener's config, without the CAs
+	current atomic.Value // *tls.Config, with the CAs
+}
+
+var (
+	clientCALock sync.Mutex
+	clientCAList []*clientCAs // which have been loaded
+)
+
+// loadClientCAs loads the client CAs of the listener for the named flag, if
+// it has any, into its TLS config.
+func (c *listenConfig) loadClientCAs(flag string) error {
+	ca := c.clientCAs
+	switch {
+	case ca == nil:
+		return nil
+	case c.tls == nil:
+		return errors.New("client CAs require TLS")
+	}
+	ca.flag, ca.base = flag, c.tls
+	if err := ca.load(); err != nil {
+		return err
+	}
+	config := c.tls.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return ca.current.Load().(*tls.Config), nil
+	}
+	c.tls, c.clientCAs = config, nil
+
+	clientCALock.Lock()
+	defer clientCALock.Unlock()
+	clientCAList = append(clientCAList, ca)
+	return nil
+}
+
+// load reads and validates the files, and swaps them in if they are valid.
+func (ca *clientCAs) load() error {
+	data, err := ioutil.ReadFile(ca.caFile)
+	if err != nil {
+		return fmt.Errorf("client CAs: %s", err)
+	}
+	cas, err := parseCerts(data)
+	if err != nil {
+		return fmt.Errorf("client CAs: %s: %s", ca.caFile, err)
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range cas {
+		pool.AddCert(cert)
+	}
+
+	revoked := map[string]bool{}
+	if ca.crlFile != "" {
+		data, err := ioutil.ReadFile(ca.crlFile)
+		if err != nil {
+			return fmt.Errorf("client CRL: %s", err)
+		}
+		if err := parseCRLs(data, cas, revoked); err != nil {
+			return fmt.Errorf("client CRL: %s: %s", ca.crlFile, err)
+		}
+	}
+
+	config := ca.base.Clone()
+	config.ClientCAs = pool
+	if config.ClientAuth != tls.VerifyClientCertIfGiven {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// The check is made in VerifyConnection, which (unlike
+	// VerifyPeerCertificate) also runs when a session is resumed, so that a
+	// revoked client cannot keep its access with a session ticket.
+	verify := ca.base.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		certs := cs.PeerCertificates
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		for _, cert := range certs {
+			if revoked[string(cert.RawIssuer)+"/"+cert.SerialNumber.String()] {
+				return fmt.Errorf("client certificate %q (serial %s) is revoked", cert.Subject, cert.SerialNumber)
+			}
+		}
+		if verify != nil {
+			return verify(cs)
+		}
+		return nil
+	}
+	ca.current.Store(config)
+	Verbose.Printf("Loaded %d client CA(s) and %d revocation(s) for --%s", len(cas), len(revoked), ca.flag)
+	return nil
+}
+
+// parseCerts parses the certificates in PEM data.
+func parseCerts(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	return certs, nil
+}
+
+// parseCRLs parses the CRLs in data, which is PEM or else a single DER CRL,
+// validates them against the CAs, and adds their revoked certificates to
+// revoked.
+func parseCRLs(data []byte, cas []*x509.Certificate, revoked map[string]bool) error {
+	var ders [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+
+	now := now()
+	for _, der := range ders {
+		crl, err := x509.ParseCRL(der)
+		if err != nil {
+			return err
+		}
+		if crl.HasExpired(now) {
+			return fmt.Errorf("CRL of %s expired at %s", crl.TBSCertList.Issuer, crl.TBSCertList.NextUpdate.Format(time.RFC3339))
+		}
+		var issuer *x509.Certificate
+		for _, cert := range cas {
+			if cert.Subject.ToRDNSequence().String() == crl.TBSCertList.Issuer.String() && cert.CheckCRLSignature(crl) == nil {
+				issuer = cert
+				break
+			}
+		}
+		if issuer == nil {
+			return fmt.Errorf("CRL of %s is not signed by any of the CAs", crl.TBSCertList.Issuer)
+		}
+		for _, r := range crl.TBSCertList.RevokedCertificates {
+			revoked[string(issuer.RawSubject)+"/"+r.SerialNumber.String()] = true
+		}
+	}
+	return nil
+}
+
+// ReloadTLS reloads the client CAs and CRLs of every listener with
+// ClientCAs (see there), for instance when the application reloads its
+// configuration.  If a listener's files fail to validate, it keeps its
+// current ones; the failures are logged, and the first is returned as a
+// LifecycleError with code ReloadFailed.  Reloads can also be requested with
+// the "reloadtls" control command.
+func ReloadTLS() error {
+	clientCALock.Lock()
+	cas := append([]*clientCAs(nil), clientCAList...)
+	clientCALock.Unlock()
+
+	var first error
+	for _, ca := range cas {
+		if err := ca.load(); err != nil {
+			Error.Printf("Failed to reload the client CAs of --%s (keeping the current ones): %s", ca.flag, err)
+			if first == nil {
+				first = &LifecycleError{ReloadFailed, "reload", ca.flag, err}
+			}
+			continue
+		}
+		Info.Printf("Reloaded the client CAs of --%s", ca.flag)
+	}
+	return first
+}
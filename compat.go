@@ -0,0 +1,74 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"log"
+)
+
+// defaultDaemon is the Daemon returned by Default, once it has been created.
+var defaultDaemon *Daemon
+
+// Default returns the process's default Daemon, which stands in for the
+// package-level API: its flags are named without a prefix, its listeners are
+// every registered Listenable which does not belong to another Daemon
+// (including those created by the package-level ListenFlag), and its log is
+// the process's log (see LogFileFlag).  Code written against the
+// package-level functions can thus be moved onto the Daemon methods, one
+// call at a time, with Default taking the place of New; the package-level
+// functions remain, and behave as the methods of Default do.
+//
+// Like any other Daemon, Default owns the signals if it is created first.
+func Default() *Daemon {
+	daemonLock.Lock()
+	defer daemonLock.Unlock()
+	if defaultDaemon == nil {
+		defaultDaemon = &Daemon{name: ""}
+		defaultDaemon.logger = log.New(logTee{stderrSink}, logPrefix, logFlags)
+		daemons = append(daemons, defaultDaemon)
+		if signalOwner == nil {
+			signalOwner = defaultDaemon
+		}
+	}
+	return defaultDaemon
+}
+
+// isDefault returns true if d is the Daemon returned by Default.
+func (d *Daemon) isDefault() bool {
+	return d.name == ""
+}
+
+// unowned returns the registered Listenables which belong to no Daemon
+// other than Default.
+func unowned() []Listenable {
+	owned := map[Listenable]bool{}
+	daemonLock.Lock()
+	for _, d := range daemons {
+		if !d.isDefault() {
+			for _, l := range d.registered() {
+				owned[l] = true
+			}
+		}
+	}
+	daemonLock.Unlock()
+
+	var ls []Listenable
+	for _, l := range registered() {
+		if !owned[l] {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
@@ -0,0 +1,148 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// MaxConns limits the number of connections which the listener has open at
+// once.  Connections beyond the limit are rejected as soon as they are
+// accepted, and shed by the listener's OverloadPolicy; with ShedQueue, they
+// wait for another connection to close.  Each time the limit is reached, it
+// is counted in a metric, and logged unless it was logged since the listener
+// last fell below 90% of the limit.
+func MaxConns(n int) ListenOption {
+	return func(c *listenConfig) {
+		c.maxConns, c.maxConnsBlock = n, false
+	}
+}
+
+// MaxConnsBlock is like MaxConns, except that once the limit is reached, the
+// listener stops accepting until a connection closes (like
+// golang.org/x/net/netutil.LimitListener), so that new connections wait in
+// the kernel's backlog instead of being accepted and shed.
+func MaxConnsBlock(n int) ListenOption {
+	return func(c *listenConfig) {
+		c.maxConns, c.maxConnsBlock = n, true
+	}
+}
+
+// parseMaxConns parses the value of the "maxconns" spec key, N[:block].
+func parseMaxConns(val string) (ListenOption, error) {
+	ns, mode, hasMode := cut(val, ":")
+	n, err := strconv.Atoi(ns)
+	switch {
+	case err != nil:
+		return nil, err
+	case !hasMode:
+		return MaxConns(n), nil
+	case mode == "block":
+		return MaxConnsBlock(n), nil
+	}
+	return nil, fmt.Errorf("unknown mode %q (want block)", mode)
+}
+
+// awaitConnSlot waits, if the listener has MaxConnsBlock, until it has fewer
+// than the maximum connections open, and takes a slot for the next one.  It
+// returns false if the listener is stopped first.
+func (w *WaitListener) awaitConnSlot() bool {
+	if w.connSlots == nil {
+		return true
+	}
+	select {
+	case w.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+	w.limitReached("blocking accept")
+	select {
+	case w.connSlots <- struct{}{}:
+		return true
+	case <-w.stop:
+		return false
+	}
+}
+
+// limitReached counts and (unless it was already logged) logs that the
+// listener has reached its MaxConns.
+func (w *WaitListener) limitReached(action string) {
+	w.metrics.limited.Add(1)
+	if atomic.CompareAndSwapInt32(&w.atLimit, 0, 1) {
+		Warning.Printf("Listener %s reached its limit of %d connections; %s", w.name(), w.config.maxConns, action)
+	}
+}
+
+// openCapped returns the number of connections counted against MaxConns.
+func (w *WaitListener) openCapped() int64 {
+	if w.connSlots != nil {
+		return int64(len(w.connSlots))
+	}
+	return atomic.LoadInt64(&w.capped)
+}
+
+// limitConns counts conn against the listener's MaxConns, shedding it if the
+// limit has been reached.
+func (w *WaitListener) limitConns(conn net.Conn) bool {
+	max := int64(w.config.maxConns)
+	if max <= 0 {
+		return true
+	}
+	capped := func() {
+		switch c := conn.(type) {
+		case *waitConn:
+			c.capped = true
+		case *countedConn:
+			c.capped = true
+		}
+	}
+	if w.connSlots != nil {
+		// The slot was taken by awaitConnSlot
+		capped()
+		return true
+	}
+	acquire := func() bool {
+		if atomic.AddInt64(&w.capped, 1) > max {
+			atomic.AddInt64(&w.capped, -1)
+			return false
+		}
+		capped()
+		return true
+	}
+	if acquire() {
+		return true
+	}
+	w.limitReached("shedding new connections")
+	return w.shed(conn, fmt.Errorf("%d connections already open", max), acquire)
+}
+
+// releaseConn records that a connection has closed, if it was counted by
+// limitConns.
+func (w *WaitListener) releaseConn(capped bool) {
+	if !capped {
+		return
+	}
+	if w.connSlots != nil {
+		<-w.connSlots
+	} else {
+		atomic.AddInt64(&w.capped, -1)
+	}
+	if atomic.LoadInt32(&w.atLimit) == 1 && w.openCapped() < int64(w.config.maxConns)*9/10 {
+		atomic.StoreInt32(&w.atLimit, 0)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ControlMode is the permission mode of the control socket.
+var ControlMode os.FileMode = 0600
+
+// How long a control connection may take to send its command and read the
+// reply.
+const controlTimeout = 30 * time.Second
+
+// A ControlFunc implements a control command.  It writes its reply to w; if
+// it returns an error, the error is written after the reply.
+type ControlFunc func(w io.Writer, args []string) error
+
+type controlCommand struct {
+	help string
+	fn   ControlFunc
+}
+
+var (
+	controlLock     sync.Mutex
+	controlCommands = map[string]controlCommand{}
+)
+
+// ControlCommand registers a command for the control socket, replacing any
+// existing command with the same name.  The help text should describe the
+// arguments, e.g. "<cidr> [hard] - evict connections".
+func ControlCommand(name, help string, fn ControlFunc) {
+	controlLock.Lock()
+	defer controlLock.Unlock()
+	controlCommands[name] = controlCommand{help, fn}
+}
+
+func init() {
+	ControlCommand("help", "- list commands", func(w io.Writer, args []string) error {
+		controlLock.Lock()
+		defer controlLock.Unlock()
+		var names []string
+		for name := range controlCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s %s\n", name, controlCommands[name].help)
+		}
+		return nil
+	})
+	ControlCommand("status", "- print the Status as JSON", func(w io.Writer, args []string) error {
+		_, err := w.Write(CurrentStatus().JSON())
+		return err
+	})
+	ControlCommand("stacks", "- dump the stacks of all goroutines", func(w io.Writer, args []string) error {
+		_, err := io.WriteString(w, stack())
+		return err
+	})
+	ControlCommand("sockets", "[listener] - show the kernel's state of the TCP sockets, like ss", socketsCommand)
+	ControlCommand("reloadtls", "- reload the client CAs and CRLs of the TLS listeners", func(w io.Writer, args []string) error {
+		if err := ReloadTLS(); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "reloaded\n")
+		return nil
+	})
+	ControlCommand("topconns", "[n] [wall] - show the open connections which have used the most CPU (or wall) time; see Accounting", topConnsCommand)
+	ControlCommand("panics", "- list the sites at which handlers have panicked", panicsCommand)
+	ControlCommand("goroutinediff", "[duration|seconds] - show the stacks whose goroutines grew over the duration (default 10s)", goroutineDiffCommand)
+	ControlCommand("logsample", "[n] - show or set the sampling of per-connection logs", func(w io.Writer, args []string) error {
+		switch len(args) {
+		case 0:
+		case 1:
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				return fmt.Errorf("usage: logsample [n], with n >= 1")
+			}
+			SetConnLogSample(n)
+		default:
+			return fmt.Errorf("usage: logsample [n]")
+		}
+		fmt.Fprintf(w, "logging 1 in %d connections\n", ConnLogSample())
+		return nil
+	})
+	ControlCommand("logoverrides", "[spec|-] - show, set or (with -) clear the log level overrides", logOverridesCommand)
+	ControlCommand("logschedule", "[spec|-] - show, set or (with -) clear the LogSchedule", logScheduleCommand)
+	ControlCommand("evict", "<cidr> [hard] - close connections from the given addresses", func(w io.Writer, args []string) error {
+		if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "hard") {
+			return fmt.Errorf("usage: evict <cidr> [hard]")
+		}
+		n, err := EvictRemote(args[0], len(args) == 2)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "evicted %d connection(s)\n", n)
+		return nil
+	})
+}
+
+type controlFlag struct {
+	path     string
+	listener net.Listener
+}
+
+func (f *controlFlag) String() string {
+	return f.path
+}
+
+func (f *controlFlag) Set(s string) error {
+	f.path = s
+	return nil
+}
+
+// Listen creates the control socket and starts serving it, if a path has
+// been given.  A stale socket left at the path (for instance by the previous
+// generation of a restarted daemon) is replaced.  Since the control socket is
+// not passed on by Restart, Listen returns nil (and no error) if there is no
+// path.
+func (f *controlFlag) Listen() (net.Listener, error) {
+	if f.listener != nil || f.path == "" {
+		return f.listener, nil
+	}
+	l, err := listenUnix(f.path, ControlMode, "control socket")
+	if err != nil {
+		return nil, err
+	}
+	Verbose.Printf("Listening for control commands on: %s", f.path)
+	f.listener = l
+	go f.serve()
+	return l, nil
+}
+
+// listenUnix creates a unix socket at path with the given mode, replacing a
+// stale socket left there.  The socket is removed on Shutdown, unless a child
+// is left serving on it.
+func listenUnix(path string, mode os.FileMode, what string) (net.Listener, error) {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, &LifecycleError{BindFailed, "listen", what, err}
+	}
+	// The previous generation must not unlink the socket of the next when
+	// it exits, so it is only removed on Shutdown.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, &LifecycleError{BindFailed, "listen", what, err}
+	}
+	chownOnDrop(path)
+	OnShutdown(func(r Reason) {
+		if !r.ChildServing {
+			os.Remove(path)
+		}
+	})
+	return l, nil
+}
+
+func (f *controlFlag) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			Error.Printf("Control socket: %s", err)
+			return
+		}
+		go serveConn(conn, HandlerFunc(control))
+	}
+}
+
+// control reads a single command from conn and writes its reply.
+func control(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+
+	controlLock.Lock()
+	cmd, ok := controlCommands[args[0]]
+	controlLock.Unlock()
+	if !ok {
+		fmt.Fprintf(conn, "error: unknown command %q (try help)\n", args[0])
+		return
+	}
+	Info.Printf("Control command: %s", strings.Join(args, " "))
+	if err := cmd.fn(conn, args[1:]); err != nil {
+		fmt.Fprintf(conn, "error: %s\n", err)
+	}
+}
+
+// ControlFlag registers a flag with the given name which sets the path of a
+// unix socket on which the daemon accepts control commands (see
+// ControlCommand).  A client connects, writes a single line containing the
+// command and its arguments, and reads the reply until the connection is
+// closed; for example:
+//
+//	echo status | nc -U /run/mydaemon.ctl
+//
+// The returned Listenable is registered, so the socket is created by
+// ListenAll, or it can be created directly by calling Listen.
+func ControlFlag(name, defPath string) Listenable {
+	f := &controlFlag{path: defPath}
+	flag.Var(f, name, "Path of the control socket (if set)")
+	Register(f)
+	return f
+}
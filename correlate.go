@@ -0,0 +1,148 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// CorrelationHeader is the HTTP header from which CorrelationMiddleware takes
+// the correlation ID of a request, and in which it returns it.
+var CorrelationHeader = "X-Request-ID"
+
+// Longest correlation ID accepted from a client.
+const maxCorrelationID = 128
+
+var correlationSeq uint64 // atomic
+
+// newCorrelationPrefix returns a random prefix from r, so that the IDs made
+// by different processes (including generations of the same daemon) differ.
+func newCorrelationPrefix(r Rand) string {
+	var b [4]byte
+	randLock.Lock()
+	r.Read(b[:])
+	randLock.Unlock()
+	return hex.EncodeToString(b[:]) + "-"
+}
+
+// NewCorrelationID returns a new ID, unique to this process and very likely
+// unique among processes.  Every connection accepted from a WaitListener is
+// assigned one (see ConnCorrelationID).
+func NewCorrelationID() string {
+	return currentProviders().correlationPrefix + strconv.FormatUint(atomic.AddUint64(&correlationSeq, 1), 36)
+}
+
+type correlationKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying the correlation ID, which
+// is included in the log records written with it by PrintfContext.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by ctx, or "".
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// A correlatedConn is a connection with a correlation ID.
+type correlatedConn interface {
+	CorrelationID() string
+}
+
+// ConnCorrelationID returns the correlation ID of a connection accepted from
+// a WaitListener, which is included in the listener's logs of the connection
+// (and its access log, with %x).  Wrapping connections are unwrapped as by
+// Meta.  If conn was not accepted from a WaitListener, it returns "".
+func ConnCorrelationID(conn net.Conn) string {
+	for conn != nil {
+		if cc, ok := conn.(correlatedConn); ok {
+			return cc.CorrelationID()
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	return ""
+}
+
+// ConnContext returns a copy of ctx carrying the correlation ID of conn, if
+// it has one.  Its signature is that of http.Server.ConnContext, so that the
+// requests on a connection are logged with its ID:
+//
+//	srv := &http.Server{Handler: h, ConnContext: daemon.ConnContext}
+//
+// A raw connection handler can use it to log through PrintfContext:
+//
+//	ctx := daemon.ConnContext(context.Background(), conn)
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if id := ConnCorrelationID(conn); id != "" {
+		return WithCorrelationID(ctx, id)
+	}
+	return ctx
+}
+
+// CorrelationMiddleware returns a handler which gives each request a
+// correlation ID before serving it with h.  The ID is taken from the
+// CorrelationHeader of the request, so that it propagates from the client or
+// a proxy, or else a new one is made.  It is set in the CorrelationHeader of
+// the response and carried by the request's context, so that handlers log
+// with it through PrintfContext:
+//
+//	daemon.Info.PrintfContext(r.Context(), "Fetching %s", key)
+//
+// A request to pass the ID on to should have it set in its
+// CorrelationHeader.
+func CorrelationMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(CorrelationHeader)
+		if !validCorrelationID(id) {
+			id = NewCorrelationID()
+		}
+		w.Header().Set(CorrelationHeader, id)
+		h.ServeHTTP(w, r.WithContext(WithCorrelationID(r.Context(), id)))
+	})
+}
+
+// validCorrelationID reports whether an ID from a client is safe to log: it
+// must be short, printable ASCII without spaces.
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > maxCorrelationID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// PrintfContext is like Printf, except that the record includes the
+// correlation ID carried by ctx, if any (see WithCorrelationID).
+func (l Logger) PrintfContext(ctx context.Context, format string, args ...interface{}) {
+	if l > logThreshold(1) {
+		return
+	}
+	l.outputTo(logger, "", CorrelationID(ctx), 3, format, args)
+}
@@ -0,0 +1,266 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// A Daemon is one of several independent logical services embedded in a
+// single process.  Each Daemon has its own set of listeners, which it starts
+// and reports on separately, and may have its own log file.  Everything
+// which is inherently per-process is shared: the flags, Restart (which passes
+// on the listeners of every Daemon, each under its own flag), and the
+// handling of signals, which is done by a single Daemon (see OwnSignals).
+//
+// The flags of a Daemon are named with its name as a prefix, e.g. a listener
+// named "http" of the Daemon named "api" is set with --api.http, so that two
+// instances of the same service can coexist.  A process started by Restart
+// must create its Daemons with the same names before parsing its flags.
+type Daemon struct {
+	name string
+
+	lock      sync.Mutex
+	listeners []Listenable
+	logFile   string
+	sink      *logSink // nil unless the Daemon has its own log file
+	logger    *log.Logger
+}
+
+var (
+	daemonLock  sync.Mutex
+	daemons     []*Daemon
+	signalOwner *Daemon
+)
+
+// New returns a Daemon with the given name, which must be unique within the
+// process.  The first Daemon created owns the signals, unless another calls
+// OwnSignals.  The empty name is reserved for Default.
+func New(name string) *Daemon {
+	if name == "" {
+		panic("daemon: Daemon with no name (see Default)")
+	}
+	d := &Daemon{name: name}
+	d.logger = log.New(logTee{stderrSink}, logPrefix+name+": ", logFlags)
+
+	daemonLock.Lock()
+	defer daemonLock.Unlock()
+	for _, other := range daemons {
+		if other.name == name {
+			panic("daemon: duplicate Daemon " + name)
+		}
+	}
+	daemons = append(daemons, d)
+	if signalOwner == nil {
+		signalOwner = d
+	}
+	return d
+}
+
+// Name returns the name of the Daemon.
+func (d *Daemon) Name() string {
+	return d.name
+}
+
+// flagName returns the name of the Daemon's flag with the given name.
+func (d *Daemon) flagName(name string) string {
+	if d.isDefault() {
+		return name
+	}
+	return d.name + "." + name
+}
+
+// ListenFlag is like the package-level ListenFlag, except that the flag is
+// named with the Daemon's prefix and the listener belongs to the Daemon.
+// The listener is also registered with the process, so that it is passed on
+// by Restart and reported by Listeners.
+func (d *Daemon) ListenFlag(name, netw, addr, proto string, opts ...ListenOption) Listenable {
+	l := ListenFlag(d.flagName(name), netw, addr, proto, opts...)
+	for _, lf := range l.(*listenFlag).all() {
+		lf.daemon = d.name
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.listeners = append(d.listeners, l)
+	return l
+}
+
+// Register adds a Listenable to the set which is started by the Daemon's
+// ListenAll.  (The Listenables of a Daemon can also be started by the
+// package-level ListenAll, with those of every other Daemon.)
+func (d *Daemon) Register(l Listenable) {
+	Register(l)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.listeners = append(d.listeners, l)
+}
+
+func (d *Daemon) registered() []Listenable {
+	if d.isDefault() {
+		return unowned()
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return withSiblings(d.listeners)
+}
+
+// ListenAll is like the package-level ListenAll, but only starts the
+// Daemon's own Listenables.
+func (d *Daemon) ListenAll(release bool) error {
+	return listenAll(d.registered(), release)
+}
+
+// Listeners returns the status of the Daemon's ListenFlags.
+func (d *Daemon) Listeners() []ListenerStatus {
+	return listenerStatus(d.registered())
+}
+
+// active returns the Daemon's WaitListeners which are listening.
+func (d *Daemon) active() []*WaitListener {
+	var ws []*WaitListener
+	for _, l := range d.registered() {
+		if lf, ok := l.(*listenFlag); ok {
+			if w := lf.current(); w != nil {
+				ws = append(ws, w)
+			}
+		}
+	}
+	return ws
+}
+
+type daemonLogFlag struct {
+	d    *Daemon
+	mode os.FileMode
+}
+
+func (f *daemonLogFlag) String() string {
+	if f.d == nil {
+		return ""
+	}
+	f.d.lock.Lock()
+	defer f.d.lock.Unlock()
+	return f.d.logFile
+}
+
+func (f *daemonLogFlag) Set(s string) error {
+	if s == "" {
+		// Passed on by Restart when unset
+		return nil
+	}
+	file, err := os.OpenFile(s, logOpenFlags, f.mode)
+	if err != nil {
+		return err
+	}
+	sink := newFileSink(file)
+
+	f.d.lock.Lock()
+	old := f.d.sink
+	f.d.logFile, f.d.sink = s, sink
+	f.d.logger.SetOutput(logTee{stderrSink, sink})
+	f.d.lock.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// LogFileFlag registers a flag, named with the Daemon's prefix, which sets a
+// file to which the Daemon's own log records (see Printf) are written, in
+// addition to standard error, instead of the process's log file.  Like the
+// package-level LogFileFlag, records are locked while generations overlap.
+func (d *Daemon) LogFileFlag(name string, mode os.FileMode) {
+	if d.isDefault() {
+		LogFileFlag(name, mode)
+		return
+	}
+	flag.Var(&daemonLogFlag{d, mode}, d.flagName(name), fmt.Sprintf("Log file for %s (if set)", d.name))
+}
+
+// Printf writes a log message to the Daemon's log at the given level, which
+// behaves as Logger.Printf.  Records are prefixed with the Daemon's name.
+// If the Daemon has no log file, they are written to the process's log.
+func (d *Daemon) Printf(l Logger, format string, args ...interface{}) {
+	if l > logThreshold(1) {
+		return
+	}
+	d.lock.Lock()
+	to := logger
+	if d.sink != nil {
+		to = d.logger
+	}
+	d.lock.Unlock()
+	l.outputTo(to, d.name, "", 3, format, args)
+}
+
+// daemonSinks returns the log destinations of every Daemon with a log file.
+func daemonSinks() []*logSink {
+	daemonLock.Lock()
+	defer daemonLock.Unlock()
+	var sinks []*logSink
+	for _, d := range daemons {
+		d.lock.Lock()
+		if d.sink != nil {
+			sinks = append(sinks, d.sink)
+		}
+		d.lock.Unlock()
+	}
+	return sinks
+}
+
+// OwnSignals makes this Daemon the one whose Run handles the process's
+// signals.  It should be called before any Daemon is Run.
+func (d *Daemon) OwnSignals() {
+	daemonLock.Lock()
+	defer daemonLock.Unlock()
+	signalOwner = d
+}
+
+// ownsSignals returns true if d handles the process's signals.
+func (d *Daemon) ownsSignals() bool {
+	daemonLock.Lock()
+	defer daemonLock.Unlock()
+	return signalOwner == d
+}
+
+// Run runs the Daemon until ctx is cancelled or the process stops.  The
+// Daemon which owns the signals runs RunContext and returns what it returns.
+// Every other Daemon waits for ctx to be cancelled (returning ctx.Err()) or
+// for the owner to begin a Shutdown or Restart, and then for its own
+// connections to drain, returning ErrShutdown or ErrRestarted.  The drain
+// itself, and its timeout, are managed by the owner.
+func (d *Daemon) Run(ctx context.Context) error {
+	if d.ownsSignals() {
+		return RunContext(ctx)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-Lamed:
+	}
+	for _, w := range d.active() {
+		w.Wait()
+	}
+	stoppingLock.Lock()
+	defer stoppingLock.Unlock()
+	if stopping == stopRestart && supersededBy == nil {
+		return ErrRestarted
+	}
+	return ErrShutdown
+}
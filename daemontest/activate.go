@@ -0,0 +1,109 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemontest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// A Socket is a listening socket to be passed to a daemon by Activate.
+type Socket struct {
+	Name string // Name in LISTEN_FDNAMES; the daemon adopts it for the ListenFlag of this name
+	Addr string // TCP address to listen on, such as "127.0.0.1:0"
+}
+
+// An Activation is a daemon started by Activate.
+type Activation struct {
+	Cmd   *exec.Cmd
+	Addrs []string // Bound address of each Socket, in order
+
+	files []*os.File
+}
+
+// Activate starts binary with the given arguments the way systemd starts a
+// socket-activated service: the sockets are bound first and passed to it as
+// descriptors 3, 4, 5..., described by LISTEN_FDS, LISTEN_FDNAMES and
+// LISTEN_PID.  This lets an application test in CI that its listeners are
+// adopted (see ListenFlag) without a real init system.
+//
+// Like systemd, Activate keeps its own copy of the sockets open until Close,
+// so connections queue rather than being refused while the daemon restarts or
+// after it has crashed.
+//
+// launchd is not simulated: it hands over sockets through
+// launch_activate_socket rather than the environment, and package daemon
+// does not adopt them.
+func Activate(binary string, args []string, sockets ...Socket) (*Activation, error) {
+	a := new(Activation)
+	var names []string
+	for _, s := range sockets {
+		l, err := net.Listen("tcp", s.Addr)
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		file, err := l.(*net.TCPListener).File()
+		l.Close()
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		a.files = append(a.files, file)
+		a.Addrs = append(a.Addrs, l.Addr().String())
+		names = append(names, s.Name)
+	}
+
+	// LISTEN_PID must be the pid of the daemon itself, which is only known
+	// once it has been forked, so a shell sets it before exec'ing the binary.
+	shArgs := append([]string{"-c", `LISTEN_PID=$$ exec "$0" "$@"`, binary}, args...)
+	a.Cmd = exec.Command("/bin/sh", shArgs...)
+	a.Cmd.Env = append(os.Environ(),
+		fmt.Sprintf("LISTEN_FDS=%d", len(a.files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"))
+	a.Cmd.ExtraFiles = a.files
+	a.Cmd.Stdout, a.Cmd.Stderr = os.Stdout, os.Stderr
+	if err := a.Cmd.Start(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Stop sends SIGTERM to the activated process and waits for it to exit.  If
+// it has restarted, its children are not signalled.
+func (a *Activation) Stop() error {
+	if err := a.Cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	return a.Cmd.Wait()
+}
+
+// Close closes the sockets held by Activate, as systemd does when the socket
+// unit is stopped.
+func (a *Activation) Close() error {
+	var err error
+	for _, file := range a.files {
+		if e := file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	a.files = nil
+	return err
+}
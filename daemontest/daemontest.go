@@ -0,0 +1,300 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package daemontest is a load-test harness for the core promise of package
+// daemon: that a Restart or Shutdown drains connections without resetting
+// them or accepting any of them twice.
+//
+// A Scenario starts a target daemon (such as the one in the target
+// subdirectory) which serves connections with Handler, drives it with many
+// concurrent clients while restarting it, and reports what the clients saw.
+package daemontest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"kylelemons.net/go/daemon"
+)
+
+// The greeting written by Handler at the start of each connection.
+const greeting = "HELLO"
+
+// Handler returns a daemon.Handler which speaks the load-test protocol: it
+// writes a greeting line containing its pid and generation, and then echoes
+// each line it receives.  Once the daemon is lame it closes the connection
+// after the next reply, so that clients see a clean close between requests.
+func Handler() daemon.Handler {
+	return daemon.HandlerFunc(func(conn net.Conn) {
+		fmt.Fprintf(conn, "%s %d %d\n", greeting, os.Getpid(), daemon.Generation())
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write([]byte(line)); err != nil {
+				return
+			}
+			select {
+			case <-daemon.Lamed:
+				return
+			default:
+			}
+		}
+	})
+}
+
+// Load describes the clients which drive a daemon.
+type Load struct {
+	Addr     string        // Address of the daemon
+	Conns    int           // Concurrent client connections
+	Requests int           // Requests per connection before reconnecting
+	Timeout  time.Duration // Time allowed for each request
+}
+
+// Result counts what the clients saw.
+type Result struct {
+	Conns         uint64 // Connections established
+	Requests      uint64 // Successful round trips
+	Closed        uint64 // Connections closed cleanly by the daemon between requests
+	Refused       uint64 // Connections which could not be established
+	Resets        uint64 // Connections which failed during a request
+	DoubleAccepts uint64 // Connections which were greeted more than once
+	Mismatches    uint64 // Replies which did not match the request
+
+	lock       sync.Mutex
+	generation int // newest seen
+	pid        int // pid of the newest generation
+}
+
+// Err returns an error describing the failures in r, if any.  It should only
+// be called once the load has stopped.
+func (r *Result) Err() error {
+	var failed []string
+	for _, f := range []struct {
+		name string
+		n    uint64
+	}{
+		{"refused", r.Refused},
+		{"reset", r.Resets},
+		{"double-accepted", r.DoubleAccepts},
+		{"mismatched", r.Mismatches},
+	} {
+		if f.n > 0 {
+			failed = append(failed, fmt.Sprintf("%d %s", f.n, f.name))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("daemontest: %s", strings.Join(failed, ", "))
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("%d conns, %d requests, %d clean closes, %d refused, %d resets, %d double accepts, %d mismatches",
+		r.Conns, r.Requests, r.Closed, r.Refused, r.Resets, r.DoubleAccepts, r.Mismatches)
+}
+
+// newest returns the pid of the newest generation seen.
+func (r *Result) newest() (pid, generation int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.pid, r.generation
+}
+
+func (r *Result) saw(pid, generation int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.pid == 0 || generation > r.generation {
+		r.pid, r.generation = pid, generation
+	}
+}
+
+// Run drives the daemon until stop is closed, adding to r.
+func (l Load) Run(r *Result, stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for i := 0; i < l.Conns; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for seq := 0; ; seq++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				l.session(r, fmt.Sprintf("%d-%d", client, seq))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// session makes a single connection and sends up to l.Requests requests.
+func (l Load) session(r *Result, id string) {
+	conn, err := net.DialTimeout("tcp", l.Addr, l.Timeout)
+	if err != nil {
+		atomic.AddUint64(&r.Refused, 1)
+		time.Sleep(10 * time.Millisecond)
+		return
+	}
+	defer conn.Close()
+	atomic.AddUint64(&r.Conns, 1)
+
+	in := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(l.Timeout))
+	hello, err := in.ReadString('\n')
+	var pid, gen int
+	if _, scanErr := fmt.Sscanf(hello, greeting+" %d %d\n", &pid, &gen); err != nil || scanErr != nil {
+		atomic.AddUint64(&r.Resets, 1)
+		return
+	}
+	r.saw(pid, gen)
+
+	for i := 0; i < l.Requests; i++ {
+		req := id + "-" + strconv.Itoa(i) + "\n"
+		conn.SetDeadline(time.Now().Add(l.Timeout))
+		if _, err := conn.Write([]byte(req)); err != nil {
+			// The daemon may have closed the connection after the previous
+			// reply; this is only a failure if it was not at a boundary.
+			if isClosed(in) {
+				atomic.AddUint64(&r.Closed, 1)
+			} else {
+				atomic.AddUint64(&r.Resets, 1)
+			}
+			return
+		}
+		reply, err := in.ReadString('\n')
+		switch {
+		case err != nil && reply == "" && i > 0:
+			// Closed after the previous reply, before reading this request
+			atomic.AddUint64(&r.Closed, 1)
+			return
+		case err != nil:
+			atomic.AddUint64(&r.Resets, 1)
+			return
+		case strings.HasPrefix(reply, greeting):
+			atomic.AddUint64(&r.DoubleAccepts, 1)
+			return
+		case reply != req:
+			atomic.AddUint64(&r.Mismatches, 1)
+			return
+		}
+		atomic.AddUint64(&r.Requests, 1)
+	}
+}
+
+// isClosed returns true if the daemon closed the connection cleanly.
+func isClosed(in *bufio.Reader) bool {
+	_, err := in.ReadByte()
+	return err != nil && !strings.Contains(err.Error(), "reset")
+}
+
+// A Scenario starts a daemon, drives it with Load, and restarts it.
+type Scenario struct {
+	Binary string   // Target daemon, which must serve Handler on Load.Addr
+	Args   []string // Arguments to the target
+
+	// Sockets, if set, are bound by the harness and passed to the target
+	// with Activate, as if by systemd socket activation.
+	Sockets []Socket
+
+	Load     Load
+	Restarts int           // Number of times to send SIGHUP
+	Interval time.Duration // Time between restarts, and before the first
+}
+
+// Run runs the scenario, finishing with a Shutdown (SIGTERM) of the newest
+// generation once the load has stopped.  The returned error is only for
+// failures of the harness itself; use Result.Err for those of the daemon.
+func (s Scenario) Run() (*Result, error) {
+	var cmd *exec.Cmd
+	if len(s.Sockets) > 0 {
+		a, err := Activate(s.Binary, s.Args, s.Sockets...)
+		if err != nil {
+			return nil, err
+		}
+		defer a.Close()
+		cmd = a.Cmd
+	} else {
+		cmd = exec.Command(s.Binary, s.Args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+	}
+	go cmd.Wait()
+	if err := waitFor(s.Load.Addr, 10*time.Second); err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+
+	r := new(Result)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Load.Run(r, stop)
+	}()
+
+	for i := 0; i < s.Restarts; i++ {
+		time.Sleep(s.Interval)
+		pid, gen := r.newest()
+		if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+			return r, fmt.Errorf("restart %d: %s", i+1, err)
+		}
+		if err := r.waitGeneration(gen+1, s.Interval+10*time.Second); err != nil {
+			return r, fmt.Errorf("restart %d: %s", i+1, err)
+		}
+	}
+	time.Sleep(s.Interval)
+
+	close(stop)
+	<-done
+	pid, _ := r.newest()
+	return r, syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// waitGeneration waits for a client to be greeted by the given generation.
+func (r *Result) waitGeneration(gen int, timeout time.Duration) error {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, g := r.newest(); g >= gen {
+			return nil
+		}
+	}
+	return fmt.Errorf("generation %d never served a connection", gen)
+}
+
+// waitFor waits for something to be listening at addr.
+func waitFor(addr string, timeout time.Duration) error {
+	var err error
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("daemon never listened on %s: %s", addr, err)
+}
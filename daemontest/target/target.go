@@ -0,0 +1,85 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// target is a daemon for daemontest.  It serves the load-test protocol, and
+// with --drive it also runs a Scenario against a copy of itself.
+//
+//	go build && ./target --drive --conns=1000 --restarts=5
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"kylelemons.net/go/daemon"
+	"kylelemons.net/go/daemon/daemontest"
+)
+
+var (
+	listen = daemon.ListenFlag("listen", "tcp", "127.0.0.1:12113", "daemontest", daemon.ServeWith(daemontest.Handler()))
+
+	drive    = flag.Bool("drive", false, "Run a scenario against a copy of this binary instead of serving")
+	conns    = flag.Int("conns", 1000, "Concurrent client connections (with --drive)")
+	requests = flag.Int("requests", 20, "Requests per connection (with --drive)")
+	restarts = flag.Int("restarts", 3, "Restarts to perform (with --drive)")
+	interval = flag.Duration("interval", 2*time.Second, "Time between restarts (with --drive)")
+	reuse    = flag.Bool("reuseport", false, "Serve with ReusePort (with --drive)")
+	activate = flag.Bool("activate", false, "Pass the listener as if by systemd socket activation (with --drive)")
+)
+
+func main() {
+	flag.Parse()
+	if *drive {
+		os.Exit(run())
+	}
+
+	daemon.LameDuck = 10 * time.Second
+	daemon.MustListenAll()
+	daemon.Run()
+}
+
+func run() int {
+	arg := "--listen=" + listen.(fmt.Stringer).String()
+	if *reuse {
+		arg += ",reuseport"
+	}
+	s := daemontest.Scenario{
+		Binary: os.Args[0],
+		Args:   []string{arg},
+		Load: daemontest.Load{
+			Addr:     listen.(fmt.Stringer).String(),
+			Conns:    *conns,
+			Requests: *requests,
+			Timeout:  5 * time.Second,
+		},
+		Restarts: *restarts,
+		Interval: *interval,
+	}
+	if *activate {
+		s.Sockets = []daemontest.Socket{{Name: "listen", Addr: s.Load.Addr}}
+	}
+	r, err := s.Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Scenario failed: %s\n", err)
+		return 2
+	}
+	fmt.Println(r)
+	if err := r.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
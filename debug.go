@@ -0,0 +1,140 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DebugMode is the permission mode of a debug server's unix socket.  It
+// allows the group to connect, so that an agent in the daemon's group can
+// scrape its metrics.
+var DebugMode os.FileMode = 0660
+
+// DebugHandler is the handler of the debug server.  If it is nil,
+// http.DefaultServeMux is used, on which net/http/pprof and expvar register
+// themselves and to which a metrics handler (such as a promtext.Registry)
+// can be added.
+var DebugHandler http.Handler
+
+// How long a debug client may take to send its request headers.
+const debugHeaderTimeout = 10 * time.Second
+
+type debugFlag struct {
+	value    string
+	listener net.Listener
+}
+
+func (f *debugFlag) String() string {
+	return f.value
+}
+
+func (f *debugFlag) Set(s string) error {
+	f.value = s
+	return nil
+}
+
+// Listen starts the debug server, if it has been configured.  As with the
+// control socket, it returns nil (and no error) if it has not.
+func (f *debugFlag) Listen() (net.Listener, error) {
+	if f.listener != nil || f.value == "" {
+		return f.listener, nil
+	}
+	var (
+		l   net.Listener
+		err error
+	)
+	if path := strings.TrimPrefix(f.value, unixPrefix); strings.Contains(path, "/") {
+		if l, err = listenUnix(path, DebugMode, "debug socket"); err != nil {
+			return nil, err
+		}
+	} else {
+		lf := findListenFlag(f.value)
+		if lf == nil {
+			err := fmt.Errorf("no ListenFlag named %q", f.value)
+			return nil, &LifecycleError{BindFailed, "listen", "debug server", err}
+		}
+		if l, err = lf.Listen(); err != nil {
+			return nil, err
+		}
+	}
+	Verbose.Printf("Serving debug handlers on: %s", l.Addr())
+	f.listener = l
+	go serveDebug(l)
+	return l, nil
+}
+
+// findListenFlag returns the registered ListenFlag with the given name, or
+// nil.
+func findListenFlag(name string) *listenFlag {
+	for _, l := range registered() {
+		if lf, ok := l.(*listenFlag); ok && lf.flag == name {
+			return lf
+		}
+	}
+	return nil
+}
+
+func serveDebug(l net.Listener) {
+	h := DebugHandler
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	srv := &http.Server{
+		Handler:           DrainMiddleware(h),
+		ReadHeaderTimeout: debugHeaderTimeout,
+	}
+	go func() {
+		// Idle scrapers must not hold up the drain.
+		<-Lamed
+		srv.SetKeepAlivesEnabled(false)
+	}()
+	if err := srv.Serve(l); err != nil && !errors.Is(err, ErrStopped) {
+		Error.Printf("Debug server: %s", err)
+	}
+}
+
+// DebugFlag registers a flag with the given name which configures an HTTP
+// server for DebugHandler, such as pprof and metrics, which is not on a TCP
+// port of its own.  The value is either the path of a unix socket (containing
+// a "/", optionally prefixed by "unix:"), which is created with DebugMode,
+// or the name of a ListenFlag whose listener is dedicated to the debug
+// server, so that the debug server shares its options and is passed on by
+// Restart.  For example:
+//
+//	daemon.ListenFlag("debug_listen", "tcp", "127.0.0.1:0", "debug")
+//	daemon.DebugFlag("debug", "/run/mydaemon/debug.sock")
+//
+// serves the debug handlers on the unix socket, or with --debug=debug_listen
+// on the TCP listener; Prometheus and other agents can scrape the socket
+// with, for instance:
+//
+//	curl --unix-socket /run/mydaemon/debug.sock http://localhost/metrics
+//
+// The returned Listenable is registered, so the server is started by
+// ListenAll, or it can be started directly by calling Listen.
+func DebugFlag(name, def string) Listenable {
+	f := &debugFlag{value: def}
+	flag.Var(f, name, "Path of a unix socket, or name of a listener flag, on which to serve debug handlers (if set)")
+	Register(f)
+	return f
+}
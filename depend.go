@@ -0,0 +1,149 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// StartJitter, if positive, causes AwaitDependencies to first sleep for a
+// random duration up to this long, so that a fleet of daemons started at once
+// does not reach its dependencies at once.
+var StartJitter time.Duration
+
+// How often an unreachable dependency is retried.
+const dependRetry = 500 * time.Millisecond
+
+type dependency struct {
+	name, network, addr string
+	timeout             time.Duration
+}
+
+var (
+	dependLock sync.Mutex
+	depends    []dependency
+	holds      int             // AwaitDependencies and readiness checks waiting
+	held       []*WaitListener // listeners paused while holds > 0
+)
+
+// DependOn declares that the daemon should not accept connections until the
+// named dependency accepts connections at the given address (e.g. "tcp",
+// "db:5432" or "unix", "/run/cache.sock").  AwaitDependencies waits up to
+// timeout for it.
+func DependOn(name, network, addr string, timeout time.Duration) {
+	dependLock.Lock()
+	defer dependLock.Unlock()
+	depends = append(depends, dependency{name, network, addr, timeout})
+}
+
+// AwaitDependencies sleeps for StartJitter and then waits for each dependency
+// declared with DependOn to become reachable.  Connections accepted by
+// listeners in the meantime are held until it returns.  If a dependency
+// cannot be reached within its timeout, an error with the code
+// DependencyFailed is logged and returned (in a ListenErrors); the listeners
+// are released nonetheless.
+//
+// Until AwaitDependencies returns, startup is not complete (see
+// StartupTimeout).
+func AwaitDependencies() error {
+	ready := StartupTask("dependencies")
+	defer ready()
+
+	hold()
+	defer release()
+	dependLock.Lock()
+	deps := append([]dependency(nil), depends...)
+	dependLock.Unlock()
+
+	if StartJitter > 0 {
+		d := time.Duration(randInt63n(int64(StartJitter)))
+		Info.Printf("Delaying startup by %s", d)
+		time.Sleep(d)
+	}
+
+	var errs ListenErrors
+	for _, dep := range deps {
+		if err := dep.await(); err != nil {
+			Error.Printf("%s", err)
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// await waits for dep to accept a connection.
+func (dep dependency) await() error {
+	start := time.Now()
+	deadline := start.Add(dep.timeout)
+	for attempt := 1; ; attempt++ {
+		conn, err := net.DialTimeout(dep.network, dep.addr, dependRetry)
+		if err == nil {
+			conn.Close()
+			Info.Printf("Dependency %s (%s) is reachable after %s", dep.name, dep.addr, time.Since(start))
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return &LifecycleError{DependencyFailed, "depend", dep.name, err}
+		}
+		if attempt == 1 {
+			Info.Printf("Waiting up to %s for %s (%s): %s", dep.timeout, dep.name, dep.addr, err)
+		}
+		time.Sleep(dependRetry)
+	}
+}
+
+// hold pauses the active listeners, and those which start listening, until
+// release is called as many times as hold.
+func hold() {
+	active := activeListeners()
+	dependLock.Lock()
+	defer dependLock.Unlock()
+	if holds++; holds > 1 {
+		return
+	}
+	for _, w := range active {
+		w.pause()
+		held = append(held, w)
+	}
+}
+
+// holdIfWaiting pauses w if AwaitDependencies or a readiness check is
+// holding the listeners.
+func holdIfWaiting(w *WaitListener) {
+	dependLock.Lock()
+	defer dependLock.Unlock()
+	if holds > 0 {
+		w.pause()
+		held = append(held, w)
+	}
+}
+
+// release undoes a hold, resuming the held listeners after the last one.
+func release() {
+	dependLock.Lock()
+	defer dependLock.Unlock()
+	if holds--; holds > 0 {
+		return
+	}
+	for _, w := range held {
+		w.resume()
+	}
+	holds, held = 0, nil
+}
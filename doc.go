@@ -14,4 +14,9 @@
 
 // Package daemon implements utilities useful in writing daemons,
 // including logging, restarting, and privilege dropping.
+//
+// The package-level functions act on the process as a whole, which is
+// represented by the Default Daemon.  New code should prefer the methods of a
+// Daemon, and kylelemons.net/go/daemon/v2, whose surface is built around
+// them; both versions can be used in the same program while it migrates.
 package daemon
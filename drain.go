@@ -0,0 +1,110 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"time"
+)
+
+// DrainAbandon, if positive, keeps a Restart or Shutdown from being held
+// hostage by a handful of stragglers: once DrainAbandon or fewer connections
+// remain, or the drain deadline is reached, the remaining connections are
+// closed (each one is logged, and first given to the OnDrainConn function of
+// its listener) and the Restart or Shutdown proceeds instead of aborting.
+var DrainAbandon = 0
+
+// drainPoll is how often the remaining connection count is checked when
+// DrainAbandon is set.
+var drainPoll = 100 * time.Millisecond
+
+// drain waits for all connections on the given listeners to close.  It
+// returns a LifecycleError with code DrainTimeout if they do not finish in
+// time.
+func drain(ports []*WaitListener, timeout time.Duration) error {
+	start := time.Now()
+	defer func() {
+		metrics.Histogram(metricDrainSeconds, "Time taken to drain connections").Observe(time.Since(start).Seconds())
+	}()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for _, w := range ports {
+			w.Wait()
+		}
+		time.Sleep(injectedDelay(faultDrain))
+	}()
+
+	var poll <-chan time.Time
+	if DrainAbandon > 0 {
+		ticker := time.NewTicker(drainPoll)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	var stalled <-chan time.Time
+	if AnomalyCheck > 0 {
+		stall := time.NewTimer(timeout / 2)
+		defer stall.Stop()
+		stalled = stall.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-poll:
+			if n := remaining(ports); n > 0 && n <= DrainAbandon {
+				abandon(ports, "%d connection(s) remaining", n)
+				poll = nil
+			}
+		case <-stalled:
+			anomaly("drain stalled: %d connection(s) remaining after %s", remaining(ports), time.Since(start))
+		case <-deadline.C:
+			if DrainAbandon <= 0 {
+				return &LifecycleError{DrainTimeout, "drain", "", ErrTimeout}
+			}
+			abandon(ports, "drain deadline of %s reached", timeout)
+			select {
+			case <-done:
+				return nil
+			case <-time.After(time.Second):
+				return &LifecycleError{DrainTimeout, "drain", "", ErrTimeout}
+			}
+		}
+	}
+}
+
+// remaining returns the number of open connections on the listeners.
+func remaining(ports []*WaitListener) int {
+	n := 0
+	for _, w := range ports {
+		n += w.Active()
+	}
+	return n
+}
+
+// abandon closes all remaining connections on the listeners.
+func abandon(ports []*WaitListener, why string, args ...interface{}) {
+	Warning.Printf("Abandoning remaining connections: "+why, args...)
+	goodbye(ports)
+	for _, w := range ports {
+		for _, conn := range w.Conns() {
+			Info.Printf("Abandoning connection: (local) %s <- %s (remote)", conn.LocalAddr(), conn.RemoteAddr())
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// ChildEnv, if non-nil, is the environment (as "key=value" strings) with
+// which Restart and Fork start the child, instead of this process's
+// environment.  The variables which this package uses to pass the listeners,
+// state, and generation to the child are added regardless.
+var ChildEnv []string
+
+// ScrubEnv lists variables to remove from the child's environment, such as
+// secrets which are only needed when the first generation starts.  A name
+// ending in "*" removes every variable with that prefix.
+var ScrubEnv []string
+
+var (
+	envLock  sync.Mutex
+	envHooks []func(env []string) []string
+)
+
+// OnChildEnv registers a function which returns the environment of a child
+// started by Restart or Fork, given the environment after ChildEnv and
+// ScrubEnv have been applied.  Functions are called in the order they were
+// registered, and each may add, change, or remove variables.
+func OnChildEnv(fn func(env []string) []string) {
+	envLock.Lock()
+	defer envLock.Unlock()
+	envHooks = append(envHooks, fn)
+}
+
+// childEnv returns the environment for a child, before this package's own
+// variables are added.
+func childEnv() []string {
+	env := ChildEnv
+	if env == nil {
+		env = os.Environ()
+	}
+	env = scrub(append([]string(nil), env...), ScrubEnv)
+
+	envLock.Lock()
+	hooks := append([]func([]string) []string(nil), envHooks...)
+	envLock.Unlock()
+	for _, fn := range hooks {
+		env = fn(env)
+	}
+	return env
+}
+
+// scrub removes the variables matching names from env.
+func scrub(env, names []string) []string {
+	if len(names) == 0 {
+		return env
+	}
+	kept := env[:0]
+	for _, kv := range env {
+		key, _, _ := cut(kv, "=")
+		if !envMatches(key, names) {
+			kept = append(kept, kv)
+		}
+	}
+	if n := len(env) - len(kept); n > 0 {
+		Verbose.Printf("Removed %d variable(s) from the child's environment", n)
+	}
+	return kept
+}
+
+func envMatches(key string, names []string) bool {
+	for _, name := range names {
+		if prefix := strings.TrimSuffix(name, "*"); prefix != name {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == name {
+			return true
+		}
+	}
+	return false
+}
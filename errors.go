@@ -0,0 +1,119 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An ErrorCode classifies a lifecycle failure.  ErrorCodes are themselves
+// errors, so that
+//
+//	errors.Is(err, daemon.BindFailed)
+//
+// can be used to check whether an error returned by this package is of a
+// particular class.
+type ErrorCode int
+
+// Lifecycle error codes.
+const (
+	BindFailed       ErrorCode = iota + 1 // A listener could not be created
+	DupFailed                             // A listener's descriptor could not be duplicated
+	SpawnFailed                           // A child process could not be started
+	DrainTimeout                          // Connections did not finish in time
+	HandoffRejected                       // An inherited descriptor was not usable
+	DependencyFailed                      // A dependency could not be reached
+	HandoffLost                           // A Restart crashed before its child was ready
+	ReadinessFailed                       // A readiness check did not pass in time
+	ReloadFailed                          // Reloaded files did not validate
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	BindFailed:       "BindFailed",
+	DupFailed:        "DupFailed",
+	SpawnFailed:      "SpawnFailed",
+	DrainTimeout:     "DrainTimeout",
+	HandoffRejected:  "HandoffRejected",
+	DependencyFailed: "DependencyFailed",
+	HandoffLost:      "HandoffLost",
+	ReadinessFailed:  "ReadinessFailed",
+	ReloadFailed:     "ReloadFailed",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
+}
+
+func (c ErrorCode) Error() string {
+	return "daemon: " + c.String()
+}
+
+// A LifecycleError is returned by the non-exiting functions in this package
+// when a listener, restart, or shutdown operation fails.
+type LifecycleError struct {
+	Code ErrorCode
+	Op   string // Operation which failed, e.g. "listen"
+	Name string // Name of the flag or listener involved, if any
+	Err  error  // Underlying error
+}
+
+func (e *LifecycleError) Error() string {
+	msg := "daemon: " + e.Op
+	if e.Name != "" {
+		msg += " " + e.Name
+	}
+	msg += ": " + e.Code.String()
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *LifecycleError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the ErrorCode of e.
+func (e *LifecycleError) Is(target error) bool {
+	code, ok := target.(ErrorCode)
+	return ok && code == e.Code
+}
+
+// CodeOf returns the ErrorCode of the first LifecycleError in err's chain, or
+// zero if there is none.
+func CodeOf(err error) ErrorCode {
+	var le *LifecycleError
+	if errors.As(err, &le) {
+		return le.Code
+	}
+	return 0
+}
+
+// errorCodeOf returns the code of the first lifecycle error among args.
+func errorCodeOf(args []interface{}) ErrorCode {
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			if code := CodeOf(err); code != 0 {
+				return code
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ParseCIDR parses an IP address or CIDR block into a network, treating a
+// bare address as a single-host network.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// remoteIP returns the IP address of the remote end of conn, or nil.
+func remoteIP(conn net.Conn) net.IP {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// Evict closes every tracked connection from this listener whose remote
+// address is within the given network, and returns how many were closed.
+//
+// If hard is false, the connections' read deadlines are set to the current
+// time, so that handlers blocked in (or next calling) Read get a timeout error
+// and can finish up and close the connection themselves.  If hard is true,
+// the connections are reset and closed immediately.
+func (w *WaitListener) Evict(network *net.IPNet, hard bool) int {
+	evicted := 0
+	for _, conn := range w.Conns() {
+		ip := remoteIP(conn)
+		if ip == nil || !network.Contains(ip) {
+			continue
+		}
+		evicted++
+		if !hard {
+			Verbose.Printf("Evicting connection: (local) %s <- %s (remote)", conn.LocalAddr(), conn.RemoteAddr())
+			conn.SetReadDeadline(time.Now())
+			continue
+		}
+		Verbose.Printf("Resetting connection: (local) %s <- %s (remote)", conn.LocalAddr(), conn.RemoteAddr())
+		resetConn(conn)
+	}
+	return evicted
+}
+
+// EvictRemote evicts connections from the given IP address or CIDR block on
+// every registered listener (see WaitListener.Evict) and returns how many
+// were evicted.  This is intended for removing a misbehaving client without
+// restarting the daemon.
+func EvictRemote(cidr string, hard bool) (int, error) {
+	network, err := ParseCIDR(cidr)
+	if err != nil {
+		return 0, err
+	}
+	evicted := 0
+	for _, w := range activeListeners() {
+		evicted += w.Evict(network, hard)
+	}
+	Info.Printf("Evicted %d connection(s) from %s", evicted, network)
+	return evicted, nil
+}
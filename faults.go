@@ -0,0 +1,25 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+// The points at which faults can be injected when the package is built with
+// the daemonfaults tag (see InjectFault).  Without the tag, injected and
+// injectedDelay never inject anything and cost nothing.
+const (
+	faultDup     = "dup"
+	faultSpawn   = "spawn"
+	faultDrain   = "drain"
+	faultHandoff = "handoff"
+)
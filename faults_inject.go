@@ -0,0 +1,112 @@
+// +build daemonfaults
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A FaultPoint is a place in the lifecycle at which InjectFault can make the
+// daemon fail.
+type FaultPoint string
+
+// Points at which faults can be injected.
+const (
+	FaultDup     FaultPoint = faultDup     // WaitListener.Dup fails, so Restart cannot pass the listener on
+	FaultSpawn   FaultPoint = faultSpawn   // Restart fails to start the new process
+	FaultDrain   FaultPoint = faultDrain   // Draining takes Delay longer than the connections do
+	FaultHandoff FaultPoint = faultHandoff // Restart leaves the listener out of those passed to the new process
+)
+
+// A Fault describes a failure for InjectFault to simulate.
+type Fault struct {
+	Point FaultPoint
+	Name  string        // Listener (by its Name) to which it applies, or "" for any; ignored for FaultSpawn and FaultDrain
+	Err   error         // Error to fail with; defaults to one naming the Point
+	Delay time.Duration // For FaultDrain
+	Count int           // Number of times it applies, or 0 for every time
+}
+
+var (
+	faultLock sync.Mutex
+	faults    []*Fault
+)
+
+// InjectFault makes the daemon fail as f describes, so that tests can
+// exercise the failure paths of an application against the daemon's actual
+// behavior; for example, a FaultHandoff makes the new process of a Restart
+// bind the listener's address itself, as it would if the descriptor had been
+// lost.  It is only available when the package is built with the
+// daemonfaults tag:
+//
+//	go test -tags daemonfaults ./...
+//
+// Faults are injected in this process only; the process started by a
+// Restart does not inherit them.
+func InjectFault(f Fault) {
+	faultLock.Lock()
+	defer faultLock.Unlock()
+	faults = append(faults, &f)
+}
+
+// ClearFaults removes every fault added by InjectFault.
+func ClearFaults() {
+	faultLock.Lock()
+	defer faultLock.Unlock()
+	faults = nil
+}
+
+// takeFault returns the first fault at the point which applies to name, if
+// there is one, and counts it as used.
+func takeFault(point, name string) *Fault {
+	faultLock.Lock()
+	defer faultLock.Unlock()
+	for i, f := range faults {
+		if string(f.Point) != point || (f.Name != "" && name != "" && f.Name != name) {
+			continue
+		}
+		if f.Count > 0 {
+			if f.Count--; f.Count == 0 {
+				faults = append(faults[:i:i], faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// injected returns the error injected at the point for name, if any.
+func injected(point, name string) error {
+	f := takeFault(point, name)
+	switch {
+	case f == nil:
+		return nil
+	case f.Err != nil:
+		return f.Err
+	}
+	return fmt.Errorf("injected %s fault", point)
+}
+
+// injectedDelay returns the delay injected at the point, if any.
+func injectedDelay(point string) time.Duration {
+	if f := takeFault(point, ""); f != nil {
+		return f.Delay
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"sync"
+	"time"
+)
+
+// FDCheck, if positive, causes Run and RunContext to check the number of open
+// file descriptors this often, warning when it reaches FDWarnRatio of the
+// limit.  Running out of descriptors is the most common reason for Accept to
+// start failing in a long-running daemon.
+var FDCheck time.Duration
+
+// FDWarnRatio is the fraction of the descriptor limit at which FDCheck warns.
+var FDWarnRatio = 0.8
+
+// FDStats holds the number of open file descriptors, by type.
+type FDStats struct {
+	Open    int // Total open descriptors
+	Limit   int // Soft limit on open descriptors (RLIMIT_NOFILE)
+	Sockets int
+	Files   int // Regular files
+	Pipes   int
+	Other   int // Directories, devices, etc.
+}
+
+var (
+	fdLock sync.Mutex
+	fdLast FDStats
+	fdOnce sync.Once
+)
+
+// FDs counts the file descriptors which are currently open.
+func FDs() (FDStats, error) {
+	var s FDStats
+	err := countFDs(&s) // provided in OS-specific files
+	return s, err
+}
+
+// LastFDs returns the result of the most recent FDCheck, or the zero value if
+// none has been made.
+func LastFDs() FDStats {
+	fdLock.Lock()
+	defer fdLock.Unlock()
+	return fdLast
+}
+
+// watchFDs checks the descriptor count every FDCheck.  It only warns when
+// the count first crosses the threshold, and again after it recovers.
+func watchFDs() {
+	warned := false
+	for range time.Tick(FDCheck) {
+		s, err := FDs()
+		if err != nil {
+			Warning.Printf("Failed to count open fds: %s", err)
+			continue
+		}
+		fdLock.Lock()
+		fdLast = s
+		fdLock.Unlock()
+
+		high := s.Limit > 0 && float64(s.Open) >= FDWarnRatio*float64(s.Limit)
+		switch {
+		case high && !warned:
+			Warning.Printf("%d of %d fds are open (%d sockets, %d files, %d pipes, %d other)",
+				s.Open, s.Limit, s.Sockets, s.Files, s.Pipes, s.Other)
+		case !high && warned:
+			Info.Printf("%d of %d fds are open", s.Open, s.Limit)
+		}
+		warned = high
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// inheritedEnv is the environment variable in which the descriptors
+// passed to a child with Inherit are recorded, as name=fd pairs.
+const inheritedEnv = "DAEMON_INHERITED_FDS"
+
+var (
+	inheritLock sync.Mutex
+	inheritable = map[string]*os.File{}
+)
+
+// Inherit marks the given file to be passed on to processes started by
+// Restart, where it can be retrieved with InheritedFile(name).
+//
+// Before a child is started, every other descriptor above standard error is
+// marked close-on-exec, so that children do not accumulate descriptors which
+// were leaked by (or inherited by) the parent.  Descriptors opened by this
+// package, such as the log file, are always opened close-on-exec.
+func Inherit(name string, f *os.File) {
+	inheritLock.Lock()
+	defer inheritLock.Unlock()
+	inheritable[name] = f
+}
+
+// InheritedFile returns the file passed to this process with the given name
+// by a parent which called Inherit, or nil if there was none.  It should be
+// called at most once per name, since closing the returned file closes the
+// inherited descriptor.
+func InheritedFile(name string) *os.File {
+	for _, pair := range strings.Split(os.Getenv(inheritedEnv), ",") {
+		eq := strings.Index(pair, "=")
+		if eq < 0 || pair[:eq] != name {
+			continue
+		}
+		fd, err := strconv.Atoi(pair[eq+1:])
+		if err != nil {
+			Warning.Printf("bad inherited fd %q: %s", pair, err)
+			return nil
+		}
+		return os.NewFile(uintptr(fd), name)
+	}
+	return nil
+}
+
+// passInherited adds the files marked by Inherit to the command.
+func passInherited(cmd *exec.Cmd) {
+	inheritLock.Lock()
+	defer inheritLock.Unlock()
+
+	var pairs []string
+	for name, f := range inheritable {
+		// The extra files list doesn't include stdin/out/err
+		fd := 3 + len(cmd.ExtraFiles)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, fd))
+	}
+	cmd.Env = append(cmd.Env, inheritedEnv+"="+strings.Join(pairs, ","))
+}
@@ -0,0 +1,116 @@
+// +build linux darwin
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// openFDs returns the descriptors which are open in this process.
+func openFDs() ([]int, error) {
+	dir := "/dev/fd"
+	if runtime.GOOS == "linux" {
+		dir = "/proc/self/fd"
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	self := int(d.Fd())
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var fds []int
+	for _, name := range names {
+		fd, err := strconv.Atoi(name)
+		if err != nil || fd == self {
+			continue
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+// closeOnExec marks every open descriptor above standard error as
+// close-on-exec.  Descriptors which should be passed to a child must be
+// listed in its ExtraFiles, which are inherited regardless.
+func closeOnExec() {
+	fds, err := openFDs()
+	if err != nil {
+		Warning.Printf("Failed to list open fds: %s", err)
+		return
+	}
+	for _, fd := range fds {
+		if fd > 2 {
+			syscall.CloseOnExec(fd)
+		}
+	}
+}
+
+// countFDs fills in the counts of open descriptors, by type, and the limit.
+func countFDs(s *FDStats) error {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return err
+	}
+	s.Limit = int(lim.Cur)
+
+	fds, err := openFDs()
+	if err != nil {
+		return err
+	}
+	for _, fd := range fds {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			// closed since it was listed
+			continue
+		}
+		s.Open++
+		switch st.Mode & syscall.S_IFMT {
+		case syscall.S_IFSOCK:
+			s.Sockets++
+		case syscall.S_IFREG:
+			s.Files++
+		case syscall.S_IFIFO:
+			s.Pipes++
+		default:
+			s.Other++
+		}
+	}
+	return nil
+}
+
+// A fileID identifies the file (or socket) to which a descriptor refers, so
+// that copies of the same descriptor can be recognized.
+type fileID struct {
+	dev, ino uint64
+}
+
+// fdID returns the fileID of the file to which fd refers.
+func fdID(fd int) (fileID, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fileID{}, err
+	}
+	return fileID{uint64(st.Dev), uint64(st.Ino)}, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// GoodbyeTimeout bounds the time an OnDrainConn function may spend writing
+// to a connection before it is closed.
+var GoodbyeTimeout = time.Second
+
+// tlsConnKey is the Meta key of the TLS connection wrapping a connection.
+type tlsConnKey struct{}
+
+// OnDrainConn sets a function which is called for each of the listener's
+// connections which is still open when it is abandoned at the drain deadline
+// (see DrainAbandon), so that it can write a final protocol message, such as
+// an SMTP "421" or a Redis "-LOADING" error, before the connection is
+// closed.  For a TLS listener, fn is given the TLS connection.  The functions
+// for all of the remaining connections are called in parallel; their reads
+// and writes time out after GoodbyeTimeout, and the connections are closed
+// then even if some of them have not returned.
+func OnDrainConn(fn func(conn net.Conn)) ListenOption {
+	return func(c *listenConfig) {
+		c.goodbye = fn
+	}
+}
+
+// goodbye calls the OnDrainConn function of each listener, if it has one,
+// with its remaining connections, and waits for them to return or for
+// GoodbyeTimeout to pass.
+func goodbye(ports []*WaitListener) {
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(GoodbyeTimeout)
+	for _, w := range ports {
+		fn := w.config.goodbye
+		if fn == nil {
+			continue
+		}
+		for _, conn := range w.Conns() {
+			if m := Meta(conn); m != nil {
+				if tconn, ok := m.Get(tlsConnKey{}).(net.Conn); ok {
+					conn = tconn
+				}
+			}
+			conn.SetDeadline(deadline)
+			wg.Add(1)
+			go func(conn net.Conn) {
+				defer wg.Done()
+				defer func() {
+					if r := recover(); r != nil {
+						Warning.Printf("OnDrainConn for %s panicked: %v", conn.RemoteAddr(), r)
+					}
+				}()
+				fn(conn)
+			}(conn)
+		}
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+	}
+}
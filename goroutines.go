@@ -0,0 +1,125 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// goroutineProfile counts the goroutines with each distinct stack.
+type goroutineProfile struct {
+	total  int
+	stacks map[string]int
+}
+
+func profileGoroutines() goroutineProfile {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+
+	// With debug=1, the profile is a header line followed by one record for
+	// each distinct stack, separated by blank lines, each starting with a
+	// line "<count> @ <pcs>".
+	p := goroutineProfile{stacks: map[string]int{}}
+	text := buf.String()
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		text = text[i+1:]
+	}
+	for _, rec := range strings.Split(text, "\n\n") {
+		var n int
+		lines := strings.SplitN(rec, "\n", 2)
+		if len(lines) < 2 {
+			continue
+		}
+		if _, err := fmt.Sscanf(lines[0], "%d @", &n); err != nil {
+			continue
+		}
+		p.stacks[strings.TrimSpace(lines[1])] += n
+		p.total += n
+	}
+	return p
+}
+
+// goroutineDiff takes two goroutine profiles d apart and writes each stack
+// with more goroutines in the second, largest growth first.
+func goroutineDiff(w io.Writer, d time.Duration) {
+	// Both profiles are taken from the same call site, so that the stack of
+	// this goroutine is the same in each.
+	var p [2]goroutineProfile
+	for i := range p {
+		if i > 0 {
+			time.Sleep(d)
+		}
+		p[i] = profileGoroutines()
+	}
+
+	type growth struct {
+		stack      string
+		before, by int
+	}
+	var grown []growth
+	for stack, n := range p[1].stacks {
+		if before := p[0].stacks[stack]; n > before {
+			grown = append(grown, growth{stack, before, n - before})
+		}
+	}
+	sort.Slice(grown, func(i, j int) bool {
+		if grown[i].by != grown[j].by {
+			return grown[i].by > grown[j].by
+		}
+		return grown[i].stack < grown[j].stack
+	})
+
+	fmt.Fprintf(w, "goroutines: %d -> %d over %s\n", p[0].total, p[1].total, d)
+	if len(grown) == 0 {
+		fmt.Fprintf(w, "no stacks grew\n")
+	}
+	for _, g := range grown {
+		fmt.Fprintf(w, "\n+%d (%d -> %d)\n%s\n", g.by, g.before, g.before+g.by, g.stack)
+	}
+}
+
+// goroutineDiffCommand implements the goroutinediff control command.
+func goroutineDiffCommand(w io.Writer, args []string) error {
+	d := 10 * time.Second
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		if n, e := strconv.Atoi(args[0]); e == nil {
+			d = time.Duration(n) * time.Second
+		} else if d, err = time.ParseDuration(args[0]); err != nil {
+			return fmt.Errorf("usage: goroutinediff [duration], e.g. 30s")
+		}
+		if d <= 0 {
+			return fmt.Errorf("usage: goroutinediff [duration], with duration > 0")
+		}
+	default:
+		return fmt.Errorf("usage: goroutinediff [duration]")
+	}
+	// The wait may be longer than the usual deadline of the connection.
+	if conn, ok := w.(net.Conn); ok {
+		conn.SetDeadline(time.Now().Add(d + controlTimeout))
+	}
+	goroutineDiff(w, d)
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// handedOff is a listener passed to a child by Restart.
+type handedOff struct {
+	w       *WaitListener
+	id      fileID
+	childFD int // in the child, or -1 if it was not found in ExtraFiles
+}
+
+// verifyHandoff is called by Restart once the child has been started.  It
+// closes this process's copies of the listeners in ports, including those
+// passed in cmd.ExtraFiles, and then checks that no descriptor in this process
+// still refers to a listening socket (which would let both generations accept
+// connections) and, where supported, that the child holds each of them.
+func verifyHandoff(cmd *exec.Cmd, ports []*WaitListener) {
+	var handoffs []handedOff
+	for _, w := range ports {
+		id, err := listenerID(w)
+		if err != nil {
+			Warning.Printf("Cannot verify handoff of %s: %s", w.Addr(), err)
+			continue
+		}
+		handoffs = append(handoffs, handedOff{w, id, -1})
+	}
+
+	for i, f := range cmd.ExtraFiles {
+		id, err := fdID(int(f.Fd()))
+		if err != nil {
+			continue
+		}
+		for j := range handoffs {
+			if handoffs[j].id == id {
+				handoffs[j].childFD = 3 + i
+				f.Close()
+			}
+		}
+	}
+	for _, h := range handoffs {
+		h.w.Close()
+	}
+
+	held := map[fileID]int{}
+	if fds, err := openFDs(); err == nil {
+		for _, fd := range fds {
+			if id, err := fdID(fd); err == nil {
+				held[id] = fd
+			}
+		}
+	}
+	for _, h := range handoffs {
+		if fd, ok := held[h.id]; ok {
+			Error.Printf("Listener %s (%s) is still open as fd %d after handing it off; both generations may accept connections", h.w.name(), h.w.Addr(), fd)
+			continue
+		}
+		child, ok := holdsSocket(cmd.Process.Pid, h.id.ino)
+		switch {
+		case !ok:
+			Verbose.Printf("Handed off %s (%s) from generation %d to pid %d (generation %d) as &%d", h.w.name(), h.w.Addr(), generation, cmd.Process.Pid, generation+1, h.childFD)
+		case child:
+			Verbose.Printf("Handed off %s (%s) from generation %d to pid %d (generation %d) as &%d; verified", h.w.name(), h.w.Addr(), generation, cmd.Process.Pid, generation+1, h.childFD)
+		default:
+			Error.Printf("Handed off %s (%s) to pid %d, but it does not hold the socket", h.w.name(), h.w.Addr(), cmd.Process.Pid)
+		}
+	}
+}
+
+// listenerID returns the fileID of the socket underlying w.
+func listenerID(w *WaitListener) (id fileID, err error) {
+	sc, ok := w.Listener.(syscall.Conn)
+	if !ok {
+		return id, fmt.Errorf("unknown listener type: %T", w.Listener)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return id, err
+	}
+	if cerr := raw.Control(func(fd uintptr) { id, err = fdID(int(fd)) }); cerr != nil {
+		return id, cerr
+	}
+	return id, err
+}
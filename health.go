@@ -0,0 +1,85 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"sync"
+	"time"
+)
+
+// HealthTimeout bounds how long a health check may take before it is
+// reported as failed.
+var HealthTimeout = 5 * time.Second
+
+var (
+	healthLock   sync.Mutex
+	healthChecks []*watchCheck
+)
+
+// HealthCheck registers a function which reports whether the named
+// component is healthy.  Health checks are run on demand by Health, and the
+// results are reported in the Status.
+func HealthCheck(name string, check func() error) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	healthChecks = append(healthChecks, &watchCheck{name: name, ping: check})
+}
+
+// A HealthResult is the outcome of a single health check.
+type HealthResult struct {
+	Name    string
+	OK      bool
+	Error   string `json:",omitempty"`
+	Latency string
+}
+
+// Health runs every registered health check, in parallel, and returns the
+// results in the order the checks were registered.
+func Health() []HealthResult {
+	healthLock.Lock()
+	checks := append([]*watchCheck(nil), healthChecks...)
+	healthLock.Unlock()
+
+	results := make([]HealthResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *watchCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := c.check(HealthTimeout)
+			results[i] = HealthResult{
+				Name:    c.name,
+				OK:      err == nil,
+				Latency: time.Since(start).String(),
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	return results
+}
+
+// Healthy returns true if every health check passes.
+func Healthy() bool {
+	for _, r := range Health() {
+		if !r.OK {
+			return false
+		}
+	}
+	return true
+}
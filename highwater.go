@@ -0,0 +1,160 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// HighWater sets high-water marks on the number of connections which the
+// listener has open.  When the connections reach a mark, a Warning is
+// logged, the mark's metric is set to 1, and the functions registered with
+// OnHighWater are called; once they fall below 90% of the mark, this is
+// logged and reported in the same way.  The marks give early warning of a
+// listener approaching its MaxConns (or the process its file limit), before
+// connections are rejected.
+func HighWater(n ...int) ListenOption {
+	return func(c *listenConfig) {
+		for _, n := range n {
+			c.highWater = append(c.highWater, highWaterMark{n: n})
+		}
+	}
+}
+
+// HighWaterPercent is like HighWater, with the marks given as percentages of
+// the listener's MaxConns.  They are ignored if it has no MaxConns.
+func HighWaterPercent(pct ...float64) ListenOption {
+	return func(c *listenConfig) {
+		for _, pct := range pct {
+			c.highWater = append(c.highWater, highWaterMark{pct: pct})
+		}
+	}
+}
+
+// highWaterMark is a mark given to HighWater (n) or HighWaterPercent (pct).
+type highWaterMark struct {
+	n   int
+	pct float64
+}
+
+// parseHighWater parses the value of the "highwater" spec key, whose marks
+// are separated by "+" and may end with "%".
+func parseHighWater(val string) (ListenOption, error) {
+	var marks []highWaterMark
+	for _, s := range strings.Split(val, "+") {
+		if strings.HasSuffix(s, "%") {
+			pct, err := strconv.ParseFloat(s[:len(s)-1], 64)
+			if err != nil {
+				return nil, err
+			}
+			marks = append(marks, highWaterMark{pct: pct})
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		marks = append(marks, highWaterMark{n: n})
+	}
+	return func(c *listenConfig) {
+		c.highWater = append(c.highWater, marks...)
+	}, nil
+}
+
+// A HighWaterAlarm reports a listener's connections crossing a high-water
+// mark (see HighWater).
+type HighWaterAlarm struct {
+	Listener  string // Name of the listener
+	Threshold int    // The mark, in connections
+	Active    int    // Connections open when it was crossed
+	Raised    bool   // Whether they reached the mark, or fell below it
+}
+
+var (
+	highWaterLock  sync.Mutex
+	highWaterHooks []func(HighWaterAlarm)
+)
+
+// OnHighWater registers a function to be called when the connections of a
+// listener reach one of its high-water marks, or fall below it again.  It is
+// called by the goroutine which accepted or closed the connection, so it
+// should not block.
+func OnHighWater(fn func(HighWaterAlarm)) {
+	highWaterLock.Lock()
+	defer highWaterLock.Unlock()
+	highWaterHooks = append(highWaterHooks, fn)
+}
+
+// highWaterState is a mark of a WaitListener.
+type highWaterState struct {
+	threshold int
+	raised    int32 // atomic
+	gauge     Gauge
+}
+
+// newHighWater resolves the listener's marks into thresholds.
+func newHighWater(w *WaitListener) []*highWaterState {
+	var states []*highWaterState
+	for _, m := range w.config.highWater {
+		threshold := m.n
+		if m.pct > 0 {
+			if w.config.maxConns <= 0 {
+				Warning.Printf("Ignoring the high-water mark of %g%% for %s, which has no MaxConns", m.pct, w.name())
+				continue
+			}
+			threshold = int(math.Ceil(m.pct / 100 * float64(w.config.maxConns)))
+		}
+		if threshold < 1 {
+			continue
+		}
+		states = append(states, &highWaterState{
+			threshold: threshold,
+			gauge: metrics.Gauge(metricHighWater, "Whether the connections are at the high-water mark",
+				"listener", w.name(), "threshold", strconv.Itoa(threshold)),
+		})
+	}
+	return states
+}
+
+// checkHighWater raises or clears the listener's marks for n open
+// connections.
+func (w *WaitListener) checkHighWater(n int) {
+	for _, hw := range w.highWater {
+		switch {
+		case n >= hw.threshold && atomic.CompareAndSwapInt32(&hw.raised, 0, 1):
+			Warning.Printf("Listener %s has %d connections, reaching its high-water mark of %d", w.name(), n, hw.threshold)
+			hw.gauge.Set(1)
+			w.highWaterAlarm(hw, n, true)
+		case n*10 < hw.threshold*9 && atomic.CompareAndSwapInt32(&hw.raised, 1, 0):
+			Info.Printf("Listener %s has %d connections, below its high-water mark of %d", w.name(), n, hw.threshold)
+			hw.gauge.Set(0)
+			w.highWaterAlarm(hw, n, false)
+		}
+	}
+}
+
+func (w *WaitListener) highWaterAlarm(hw *highWaterState, n int, raised bool) {
+	highWaterLock.Lock()
+	hooks := append([]func(HighWaterAlarm){}, highWaterHooks...)
+	highWaterLock.Unlock()
+	alarm := HighWaterAlarm{w.name(), hw.threshold, n, raised}
+	for _, fn := range hooks {
+		fn(alarm)
+	}
+}
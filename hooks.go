@@ -0,0 +1,51 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"sync"
+)
+
+// A hookList is a list of functions to be run at some point in the
+// daemon's lifecycle.
+type hookList struct {
+	lock sync.Mutex
+	fns  []func() error
+}
+
+func (h *hookList) add(fn func() error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.fns = append(h.fns, fn)
+}
+
+// run calls each hook in order, logging any failures, and returns the first
+// error.
+func (h *hookList) run(what string) error {
+	h.lock.Lock()
+	fns := append([]func() error(nil), h.fns...)
+	h.lock.Unlock()
+
+	var first error
+	for _, fn := range fns {
+		if err := fn(); err != nil {
+			Error.Printf("%s hook failed: %s", what, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,204 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// An IdleFunc is called by Restart for each open connection of a listener
+// with HandoffIdle.  If the connection is idle (it has no request in flight,
+// and the protocol allows it to be resumed by another process), the function
+// must claim it, so that its handler will no longer read from or write to it,
+// and return true along with a small blob of metadata for the child;
+// otherwise it returns false, and the connection is drained as usual.
+//
+// The handler of a claimed connection should exit without writing anything:
+// its copy of the connection is closed, which interrupts any pending Read.
+type IdleFunc func(conn net.Conn) (meta []byte, idle bool)
+
+// HandoffIdle (experimental) causes Restart to pass the listener's idle
+// connections, as determined by fn, to the child along with their metadata,
+// so that long-lived idle clients are not disconnected by every deploy.  In
+// the child, the connections are returned by Accept before any new ones, and
+// their metadata can be retrieved with HandoffMeta.  The child's listener
+// must also have HandoffIdle for them to be adopted.
+//
+// Only plain TCP connections can be passed; HandoffIdle is ignored on TLS
+// and Untracked listeners.  The connections are not subject to the child's
+// admission control, since the parent has already admitted them.
+func HandoffIdle(fn IdleFunc) ListenOption {
+	return func(c *listenConfig) {
+		c.idle = fn
+		idleStateOnce.Do(func() {
+			RegisterState(idleStateName, 1, saveIdleConns, restoreIdleConns)
+		})
+	}
+}
+
+// HandoffMeta returns the metadata passed with a connection handed off by
+// the previous generation (see HandoffIdle), if conn was.
+func HandoffMeta(conn net.Conn) (meta []byte, ok bool) {
+	m := Meta(conn)
+	if m == nil {
+		return nil, false
+	}
+	meta, ok = m.Get(handoffMetaKey{}).([]byte)
+	return meta, ok
+}
+
+type handoffMetaKey struct{}
+
+// idleStateName is the name of the state component (see RegisterState) in
+// which the handed off connections are described.
+const idleStateName = "daemon.idle-conns"
+
+// An idleConn describes a connection passed to the child.
+type idleConn struct {
+	Flag string
+	FD   int
+	Meta []byte
+}
+
+var (
+	idleStateOnce sync.Once
+
+	idleLock    sync.Mutex
+	idlePassed  []idleConn                // by this process, for saveIdleConns
+	idleAdopted = map[string][]idleConn{} // passed to this process, by flag
+)
+
+// passIdleConns claims the idle connections of the listeners with
+// HandoffIdle and adds them to cmd, returning the connections to close once
+// the child has started and the files to close along with them.
+func passIdleConns(cmd *exec.Cmd) (handed []net.Conn, files []*os.File) {
+	var passed []idleConn
+	for _, l := range registered() {
+		lf, ok := l.(*listenFlag)
+		if !ok || lf.listener == nil || lf.config.idle == nil || lf.listener.tls != nil {
+			continue
+		}
+		for _, conn := range lf.listener.Conns() {
+			tcp, ok := conn.(*waitConn).Conn.(*net.TCPConn)
+			if !ok {
+				continue
+			}
+			meta, idle := lf.config.idle(conn)
+			if !idle {
+				continue
+			}
+			file, err := tcp.File()
+			if err != nil {
+				Warning.Printf("Failed to hand off idle connection from %s: %s", conn.RemoteAddr(), err)
+				continue
+			}
+			passed = append(passed, idleConn{lf.flag, 3 + len(cmd.ExtraFiles), meta})
+			cmd.ExtraFiles = append(cmd.ExtraFiles, file)
+			handed = append(handed, conn)
+			files = append(files, file)
+		}
+	}
+	idleLock.Lock()
+	idlePassed = passed
+	idleLock.Unlock()
+	if len(passed) > 0 {
+		Info.Printf("Handing off %d idle connection(s)", len(passed))
+	}
+	return handed, files
+}
+
+// releaseIdleConns closes this process's copies of the connections handed
+// off to the child.
+func releaseIdleConns(handed []net.Conn, files []*os.File) {
+	for _, conn := range handed {
+		conn.SetDeadline(time.Now())
+		conn.Close()
+	}
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func saveIdleConns() ([]byte, error) {
+	idleLock.Lock()
+	defer idleLock.Unlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(idlePassed)
+	return buf.Bytes(), err
+}
+
+func restoreIdleConns(version int, data []byte) error {
+	var conns []idleConn
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&conns); err != nil {
+		return err
+	}
+	idleLock.Lock()
+	defer idleLock.Unlock()
+	for _, c := range conns {
+		idleAdopted[c.Flag] = append(idleAdopted[c.Flag], c)
+	}
+	return nil
+}
+
+// adoptIdleConns queues the connections handed off by the previous
+// generation for the flag's listener, to be returned by Accept.
+func (l *listenFlag) adoptIdleConns() {
+	idleLock.Lock()
+	conns := idleAdopted[l.flag]
+	delete(idleAdopted, l.flag)
+	idleLock.Unlock()
+
+	w := l.listener
+	for _, c := range conns {
+		f := os.NewFile(uintptr(c.FD), "idle")
+		under, err := net.FileConn(f)
+		f.Close() // FileConn dups the fd
+		if err != nil {
+			Warning.Printf("Failed to adopt idle connection for --%s: %s", l.flag, err)
+			continue
+		}
+		if l.config.idle == nil || w.tls != nil || l.config.untracked {
+			under.Close()
+			continue
+		}
+		w.wg.Add(1)
+		conn := w.wrap(under, NewCorrelationID(), w.sampled())
+		Meta(conn).Set(handoffMetaKey{}, c.Meta)
+		w.adoptLock.Lock()
+		w.adopted = append(w.adopted, conn)
+		w.adoptLock.Unlock()
+	}
+	if len(conns) > 0 {
+		Verbose.Printf("Adopted %d idle connection(s) for --%s", len(conns), l.flag)
+	}
+}
+
+// nextAdopted returns the next connection queued by adoptIdleConns, or nil.
+func (w *WaitListener) nextAdopted() net.Conn {
+	w.adoptLock.Lock()
+	defer w.adoptLock.Unlock()
+	if len(w.adopted) == 0 {
+		return nil
+	}
+	conn := w.adopted[0]
+	w.adopted = w.adopted[1:]
+	return conn
+}
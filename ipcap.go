@@ -0,0 +1,100 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// PerIPLimit limits the number of connections from any single remote IP
+// address which the listener has open at once, so that one client cannot use
+// up the capacity of the daemon.  Connections beyond the limit are rejected
+// as soon as they are accepted, and shed by the listener's OverloadPolicy.
+// Addresses within the allowed networks, such as load balancers which carry
+// many clients, are not limited; see ParseCIDR.
+func PerIPLimit(n int, allow ...*net.IPNet) ListenOption {
+	return func(c *listenConfig) {
+		c.perIP = &ipLimit{limit: n, allow: allow}
+	}
+}
+
+// ipLimit is the configuration of PerIPLimit.
+type ipLimit struct {
+	limit int
+	allow []*net.IPNet
+}
+
+// ipCounts are the open connections of a listener with a PerIPLimit, by
+// remote IP.
+type ipCounts struct {
+	lock sync.Mutex
+	open map[string]int
+}
+
+// limitIP applies the listener's PerIPLimit to conn, shedding it and
+// returning false if it is rejected.
+func (w *WaitListener) limitIP(conn net.Conn) bool {
+	limit := w.config.perIP
+	if limit == nil {
+		return true
+	}
+	ip := remoteIP(conn)
+	if ip == nil {
+		return true
+	}
+	for _, network := range limit.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	key := ip.String()
+	acquire := func() bool {
+		w.perIP.lock.Lock()
+		defer w.perIP.lock.Unlock()
+		if w.perIP.open[key] >= limit.limit {
+			return false
+		}
+		if w.perIP.open == nil {
+			w.perIP.open = make(map[string]int)
+		}
+		w.perIP.open[key]++
+		switch c := conn.(type) {
+		case *waitConn:
+			c.ipKey = key
+		case *countedConn:
+			c.ipKey = key
+		}
+		return true
+	}
+	if acquire() {
+		return true
+	}
+	return w.shed(conn, fmt.Errorf("%d connections already open from %s", limit.limit, key), acquire)
+}
+
+// releaseIP records that a connection counted by limitIP has closed.
+func (w *WaitListener) releaseIP(key string) {
+	if key == "" {
+		return
+	}
+	w.perIP.lock.Lock()
+	defer w.perIP.lock.Unlock()
+	if w.perIP.open[key]--; w.perIP.open[key] <= 0 {
+		delete(w.perIP.open, key)
+	}
+}
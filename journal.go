@@ -0,0 +1,157 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HandoffJournal, if set, is the path of a file in which Restart records
+// each handoff until the child has completed startup.  If a generation
+// crashes in between (after the parent has let go of its listeners, but
+// before the child is serving them), the sockets are closed and their ports
+// are lost until the daemon is started again.  The next process to start
+// finds the record and reports the lost handoff as an error with the code
+// HandoffLost, naming each listener which was lost and each which was
+// recovered.  A parent which reaps its child (see WatchChildren) reports it
+// as soon as the child exits.
+//
+// To recover the sockets themselves, use FDStore: systemd keeps a copy of
+// every listener, so the ports stay open across the crash, and passes them to
+// the process it starts next.
+var HandoffJournal string
+
+// HandoffJournalFlag registers a flag with the given name which sets
+// HandoffJournal.
+func HandoffJournalFlag(name, defPath string) *string {
+	flag.StringVar(&HandoffJournal, name, defPath, "File in which to record restarts until they complete (if set)")
+	return &HandoffJournal
+}
+
+// A handoffRecord is the entry in the HandoffJournal for a Restart.
+type handoffRecord struct {
+	Parent     int
+	Generation int // of the parent
+	Child      int `json:",omitempty"` // once spawned
+	Started    time.Time
+	Listeners  map[string]string // address by flag name
+}
+
+// journalHandoff records a handoff which is about to begin (with no child)
+// or has spawned its child.
+func journalHandoff(rec handoffRecord) {
+	if HandoffJournal == "" {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err == nil {
+		tmp := HandoffJournal + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, HandoffJournal)
+		}
+	}
+	if err != nil {
+		Warning.Printf("Failed to write handoff journal: %s", err)
+	}
+}
+
+// readJournal returns the record in the HandoffJournal, if any.
+func readJournal() *handoffRecord {
+	if HandoffJournal == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(HandoffJournal)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Warning.Printf("Failed to read handoff journal: %s", err)
+		}
+		return nil
+	}
+	rec := new(handoffRecord)
+	if err := json.Unmarshal(data, rec); err != nil {
+		Warning.Printf("Ignoring corrupt handoff journal %s: %s", HandoffJournal, err)
+		os.Remove(HandoffJournal)
+		return nil
+	}
+	return rec
+}
+
+// completeHandoff removes the journal record of the Restart which started
+// this process, once it has completed startup.
+func completeHandoff() {
+	if rec := readJournal(); rec != nil && rec.Child == os.Getpid() {
+		os.Remove(HandoffJournal)
+	}
+}
+
+// checkJournal reports a handoff which never completed because both of the
+// processes involved have gone.
+func checkJournal() {
+	rec := readJournal()
+	if rec == nil || rec.Child == os.Getpid() || rec.Parent == os.Getpid() {
+		return
+	}
+	if processAlive(rec.Parent) || (rec.Child != 0 && processAlive(rec.Child)) {
+		// Still in progress, perhaps by another instance
+		return
+	}
+	reportLost(rec)
+}
+
+// childExited is called when a child started by Restart has been reaped, to
+// report the lost handoff if it had not completed startup.
+func childExited(pid int) {
+	if rec := readJournal(); rec != nil && rec.Child == pid {
+		reportLost(rec)
+	}
+}
+
+// reportLost logs the lost handoff and removes its record.
+func reportLost(rec *handoffRecord) {
+	var what string
+	if rec.Child == 0 {
+		what = fmt.Sprintf("generation %d (pid %d) crashed while handing off its listeners at %s",
+			rec.Generation, rec.Parent, rec.Started.Format(time.RFC3339))
+	} else {
+		what = fmt.Sprintf("pid %d exited before completing startup after a Restart from generation %d (pid %d) at %s",
+			rec.Child, rec.Generation, rec.Parent, rec.Started.Format(time.RFC3339))
+	}
+	var lost, recovered []string
+	for name, addr := range rec.Listeners {
+		desc := fmt.Sprintf("--%s (%s)", name, addr)
+		if _, ok := systemdFD(name); ok {
+			recovered = append(recovered, desc)
+		} else {
+			lost = append(lost, desc)
+		}
+	}
+	sort.Strings(lost)
+	sort.Strings(recovered)
+	if len(lost) > 0 {
+		what += "; lost " + strings.Join(lost, ", ")
+	}
+	if len(recovered) > 0 {
+		what += "; recovered " + strings.Join(recovered, ", ") + " from systemd"
+	}
+	Error.Printf("%s", &LifecycleError{HandoffLost, "restart", "", fmt.Errorf("%s", what)})
+	os.Remove(HandoffJournal)
+}
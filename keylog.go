@@ -0,0 +1,88 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// InsecureKeyLog allows listeners with the KeyLog option to write their TLS
+// session keys.  Anyone who can read the keys can decrypt the traffic
+// captured from those listeners, so it should only be set while debugging.
+var InsecureKeyLog bool
+
+// InsecureKeyLogFlag registers a flag with the given name which sets
+// InsecureKeyLog.
+func InsecureKeyLogFlag(name string) *bool {
+	flag.BoolVar(&InsecureKeyLog, name, InsecureKeyLog, "INSECURE: allow listeners to write TLS session keys (the keylog listener option)")
+	return &InsecureKeyLog
+}
+
+type keyLog struct {
+	path string
+}
+
+// KeyLog causes a TLS listener to append the session keys of its
+// connections to the file at path, in the NSS key log format which
+// Wireshark and other tools read to decrypt captured traffic (see also Tap).
+// If path is empty, the SSLKEYLOGFILE environment variable is used, as by
+// browsers.  Unless InsecureKeyLog is set, the listener fails to listen; if
+// it is, warnings are logged when it listens and in the startup summary.
+func KeyLog(path string) ListenOption {
+	if path == "" {
+		path = os.Getenv("SSLKEYLOGFILE")
+	}
+	return func(c *listenConfig) {
+		c.keyLog = &keyLog{path}
+	}
+}
+
+var (
+	insecureLock  sync.Mutex
+	insecureNotes []string // for the startup summary
+)
+
+// startKeyLog opens the key log of the listener for the named flag, if it
+// has one.
+func (c *listenConfig) startKeyLog(flag string) error {
+	switch {
+	case c.keyLog == nil:
+		return nil
+	case c.tls == nil:
+		return errors.New("keylog requires TLS")
+	case !InsecureKeyLog:
+		return errors.New("keylog requires InsecureKeyLog to be set")
+	case c.keyLog.path == "":
+		return errors.New("keylog has no path, and SSLKEYLOGFILE is not set")
+	}
+	f, err := os.OpenFile(c.keyLog.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("keylog: %s", err)
+	}
+	config := c.tls.Clone()
+	config.KeyLogWriter = f
+	c.tls, c.keyLog = config, nil
+
+	note := fmt.Sprintf("TLS session keys of --%s are written to %s; its traffic can be decrypted", flag, f.Name())
+	Warning.Printf("INSECURE: %s", note)
+	insecureLock.Lock()
+	insecureNotes = append(insecureNotes, note)
+	insecureLock.Unlock()
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DrainRetryAfter is the Retry-After sent by DrainMiddleware.  During a
+// Restart the next generation is already accepting, so clients can usually
+// retry at once on a new connection.
+var DrainRetryAfter = time.Second
+
+// DrainMiddleware wraps an http.Handler so that, once IsDraining, requests
+// are refused with 503 Service Unavailable, a Retry-After of DrainRetryAfter
+// and "Connection: close".  The listener stops accepting connections when
+// the drain starts, but HTTP keep-alive connections which were already open
+// would otherwise keep bringing new requests to a lame duck.  Requests which
+// started before the drain are not affected.
+//
+// This package does not depend on gRPC, but a unary interceptor doing the
+// same is only a few lines:
+//
+//	func drainInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+//		if daemon.IsDraining() {
+//			return nil, status.Error(codes.Unavailable, "server is draining")
+//		}
+//		return handler(ctx, req)
+//	}
+//
+// (with grpc.NewServer(grpc.UnaryInterceptor(drainInterceptor))), and
+// calling GracefulStop from OnShutdown and OnRestart sends GOAWAY to the
+// clients on open connections.
+func DrainMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsDraining() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		secs := int((DrainRetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Service Unavailable: server is draining", http.StatusServiceUnavailable)
+	})
+}
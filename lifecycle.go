@@ -0,0 +1,125 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// restartedAtEnv is the environment variable in which a parent records the
+// time at which it started a child with Restart.
+const restartedAtEnv = "DAEMON_RESTARTED_AT"
+
+// generationEnv is the environment variable in which a parent passes the
+// generation of the child it starts with Restart.
+const generationEnv = "DAEMON_GENERATION"
+
+// parentPIDEnv is the environment variable in which a parent passes its pid
+// to the child it starts with Restart.
+const parentPIDEnv = "DAEMON_PARENT_PID"
+
+var (
+	startTime  = time.Now()
+	generation int
+	parentPID  int // of the generation which started this one, if any
+
+	lifecycleLock sync.Mutex
+	restartedAt   time.Time
+	drainStarted  time.Time
+)
+
+func init() {
+	if s := os.Getenv(restartedAtEnv); s != "" {
+		restartedAt, _ = time.Parse(time.RFC3339Nano, s)
+		os.Unsetenv(restartedAtEnv)
+	}
+	if s := os.Getenv(generationEnv); s != "" {
+		generation, _ = strconv.Atoi(s)
+		os.Unsetenv(generationEnv)
+	}
+	if s := os.Getenv(parentPIDEnv); s != "" {
+		parentPID, _ = strconv.Atoi(s)
+		os.Unsetenv(parentPIDEnv)
+	}
+}
+
+// sharingLogs is set once this process has started a child with Restart,
+// which may write to the same log file.
+var sharingLogs int32 // atomic
+
+// logsShared returns true if another generation may be writing to the same
+// log file as this process: a child being started by Restart, or the parent
+// which is still draining.
+func logsShared() bool {
+	return atomic.LoadInt32(&sharingLogs) != 0 || (parentPID != 0 && os.Getppid() == parentPID)
+}
+
+// Generation returns the number of times the daemon has been restarted with
+// Restart to get to this process.  It is 0 for a process which was not started
+// by Restart.
+func Generation() int {
+	return generation
+}
+
+// StartTime returns the time at which this process started.
+func StartTime() time.Time {
+	return startTime
+}
+
+// Uptime returns how long this process has been running.
+func Uptime() time.Duration {
+	return time.Since(startTime)
+}
+
+// LastRestartTime returns the time at which the previous generation of this
+// daemon called Restart to start this process, or the zero time if this
+// process was not started by Restart.
+func LastRestartTime() time.Time {
+	lifecycleLock.Lock()
+	defer lifecycleLock.Unlock()
+	return restartedAt
+}
+
+// DrainStartedAt returns the time at which this process began draining its
+// connections for a Restart or Shutdown, or the zero time if it has not.
+func DrainStartedAt() time.Time {
+	lifecycleLock.Lock()
+	defer lifecycleLock.Unlock()
+	return drainStarted
+}
+
+// IsDraining reports whether the daemon has been told to Restart or Shutdown
+// (that is, whether Lamed is closed).  Long-lived connections should stop
+// taking on new work once it is true; see DrainMiddleware.
+func IsDraining() bool {
+	select {
+	case <-Lamed:
+		return true
+	default:
+		return false
+	}
+}
+
+// startDrain records the start of the drain.
+func startDrain() time.Time {
+	lifecycleLock.Lock()
+	defer lifecycleLock.Unlock()
+	drainStarted = time.Now()
+	return drainStarted
+}
@@ -23,43 +23,330 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // ErrStopped is returned when Accept is called on a listener
 // which has been stopped.
 var ErrStopped = errors.New("daemon: listener stopped")
 
-// ErrTimeout is returned when Restart times out.
+// ErrClosed is returned when a listener which has been closed is closed or
+// stopped again.
+var ErrClosed = errors.New("daemon: listener closed")
+
+// ErrTimeout is returned when Restart or a watchdog ping times out.
 var ErrTimeout = errors.New("daemon: timeout")
 
+// UnixMode is the permission mode of the unix sockets created by ListenFlag.
+var UnixMode os.FileMode = 0666
+
+// unixPrefix marks the address of a unix socket in a ListenFlag.
+const unixPrefix = "unix:"
+
+var errDoubleClose = errors.New("double close")
+
 type waitConn struct {
 	*sync.WaitGroup
 	net.Conn
 	closeOnce sync.Once
+	meta      ConnMeta
+	listener  *WaitListener
+	id        string        // correlation ID
+	sample    uint64        // sampling rate if logged (see WaitListener.sampled)
+	access    *accessRecord // nil unless the listener has an AccessLog
+	tap       *tapStream    // nil unless the connection is tapped
+	ipKey     string        // remote IP, if counted by PerIPLimit
+	capped    bool          // counted against MaxConns
+	account   *connAccount  // nil unless the listener has Accounting
+	reap      *reapState    // nil unless the listener has Reap
+}
+
+// Meta returns the connection's metadata store.
+func (c *waitConn) Meta() *ConnMeta {
+	return &c.meta
+}
+
+// CorrelationID returns the connection's correlation ID.
+func (c *waitConn) CorrelationID() string {
+	return c.id
+}
+
+// NetConn returns the underlying connection.
+func (c *waitConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *waitConn) Read(b []byte) (int, error) {
+	if c.account != nil && c.account.pause() {
+		// Don't hold a thread while waiting for the client.
+		defer c.account.begin()
+	}
+	n, err := c.Conn.Read(b)
+	if c.access != nil {
+		atomic.AddUint64(&c.access.in, uint64(n))
+	}
+	if c.tap != nil {
+		c.tap.record(true, b[:n])
+	}
+	if c.reap != nil {
+		c.reap.read(err)
+	}
+	return n, err
+}
+
+func (c *waitConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.access != nil {
+		atomic.AddUint64(&c.access.out, uint64(n))
+	}
+	if c.tap != nil {
+		c.tap.record(false, b[:n])
+	}
+	if c.reap != nil {
+		c.reap.wrote()
+	}
+	return n, err
 }
 
 func (c *waitConn) Close() error {
-	err := fmt.Errorf("double close")
+	err := errDoubleClose
 	c.closeOnce.Do(func() {
 		defer c.Done()
-		Verbose.Printf("Closed connection: (local) %s <- %s (remote)",
-			c.LocalAddr(), c.RemoteAddr())
+		c.listener.untrack(c)
+		c.listener.releaseIP(c.ipKey)
+		c.listener.releaseConn(c.capped)
+		if c.sample > 0 {
+			logConn("Closed", c, c.id, c.sample)
+		}
+		if c.access != nil {
+			c.listener.config.access.write(c)
+		}
+		if c.tap != nil {
+			c.tap.close()
+		}
 		err = c.Conn.Close()
 	})
 	return err
 }
 
+// A countedConn is the connection returned by an Untracked listener.
+type countedConn struct {
+	net.Conn
+	listener *WaitListener
+	closed   int32  // atomic
+	id       string // as in waitConn
+	sample   uint64 // as in waitConn
+	ipKey    string // as in waitConn
+	capped   bool   // as in waitConn
+}
+
+// CorrelationID returns the connection's correlation ID.
+func (c *countedConn) CorrelationID() string {
+	return c.id
+}
+
+// NetConn returns the underlying connection.
+func (c *countedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *countedConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return errDoubleClose
+	}
+	defer c.listener.wg.Done()
+	c.listener.uncount()
+	c.listener.releaseIP(c.ipKey)
+	c.listener.releaseConn(c.capped)
+	if c.sample > 0 {
+		logConn("Closed", c, c.id, c.sample)
+	}
+	return c.Conn.Close()
+}
+
 // A WaitListener is a listener which accepts connections like a normal
 // Listener, but counts them and can Wait for all of them to close.
 type WaitListener struct {
+	rejected  uint64 // atomic; first for alignment
+	active    int64  // atomic
+	accepts   uint64 // atomic; for LogSample
+	logSample uint64 // atomic; see SetLogSample
+	acceptErr uint64 // atomic; accept errors other than "closed", for AnomalyCheck
+	capped    int64  // atomic; connections counted against MaxConns
+	atLimit   int32  // atomic; 1 once MaxConns was reached and logged
+
 	wg sync.WaitGroup
 	net.Listener
-	stop chan bool
+	stop chan bool // closed by Stop or Close
+
+	stopLock sync.Mutex
+	closed   bool
+
+	config  *listenConfig
+	tls     *tlsState   // nil unless config.tls is set
+	proxy   *proxyState // nil unless config.proxy is set
+	shards  *shardState // nil unless config.shards is set
+	metrics listenerMetrics
+
+	perIP     ipCounts      // see PerIPLimit
+	connSlots chan struct{} // one for each open connection, with MaxConnsBlock
+
+	reused bool // bound with ReusePort, so cut over instead of passed on
+
+	adoptLock sync.Mutex
+	adopted   []net.Conn // see HandoffIdle
+
+	warmLock sync.Mutex
+	warmNext time.Time // earliest next accept during WarmUp
+
+	rate      rateState         // see AcceptRate
+	highWater []*highWaterState // see HighWater
+
+	gateLock sync.Mutex
+	gate     chan bool // non-nil while paused (see Checkpoint)
+
+	connLock sync.Mutex
+	conns    map[*waitConn]bool
+}
+
+func newWaitListener(under net.Listener, config *listenConfig) *WaitListener {
+	w := &WaitListener{
+		Listener:  under,
+		stop:      make(chan bool),
+		config:    config,
+		logSample: config.logSample,
+	}
+	if config.tls != nil {
+		w.tls = new(tlsState)
+	}
+	if config.proxy != nil {
+		w.proxy = new(proxyState)
+	}
+	w.metrics = newListenerMetrics(w.name(), w.overload().Name())
+	if config.shards > 1 {
+		w.shards = newShardState(w)
+	}
+	w.highWater = newHighWater(w)
+	if config.acceptRate > 0 {
+		w.SetAcceptRate(config.acceptRate, config.acceptBurst)
+	}
+	if config.maxConns > 0 && config.maxConnsBlock {
+		w.connSlots = make(chan struct{}, config.maxConns)
+	}
+	holdIfWaiting(w)
+	if config.reap != nil {
+		reapConns(w)
+	}
+	return w
+}
+
+// name returns the name of the listener, for metrics.
+func (w *WaitListener) name() string {
+	if w.config.name != "" {
+		return w.config.name
+	}
+	return w.Addr().String()
 }
 
 // Accept is a wrapper around the underlying Listener's accept
-// to facilitate tracking connections.
+// to facilitate tracking connections.  If the listener was created with the
+// TLS option, the returned connections have completed their handshakes.
 func (w *WaitListener) Accept() (conn net.Conn, err error) {
+	if w.tls != nil {
+		conn, err = w.acceptTLS()
+	} else {
+		conn, err = w.acceptRaw()
+	}
+	if err == nil && atomic.LoadInt32(&selfProbing) > 0 {
+		selfProbeAccepted(conn)
+	}
+	return conn, err
+}
+
+// acceptRaw returns the next connection which passes admission control,
+// from the shards if there are any.
+func (w *WaitListener) acceptRaw() (net.Conn, error) {
+	if w.shards != nil {
+		return w.acceptShard()
+	}
+	return w.accept()
+}
+
+// accept returns the next connection which passes admission control.
+func (w *WaitListener) accept() (net.Conn, error) {
+	if conn := w.nextAdopted(); conn != nil {
+		return conn, nil
+	}
+	for {
+		w.warmUp()
+		w.limitRate()
+		if !w.awaitConnSlot() {
+			return nil, ErrStopped
+		}
+		conn, err := w.acceptOne()
+		if err != nil {
+			w.releaseConn(w.connSlots != nil)
+			return nil, err
+		}
+		if w.limitConns(conn) && w.limitIP(conn) && w.admit(conn) {
+			return conn, nil
+		}
+	}
+}
+
+// admit runs the listener's AdmissionFunc, if any, shedding the connection
+// if it is rejected.
+func (w *WaitListener) admit(conn net.Conn) bool {
+	if w.config.admit == nil {
+		return true
+	}
+	if err := w.config.admit(conn); err != nil {
+		return w.shed(conn, err, func() bool { return w.config.admit(conn) == nil })
+	}
+	return true
+}
+
+// acceptErrorClass classifies an error from Accept for the accept error
+// metric: running out of descriptors, connections aborted by the client, the
+// listener being closed, deadlines, and anything else.
+func acceptErrorClass(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE):
+		return "emfile"
+	case errors.Is(err, syscall.ECONNABORTED):
+		return "econnaborted"
+	case strings.Contains(err.Error(), "closed network connection"):
+		return "closed"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// acceptBackoff returns how long to wait before accepting again after an
+// error, given the previous wait: from 5ms, doubling up to a second, as
+// net/http does.
+func acceptBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
+// Rejected returns the number of connections which have been rejected by
+// admission control: the listener's AdmissionFunc or PerIPLimit, or MaxConns.
+// It includes those which ShedQueue admitted after all.
+func (w *WaitListener) Rejected() uint64 {
+	return atomic.LoadUint64(&w.rejected)
+}
+
+func (w *WaitListener) acceptOne() (conn net.Conn, err error) {
 	// To prevent race conditions, always assume we're going
 	// to accept a connection.
 	w.wg.Add(1)
@@ -76,55 +363,295 @@ func (w *WaitListener) Accept() (conn net.Conn, err error) {
 	default:
 	}
 
-	conn, err = w.Listener.Accept()
+	conn, err = w.acceptProxied()
+	if err == ErrStopped {
+		return nil, err
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "closed network connection") {
+		class := acceptErrorClass(err)
+		w.metrics.acceptErrors[class].Add(1)
+		if class == "closed" {
 			return nil, ErrStopped
 		}
+		atomic.AddUint64(&w.acceptErr, 1)
 		return nil, err
 	}
 
-	Verbose.Printf("Accepted connection: (local) %s <- %s (remote)",
-		conn.LocalAddr(), conn.RemoteAddr())
+	id := NewCorrelationID()
+	sample := w.sampled()
+	if sample > 0 {
+		logConn("Accepted", conn, id, sample)
+	}
+
+	if !w.wait() {
+		conn.Close()
+		return nil, ErrStopped
+	}
+	w.metrics.accepted.Add(1)
+	return w.wrap(conn, id, sample), nil
+}
 
-	return &waitConn{
+// wrap tracks (or counts) a new connection, for which w.wg has been
+// incremented.
+func (w *WaitListener) wrap(conn net.Conn, id string, sample uint64) net.Conn {
+	if w.config.untracked {
+		w.count()
+		return &countedConn{Conn: conn, listener: w, id: id, sample: sample}
+	}
+	wc := &waitConn{
 		WaitGroup: &w.wg,
 		Conn:      conn,
-	}, nil
+		listener:  w,
+		id:        id,
+		sample:    sample,
+	}
+	if w.config.access != nil {
+		wc.access = &accessRecord{start: now()}
+	}
+	if w.config.tap != nil {
+		wc.tap = w.config.tap.stream(conn)
+	}
+	if w.config.accounting {
+		wc.account = &connAccount{start: now()}
+	}
+	if w.config.reap != nil {
+		wc.reap = newReapState()
+	}
+	w.track(wc)
+	return wc
 }
 
-// Close stops and closes the listener; it is an error to close more than once.
-func (w *WaitListener) Close() error {
-	select {
-	case <-w.stop:
-		return fmt.Errorf("listener already closed")
-	default:
-		close(w.stop)
+// sampled returns the sampling rate if the next accepted connection should
+// be logged, or 0 if it should not.  Every connection is counted, even while
+// the log is suppressed, so that sampling stays even when it is enabled
+// again; beyond that, a suppressed log costs nothing.
+func (w *WaitListener) sampled() uint64 {
+	accepts := atomic.AddUint64(&w.accepts, 1)
+	if Verbose > logLevel() {
+		return 0
+	}
+	n := atomic.LoadUint64(&w.logSample)
+	if n == 0 {
+		n = atomic.LoadUint64(&connLogSample)
+	}
+	if n <= 1 {
+		return 1
+	}
+	if accepts%n != 1 {
+		return 0
+	}
+	return n
+}
 
-		Verbose.Printf("Closing listener: %s", w.Addr())
-		return w.Listener.Close()
+// SetLogSample changes the sampling of the listener's per-connection logs
+// (see LogSample) while it is running.  Setting it to 0 uses the default set
+// by SetConnLogSample.
+func (w *WaitListener) SetLogSample(n int) {
+	if n < 0 {
+		n = 0
 	}
+	atomic.StoreUint64(&w.logSample, uint64(n))
+}
+
+// connLogSample is the sampling rate for listeners without their own.
+var connLogSample uint64 = 1 // atomic
+
+// SetConnLogSample sets the default sampling of per-connection logs: only one
+// in every n connections is logged when it is accepted and closed, on
+// listeners which do not set their own with LogSample.  It can be called at
+// any time, including through the "logsample" control command.
+func SetConnLogSample(n int) {
+	if n < 1 {
+		n = 1
+	}
+	atomic.StoreUint64(&connLogSample, uint64(n))
+}
+
+// ConnLogSample returns the default sampling of per-connection logs.
+func ConnLogSample() int {
+	return int(atomic.LoadUint64(&connLogSample))
+}
+
+// logConn logs a connection event with its correlation ID, noting the
+// sampling rate if only some connections are logged.
+func logConn(event string, conn net.Conn, id string, sample uint64) {
+	if Verbose > logThreshold(0) {
+		return
+	}
+	if sample > 1 {
+		Verbose.outputTo(logger, "", id, 2, "%s connection: (local) %s <- %s (remote) [sampled 1/%d]",
+			[]interface{}{event, conn.LocalAddr(), conn.RemoteAddr(), sample})
+		return
+	}
+	Verbose.outputTo(logger, "", id, 2, "%s connection: (local) %s <- %s (remote)",
+		[]interface{}{event, conn.LocalAddr(), conn.RemoteAddr()})
+}
+
+// count and uncount maintain the number of open connections of an Untracked
+// listener.
+func (w *WaitListener) count() {
+	connOpened()
+	n := atomic.AddInt64(&w.active, 1)
+	w.metrics.active.Set(float64(n))
+	w.checkHighWater(int(n))
+}
+
+func (w *WaitListener) uncount() {
+	connClosed()
+	n := atomic.AddInt64(&w.active, -1)
+	w.metrics.active.Set(float64(n))
+	w.checkHighWater(int(n))
+}
+
+// Active returns the number of connections from this listener which are
+// currently open.
+func (w *WaitListener) Active() int {
+	return int(atomic.LoadInt64(&w.active))
+}
+
+func (w *WaitListener) track(c *waitConn) {
+	w.connLock.Lock()
+	if w.conns == nil {
+		w.conns = make(map[*waitConn]bool)
+	}
+	w.conns[c] = true
+	connOpened()
+	n := len(w.conns)
+	atomic.StoreInt64(&w.active, int64(n))
+	w.metrics.active.Set(float64(n))
+	w.connLock.Unlock()
+	w.checkHighWater(n)
+}
+
+func (w *WaitListener) untrack(c *waitConn) {
+	w.connLock.Lock()
+	delete(w.conns, c)
+	connClosed()
+	n := len(w.conns)
+	atomic.StoreInt64(&w.active, int64(n))
+	w.metrics.active.Set(float64(n))
+	w.connLock.Unlock()
+	w.checkHighWater(n)
+}
+
+// Conns returns the connections from this listener which are currently open.
+// It returns nothing for an Untracked listener.
+func (w *WaitListener) Conns() []net.Conn {
+	w.connLock.Lock()
+	defer w.connLock.Unlock()
+	conns := make([]net.Conn, 0, len(w.conns))
+	for c := range w.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Close stops and closes the listener.  It may be called after Stop, to
+// close this process's copy of a listener which has been passed on; if the
+// listener is already closed, it returns ErrClosed.
+func (w *WaitListener) Close() error {
+	w.stopLock.Lock()
+	defer w.stopLock.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	w.halt()
+
+	Verbose.Printf("Closing listener: %s", w.Addr())
+	return w.Listener.Close()
 }
 
 // Stop stops the listener so that it can be used in another process.  After
 // Stop, it may be necessary to create a dummy connection to this Listener to
-// fall out of an existing Accept.  It is an error to call Stop more than once.
-func (w *WaitListener) Stop() {
-	close(w.stop)
+// fall out of an existing Accept.  If the listener is already stopped or
+// closed, Stop does nothing and returns ErrStopped or ErrClosed.
+func (w *WaitListener) Stop() error {
+	w.stopLock.Lock()
+	defer w.stopLock.Unlock()
+	switch {
+	case w.closed:
+		return ErrClosed
+	case !w.halt():
+		return ErrStopped
+	}
 
 	Verbose.Printf("Stopping listener: %s", w.Addr())
+	return nil
 }
 
-// File copies and the listener's underlying file descriptor.  This is intended
+// state returns the ListenerState of w.
+func (w *WaitListener) state() ListenerState {
+	select {
+	case <-w.stop:
+	default:
+		return ListenerListening
+	}
+	if w.Active() > 0 {
+		return ListenerDraining
+	}
+	return ListenerClosed
+}
+
+// halt closes w.stop, unless it is already closed, and reports whether it
+// did.  The caller must hold stopLock.
+func (w *WaitListener) halt() bool {
+	select {
+	case <-w.stop:
+		return false
+	default:
+	}
+	close(w.stop)
+	if w.shards != nil {
+		w.wakeShards()
+	}
+	return true
+}
+
+// Dup duplicates the listener's underlying file descriptor.  This is intended
 // to be used to pass the file descriptor on to a restarted version of this
-// process.
-func (w *WaitListener) File() *os.File {
-	tcp, ok := w.Listener.(*net.TCPListener)
+// process.  The returned error, if any, is a LifecycleError with code
+// DupFailed.
+func (w *WaitListener) Dup() (*os.File, error) {
+	if err := injected(faultDup, w.name()); err != nil {
+		return nil, &LifecycleError{DupFailed, "dup", w.Addr().String(), err}
+	}
+	filer, ok := w.Listener.(interface{ File() (*os.File, error) })
 	if !ok {
-		Fatal.Printf("unknown listener type: %T", w.Listener)
+		return nil, &LifecycleError{DupFailed, "dup", w.Addr().String(), fmt.Errorf("unknown listener type: %T", w.Listener)}
+	}
+
+	lf, err := filer.File()
+	if err != nil {
+		return nil, &LifecycleError{DupFailed, "dup", w.Addr().String(), err}
+	}
+	return lf, nil
+}
+
+// DupTo duplicates the listener's underlying file descriptor onto the given
+// descriptor number, replacing whatever it referred to, and leaves it open
+// across exec.  This is intended for passing the listener to a program which
+// is executed directly (e.g. with syscall.Exec) and expects its sockets at
+// fixed numbers, such as 3, 4, 5... for LISTEN_FDS.  The returned error, if
+// any, is a LifecycleError with code DupFailed.
+func (w *WaitListener) DupTo(fd int) error {
+	file, err := w.Dup()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := dup2(int(file.Fd()), fd); err != nil {
+		return &LifecycleError{DupFailed, "dup", w.Addr().String(), err}
 	}
+	return nil
+}
 
-	lf, err := tcp.File()
+// File copies and the listener's underlying file descriptor.  This is intended
+// to be used to pass the file descriptor on to a restarted version of this
+// process.  If the descriptor cannot be copied, the process aborts; use Dup
+// to handle the error instead.
+func (w *WaitListener) File() *os.File {
+	lf, err := w.Dup()
 	if err != nil {
 		Fatal.Printf("failed to get fd: %s", err)
 	}
@@ -138,6 +665,12 @@ func (w *WaitListener) Wait() {
 
 // noop makes a dummy connection to the listener
 func (w *WaitListener) noop() {
+	if unix, ok := w.Addr().(*net.UnixAddr); ok {
+		if conn, err := net.Dial("unix", unix.Name); err == nil {
+			conn.Close()
+		}
+		return
+	}
 	addr := w.Addr().(*net.TCPAddr)
 	for _, ip := range []net.IP{
 		net.IPv4(127, 0, 0, 1),
@@ -161,6 +694,9 @@ func (w *WaitListener) noop() {
 // be backed by a file descriptor of an existing listener,
 // or if none is available, a new listener.  String returns
 // the intended address for the listening socket as a string.
+//
+// Calling Listen more than once on a Listenable returned by this
+// package returns the same listener.
 type Listenable interface {
 	Listen() (net.Listener, error)
 	String() string
@@ -168,7 +704,20 @@ type Listenable interface {
 
 type listenFlag struct {
 	flag, proto string
-	mode        string // "fd", "tcp"
+	mode        string // "fd", "tcp", "unix"
+	err         error  // returned by Listen, e.g. if the default was bad
+	config      listenConfig
+	base        listenConfig // from the options given to ListenFlag
+	spec        string       // options given in the flag value (see parseSpec)
+	daemon      string       // name of the Daemon, if created by one
+
+	siblings []*listenFlag  // one for each address after the first
+	multi    *MultiListener // returned by Listen if there are siblings
+	family   bool           // bind only the address family (see network)
+
+	// lock guards listener, mode and laddr, which Rebind may change while
+	// they are read.
+	lock sync.Mutex
 
 	// mode == "fd"
 	fd       int
@@ -177,51 +726,259 @@ type listenFlag struct {
 	// mode == "tcp"
 	net   string
 	laddr *net.TCPAddr
+
+	// mode == "unix"
+	path string
 }
 
 func (l *listenFlag) Listen() (net.Listener, error) {
-	var under net.Listener
-	var err error
-	switch l.mode {
-	case "fd":
-		f := os.NewFile(uintptr(l.fd), fmt.Sprintf("&%d", l.fd))
-		under, err = net.FileListener(f)
-	case "tcp":
-		under, err = net.ListenTCP(l.net, l.laddr)
+	if len(l.siblings) > 0 {
+		return l.listenMulti()
+	}
+	return l.listen()
+}
+
+// listen binds the flag's own address.
+func (l *listenFlag) listen() (net.Listener, error) {
+	if w := l.current(); w != nil {
+		// Already listening (e.g. via ListenAll)
+		return w, nil
+	}
+
+	inherited := false
+	if fd, ok := inheritedFDs[l.flag]; ok {
+		// Passed by Restart, whatever the flag says
+		l.mode, l.fd, l.err = "fd", fd, nil
+		delete(inheritedFDs, l.flag)
+		inherited = true
+	}
+	if l.mode == "tcp" || l.mode == "unix" {
+		if fd, ok := systemdFD(l.flag); ok {
+			Verbose.Printf("Using fd %d from systemd for --%s", fd, l.flag)
+			l.mode, l.fd, l.err = "fd", fd, nil
+		}
+	}
+
+	var (
+		under  net.Listener
+		reused bool // bound with ReusePort
+	)
+	err := l.err
+	if err == nil {
+		err = l.config.loadKeyPair()
+	}
+	if err == nil {
+		err = l.config.startKeyLog(l.flag)
+	}
+	if err == nil {
+		err = l.config.loadClientCAs(l.flag)
+	}
+	switch {
+	case err != nil:
+	case l.mode == "fd":
+		under, err = l.adopt()
+		if err != nil {
+			Error.Printf("Inherited fd %d for --%s is unusable (was it renumbered?): %s", l.fd, l.flag, err)
+			return nil, &LifecycleError{HandoffRejected, "adopt", l.flag, err}
+		}
+		if unix, ok := under.Addr().(*net.UnixAddr); ok && inherited {
+			// Created by an earlier generation, so it is ours to remove
+			path := unix.Name
+			OnShutdown(func(r Reason) {
+				if !r.ChildServing {
+					os.Remove(path)
+				}
+			})
+		}
+	case l.mode == "unix":
+		if under, err = listenUnix(l.path, UnixMode, l.flag); err != nil {
+			return nil, err
+		}
+	case l.mode == "tcp":
+		if err := l.checkListening(); err != nil {
+			return nil, err
+		}
+		if l.config.reusePort && reusePortSupported {
+			under, err = listenReusePort(l.network(), l.laddr)
+			reused = err == nil
+		} else {
+			under, err = listenTCP(&l.config, l.network(), l.laddr)
+		}
 	default:
-		return nil, fmt.Errorf("unknown mode %q", l.mode)
+		err = fmt.Errorf("unknown mode %q", l.mode)
 	}
 	if err != nil {
-		return nil, err
+		if errors.Is(err, syscall.EADDRINUSE) && l.laddr != nil {
+			for _, holder := range portHolders(l.laddr.Port) {
+				Warning.Printf("Port %d for --%s is in use by %s", l.laddr.Port, l.flag, holder)
+			}
+		}
+		return nil, &LifecycleError{BindFailed, "listen", l.flag, err}
 	}
 	Verbose.Printf("Listening for %s on: %s (from %s)", l.proto, under.Addr(), l.mode)
-	listener := &WaitListener{
-		Listener: under,
-		stop:     make(chan bool),
+	w := l.start(under)
+	w.reused = reused
+	return w, nil
+}
+
+// binds returns the address the flag will bind, or nil if it will not bind
+// one (e.g. because it was passed a descriptor).
+func (l *listenFlag) binds() *net.TCPAddr {
+	if l.mode != "tcp" || l.err != nil {
+		return nil
 	}
+	if _, ok := systemdFD(l.flag); ok {
+		return nil
+	}
+	return l.laddr
+}
+
+// checkListening returns an error if another ListenFlag is already listening
+// on an address which overlaps the one l is about to bind.
+func (l *listenFlag) checkListening() error {
+	for _, o := range registered() {
+		other, ok := o.(*listenFlag)
+		if !ok || other == l || l.disjoint(other) {
+			continue
+		}
+		w := other.current()
+		if w == nil {
+			continue
+		}
+		if addr, ok := w.Addr().(*net.TCPAddr); ok && overlaps(l.laddr, addr) {
+			return l.conflict(other.flag, addr)
+		}
+	}
+	return nil
+}
+
+// conflict returns the error for l overlapping the address of another flag.
+func (l *listenFlag) conflict(other string, addr *net.TCPAddr) error {
+	return &LifecycleError{BindFailed, "listen", l.flag,
+		fmt.Errorf("address %s overlaps %s for --%s", l.addr(), addr, other)}
+}
+
+// current returns the flag's listener, or nil if it is not listening.
+func (l *listenFlag) current() *WaitListener {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.listener
+}
+
+// start wraps under in a WaitListener, which becomes the flag's listener, and
+// serves it if the flag was created with ServeWith.
+func (l *listenFlag) start(under net.Listener) *WaitListener {
+	listener := newWaitListener(under, &l.config)
+	l.lock.Lock()
 	l.listener = listener
-	return listener, nil
+	l.lock.Unlock()
+	l.adoptIdleConns()
+	if FDStore {
+		storeListener(l.flag, listener)
+	}
+	if h := l.config.serve; h != nil {
+		go func() {
+			if err := Serve(listener, h); err != nil {
+				Error.Printf("Serving --%s failed: %s", l.flag, err)
+			}
+		}()
+	}
+	return listener
+}
+
+// adopt creates a listener from an inherited file descriptor, verifying that
+// it is listening on the address the parent process said it would be.
+func (l *listenFlag) adopt() (net.Listener, error) {
+	under, err := adoptListener(l.fd)
+	if err != nil {
+		return nil, err
+	}
+	if want, ok := inheritedAddrs()[l.flag]; ok && under.Addr().String() != want {
+		under.Close()
+		return nil, fmt.Errorf("fd %d is listening on %s, want %s", l.fd, under.Addr(), want)
+	}
+	return under, nil
 }
 
 func (l *listenFlag) String() string {
+	if len(l.siblings) > 0 {
+		return strings.Join(append([]string{l.configured()}, l.siblingAddrs()...), ",") + l.specSuffix()
+	}
+	return l.addr() + l.specSuffix()
+}
+
+// configured returns the address to which the flag is set, or its &fd.
+func (l *listenFlag) configured() string {
+	if l.mode == "fd" {
+		return fmt.Sprintf("&%d", l.fd)
+	}
+	return l.addr()
+}
+
+// addr returns the address to which the flag is set.
+func (l *listenFlag) addr() string {
+	if l.path != "" {
+		return unixPrefix + l.path
+	}
+	if l.laddr == nil {
+		return ""
+	}
 	if l.laddr.IP == nil {
 		return fmt.Sprintf(":%d", l.laddr.Port)
 	}
 	return l.laddr.String()
 }
 
+// specSuffix returns the options given in the flag value, if any, to be
+// appended to its address.
+func (l *listenFlag) specSuffix() string {
+	if l.spec == "" {
+		return ""
+	}
+	return "," + l.spec
+}
+
 func (l *listenFlag) Set(s string) error {
 	if len(s) == 0 {
 		return fmt.Errorf("--%s requires an argument", l.flag)
 	}
 
+	addrs, spec, opts, err := parseSpec(&l.base, s)
+	if err != nil {
+		return err
+	}
+	old := l.config
+	l.config, l.spec = l.base, spec
+	for _, opt := range opts {
+		opt(&l.config)
+	}
+	closeReplaced(&old, &l.config, &l.base)
+	if len(addrs) == 0 {
+		// Only options were given, so keep the default addresses
+		return l.setSiblings(l.siblingAddrs())
+	}
+	if err := l.setAddr(addrs[0]); err != nil {
+		return err
+	}
+	return l.setSiblings(addrs[1:])
+}
+
+// setAddr sets the address to listen on, or the &fd to adopt.
+func (l *listenFlag) setAddr(s string) error {
 	// Check for passed file descriptor
 	if s[0] == '&' {
 		fd, err := strconv.Atoi(s[1:])
 		if err != nil {
 			return fmt.Errorf("failed to parse &fd: %s", err)
 		}
-		l.mode, l.fd = "fd", fd
+		l.mode, l.fd, l.err = "fd", fd, nil
+		return nil
+	}
+	if strings.HasPrefix(s, unixPrefix) {
+		if s = s[len(unixPrefix):]; s == "" {
+			return fmt.Errorf("%q requires a path", unixPrefix)
+		}
+		l.mode, l.path, l.laddr, l.err = "unix", s, nil, nil
 		return nil
 	}
 
@@ -229,7 +986,7 @@ func (l *listenFlag) Set(s string) error {
 	if err != nil {
 		return fmt.Errorf("failed to resolve %q: %s", s, err)
 	}
-	l.mode, l.laddr = "tcp", laddr
+	l.mode, l.path, l.laddr, l.err = "tcp", "", laddr, nil
 	return nil
 }
 
@@ -237,19 +994,81 @@ func (l *listenFlag) Set(s string) error {
 // Listenable to listen on the provided address.  If the flag is not
 // provided, the default addr will be used.  The given proto is used
 // to create the help text.
-func ListenFlag(name, netw, addr, proto string) Listenable {
-	laddr, err := net.ResolveTCPAddr(netw, addr)
-	if err != nil {
-		Fatal.Printf("failed to resolve default %q: %s", addr, err)
-	}
-
+//
+// If the default addr cannot be resolved and the flag is not set to
+// something else, the error is returned by Listen.
+//
+// Several addresses may be given, separated by commas, to bind a socket on
+// each of them; Listen then returns a MultiListener.
+//
+// An address of the form "unix:PATH" listens on a unix socket at PATH
+// instead, with the permissions UnixMode.  A stale socket left at PATH is
+// replaced, and the socket is passed on by Restart like any other listener
+// and removed on Shutdown.
+//
+// If the process was started by systemd with a socket whose name (see
+// FileDescriptorName= in systemd.socket(5), or FDStore) matches the flag
+// name, that socket is adopted instead of binding a new one.
+//
+// The options, if any, configure the listener; for example, passing TLS
+// causes connections to be returned from Accept only once their TLS
+// handshakes have completed.  Options can also be given in the flag value,
+// after the address and separated by commas, and are applied on top of
+// those passed here:
+//
+//	--https="addr=:443,tls=cert.pem:key.pem,name=public"
+//
+// The address may be given first without "addr=", and may be omitted to use
+// the default; further addresses (which must contain a colon, or be an &fd)
+// may follow it.  The keys are:
+//
+//	addr=ADDR          address on which to listen, or &fd; may be repeated
+//	name=NAME          see Name
+//	tls=CERT:KEY       see TLS; the key pair is loaded when the flag is parsed
+//	handshake=DUR      see HandshakeTimeout
+//	untracked          see Untracked
+//	reuseport          see ReusePort
+//	shareport          see SharePort
+//	accounting         see Accounting
+//	reap=IDLE[:HALF]   see Reap (HALF is the limit for half-closed connections)
+//	maxconns=N[:block] see MaxConns, or MaxConnsBlock with block
+//	rate=R[:BURST]     see AcceptRate (BURST defaults to 1)
+//	highwater=M[+M...] see HighWater, or HighWaterPercent for marks like 90%
+//	proxy[=NET+NET]    see ProxyProtocol, trusting the networks if given
+//	proxyproto[=...]   the same as proxy
+//	logsample=N        see LogSample
+//	shards=N[:QUEUE]   see AcceptShards (QUEUE defaults to N)
+//	accesslog=PATH     see AccessLog; appends to PATH in CommonAccessFormat
+//	perip=N            see PerIPLimit (with no allowed networks)
+//	clientca=CA[:CRL]  see ClientCAs
+//	keylog[=PATH]      see KeyLog; requires InsecureKeyLog
+//	tap=PATH[:N]       see Tap; writes to the unix socket at PATH if there
+//	                   is one, or else appends to the capture file PATH
+//
+// The options in the flag value are passed on by Restart, so the key pair is
+// reloaded by each new generation.
+func ListenFlag(name, netw, addr, proto string, opts ...ListenOption) Listenable {
 	f := &listenFlag{
-		flag:  name,
-		proto: proto,
-		mode:  "tcp",
-		net:   netw,
-		laddr: laddr,
+		flag:   name,
+		proto:  proto,
+		mode:   "tcp",
+		net:    netw,
+		config: listenConfig{name: name},
+	}
+	addrs := strings.Split(addr, ",")
+	if addr = addrs[0]; strings.HasPrefix(addr, unixPrefix) {
+		f.mode, f.path = "unix", addr[len(unixPrefix):]
+	} else if f.laddr, f.err = net.ResolveTCPAddr(netw, addr); f.err != nil {
+		f.err = fmt.Errorf("failed to resolve default %q: %s", addr, f.err)
+	}
+	for _, opt := range opts {
+		opt(&f.config)
+	}
+	f.base = f.config
+	if err := f.setSiblings(addrs[1:]); err != nil && f.err == nil {
+		f.err = fmt.Errorf("default %s", err)
 	}
 	flag.Var(f, name, fmt.Sprintf("Address on which to listen for %s", proto))
+	Register(f)
 	return f
 }
@@ -0,0 +1,46 @@
+// +build linux darwin
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// checkListenFD verifies that the inherited fd is a listening socket.
+func checkListenFD(fd int) error {
+	accepting, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	if err != nil {
+		return fmt.Errorf("fd %d is not a socket: %s", fd, err)
+	}
+	if accepting == 0 {
+		return fmt.Errorf("fd %d is a socket, but is not listening", fd)
+	}
+	return nil
+}
+
+// checkPacketFD verifies that the inherited fd is a datagram socket.
+func checkPacketFD(fd int) error {
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return fmt.Errorf("fd %d is not a socket: %s", fd, err)
+	}
+	if typ != syscall.SOCK_DGRAM {
+		return fmt.Errorf("fd %d is not a datagram socket (type %d)", fd, typ)
+	}
+	return nil
+}
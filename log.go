@@ -17,19 +17,32 @@ package daemon
 import (
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 var (
-	logPrefix = fmt.Sprintf("[%d] ", os.Getpid())
+	logPrefix = newLogPrefix()
 	logFlags  = log.Ldate | log.Lmicroseconds | log.Lshortfile
-	logFile   = os.Stderr
-	logger    = log.New(logFile, logPrefix, logFlags)
+	logFile   = os.Stderr // guarded by sinkLock
+	logger    = log.New(logTee{stderrSink}, logPrefix, logFlags)
 )
 
+// newLogPrefix returns the prefix of every log record: the pid, followed by
+// the generation (see Generation) in processes started by Restart, so that
+// the records of the generations can be told apart while both are writing.
+// It reads the environment directly, since it is needed before init.
+func newLogPrefix() string {
+	if gen := os.Getenv(generationEnv); gen != "" && gen != "0" {
+		return fmt.Sprintf("[%d/%s] ", os.Getpid(), gen)
+	}
+	return fmt.Sprintf("[%d] ", os.Getpid())
+}
+
 // A Logger is a level-filtered log writer.
 type Logger int
 
@@ -58,9 +71,28 @@ func V(level int) Logger {
 }
 
 // LogLevel controls what log messages are written to the log.  Only logs
-// destined for an equal or higher level will be written.
+// destined for an equal or higher level will be written.  Once logging has
+// started, it should be changed with SetLogLevel.
 var LogLevel = Info
 
+// SetLogLevel sets LogLevel while other goroutines may be logging.  Outside
+// the windows of a LogSchedule, the level set is the one returned to.
+func SetLogLevel(l Logger) {
+	atomic.StoreUintptr(logLevelWord(), uintptr(l))
+}
+
+// logLevel returns LogLevel, which may be changed by SetLogLevel or the
+// LogSchedule while it is read.
+func logLevel() Logger {
+	return Logger(atomic.LoadUintptr(logLevelWord()))
+}
+
+// logLevelWord returns the address of LogLevel as a word, which is the size
+// of an int, so that it can be accessed atomically.
+func logLevelWord() *uintptr {
+	return (*uintptr)(unsafe.Pointer(&LogLevel))
+}
+
 func (l Logger) prefix() string {
 	switch l {
 	case Error, Fatal:
@@ -94,25 +126,97 @@ func stack() string {
 // sufficient.  If the message is directed at Exit or Fatal, the binary will
 // terminate after the log message is written.  If the message is directed to
 // Fatal or lower, a stack trace of all goroutines will also be written to the
-// log before exiting.  If the logger is Warning or higher, the log will be
-// Sync'd after writing.
+// log before exiting.  The message is masked by any functions registered with
+// Redact.  Error and higher records are also passed to any
+// functions registered with OnError.  If the logger is Warning or higher,
+// Printf waits (up to LogFlushTimeout) for the record to be written to each
+// destination, and the log will also be Sync'd after writing; other records
+// are queued without waiting (see LogCrashSafe).
+//
+// The arguments to Printf are prepared even if the message is suppressed; on
+// hot paths, use Logf or check Enabled first.
 func (l Logger) Printf(format string, args ...interface{}) {
-	if l > LogLevel {
+	if l > logThreshold(1) {
+		return
+	}
+	l.output(3, format, args)
+}
+
+// Enabled returns true if messages to this logger are written to the log
+// from the caller (see SetLogOverrides).  It can be used to skip preparing
+// expensive log arguments.
+func (l Logger) Enabled() bool {
+	return l <= logThreshold(1)
+}
+
+// Logf is like Printf, except that args is only called if the message will
+// be written, so a suppressed Logf does not allocate, as long as the function
+// literal does not escape.  For example:
+//
+//	daemon.V(4).Logf("Request: %v", func() []interface{} { return []interface{}{req} })
+func (l Logger) Logf(format string, args func() []interface{}) {
+	if l > logThreshold(1) {
 		return
 	}
-	msg := fmt.Sprintf(l.prefix()+format, args...)
+	l.output(3, format, args())
+}
+
+// output writes a message for Printf and Logf; depth is the number of stack
+// frames between the caller and Output.
+func (l Logger) output(depth int, format string, args []interface{}) {
+	l.outputTo(logger, "", "", depth+1, format, args)
+}
+
+// outputTo is output with the destination, which is logger except for a
+// Daemon with its own log file, the name of the Daemon logging, if any, and
+// the correlation ID of the record, if any.
+func (l Logger) outputTo(to *log.Logger, name, id string, depth int, format string, args []interface{}) {
+	msg := redact(fmt.Sprintf(format, args...))
+	var trace string
 	if l <= Fatal {
-		msg += "\n" + stack()
+		trace = stack()
 	}
-	logger.Output(2, msg)
-	if l < Info {
-		logFile.Sync()
+	switch {
+	case LogRecordFormat != FormatText:
+		e := newLogEntry(l, depth, name, id, msg, trace, errorCodeOf(args))
+		to.Writer().Write(e.format(LogRecordFormat))
+	case to == logger && name != "":
+		// The Daemon's name is normally the prefix of its logger.
+		to.Output(depth, l.prefix()+name+": "+correlated(id)+msg+suffix(trace))
+	default:
+		to.Output(depth, l.prefix()+correlated(id)+msg+suffix(trace))
+	}
+	switch {
+	case !LogCrashSafe && l <= Warning:
+		flushLogs(true)
+	case l <= Error:
+		flushLogs(true)
+	}
+	if l <= Error {
+		runErrorHooks(l, msg, trace, errorCodeOf(args), depth)
 	}
 	if l == Exit || l == Fatal {
-		os.Exit(1)
+		exit(1)
 	}
 }
 
+// suffix returns the stack trace to follow a message, if there is one.
+func suffix(trace string) string {
+	if trace == "" {
+		return ""
+	}
+	return "\n" + trace
+}
+
+// correlated returns the correlation ID to precede a message, if there is
+// one.
+func correlated(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "[" + id + "] "
+}
+
 // LogLevelFlag registers a flag with the given name which, when set, causes
 // only log messages of equal or higher level to be logged.  A pointer to the
 // log level chosen is returned.
@@ -122,20 +226,59 @@ func LogLevelFlag(name string) *Logger {
 }
 
 type logFileFlag struct {
-	mode os.FileMode
+	mode   os.FileMode
+	rotate sync.Once // starts rotating, once the name is a template
+
+	lock sync.Mutex
+	tmpl *logNameTemplate // nil if the name is not a template
+}
+
+// template returns the template of the log file name, if it has one.
+func (f *logFileFlag) template() *logNameTemplate {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.tmpl
 }
 
 func (f *logFileFlag) String() string {
-	return logFile.Name()
+	if tmpl := f.template(); tmpl != nil {
+		return tmpl.text
+	}
+	return currentLogFile().Name()
 }
 
 func (f *logFileFlag) Set(s string) error {
-	file, err := os.OpenFile(s, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.mode)
+	var tmpl *logNameTemplate
+	name := s
+	if isLogNameTemplate(s) {
+		var err error
+		if tmpl, err = parseLogNameTemplate(s); err != nil {
+			return err
+		}
+		if name, err = tmpl.expand(); err != nil {
+			return err
+		}
+	}
+	if err := f.open(name); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.tmpl = tmpl
+	f.lock.Unlock()
+	if tmpl != nil {
+		tmpl.link(name)
+		f.rotate.Do(func() { go f.rotateLogs() })
+	}
+	return nil
+}
+
+func (f *logFileFlag) open(name string) error {
+	file, err := os.OpenFile(name, logOpenFlags, f.mode)
 	if err != nil {
 		return err
 	}
-	logger = log.New(io.MultiWriter(os.Stderr, file), logPrefix, logFlags)
-	logFile = file
+	setLogFile(file) // the old file is closed by its sink
+	chownLogFile(-1, -1)
 	redirectStdout() // provided in OS-specific files
 	return nil
 }
@@ -143,7 +286,19 @@ func (f *logFileFlag) Set(s string) error {
 // LogFileFlag registers a flag with the given name which, when set,
 // causes daemon logs to be sent to the given file in addition to
 // standard error.  A pointer to the file is also returned,
-// which can be used for a deferred Close in main.
+// which can be used for a deferred Close in main.  Standard error and the
+// file are written independently, so that a stalled file does not stall
+// logging to standard error; see LogSinks.
+//
+// The file name may be a text/template (see LogNameData) so that each day
+// or process generation gets its own file.
+//
+// The log file is opened close-on-exec, so it will not be inherited by
+// processes started with os/exec; a process started by Restart receives
+// the flag and reopens the file in append mode instead.  Each record is
+// written with a single write, and while both generations are running, each
+// holds an exclusive lock (flock) on the file for the duration of the write,
+// so that their records do not interleave.
 func LogFileFlag(name string, mode os.FileMode) **os.File {
 	fileFlag := &logFileFlag{
 		mode: mode,
@@ -151,3 +306,34 @@ func LogFileFlag(name string, mode os.FileMode) **os.File {
 	flag.Var(fileFlag, name, "Log file (also writes to stderr if set)")
 	return &logFile
 }
+
+// Owner and group of the log file, if set by LogFileOwnerFlags.
+var logOwner, logGroup string
+
+type logOwnerFlag struct {
+	val *string
+}
+
+func (f *logOwnerFlag) String() string {
+	if f.val == nil {
+		return ""
+	}
+	return *f.val
+}
+
+func (f *logOwnerFlag) Set(s string) error {
+	*f.val = s
+	chownLogFile(-1, -1)
+	return nil
+}
+
+// LogFileOwnerFlags registers two flags, with the given names, which set the
+// user and group that should own the log file.  Ownership can only be changed
+// while running as root, so it is applied when the flags are parsed and again
+// just before privileges are dropped.  If no owner is specified, the log file
+// is given to the user to whom privileges are dropped; the group can be used
+// to give a secondary group (e.g. "adm") read access to the logs.
+func LogFileOwnerFlags(ownerFlagName, groupFlagName string) {
+	flag.Var(&logOwnerFlag{&logOwner}, ownerFlagName, "User who should own the log file (if set)")
+	flag.Var(&logOwnerFlag{&logGroup}, groupFlagName, "Group which should own the log file (if set)")
+}
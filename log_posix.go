@@ -18,9 +18,13 @@ package daemon
 
 import (
 	"os"
+	"os/user"
+	"strconv"
 	"syscall"
 )
 
+const logOpenFlags = os.O_WRONLY | os.O_APPEND | os.O_CREATE | syscall.O_CLOEXEC
+
 // RedirectStdout will cause anything written to standard output to be also
 // written to the LogFileFlagged file.  In particular, when this is true, panic
 // traces and standard uses of the "log" package will find their way into the
@@ -32,5 +36,53 @@ func redirectStdout() {
 		return
 	}
 
-	syscall.Dup2(int(logFile.Fd()), int(os.Stderr.Fd()))
+	syscall.Dup2(int(currentLogFile().Fd()), int(os.Stderr.Fd()))
+}
+
+// lockFile takes an exclusive advisory lock on f, and returns a function
+// which releases it.  If the lock cannot be taken, writing proceeds anyway.
+func lockFile(f *os.File) (unlock func()) {
+	fd := int(f.Fd())
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		return func() {}
+	}
+	return func() { syscall.Flock(fd, syscall.LOCK_UN) }
+}
+
+// chownLogFile transfers the log file to the owner and group specified with
+// LogFileOwnerFlags, falling back to uid and gid if they are not set (-1 leaves
+// the corresponding ID unchanged).  It does nothing unless running as root.
+func chownLogFile(uid, gid int) {
+	file := currentLogFile()
+	if file == os.Stderr || os.Geteuid() != 0 {
+		return
+	}
+	if logOwner != "" {
+		usr, err := user.Lookup(logOwner)
+		if err != nil {
+			Warning.Printf("failed to find log owner %q: %s", logOwner, err)
+			return
+		}
+		if uid, err = strconv.Atoi(usr.Uid); err != nil {
+			Warning.Printf("bad user ID %q: %s", usr.Uid, err)
+			return
+		}
+	}
+	if logGroup != "" {
+		grp, err := user.LookupGroup(logGroup)
+		if err != nil {
+			Warning.Printf("failed to find log group %q: %s", logGroup, err)
+			return
+		}
+		if gid, err = strconv.Atoi(grp.Gid); err != nil {
+			Warning.Printf("bad group ID %q: %s", grp.Gid, err)
+			return
+		}
+	}
+	if uid == -1 && gid == -1 {
+		return
+	}
+	if err := file.Chown(uid, gid); err != nil {
+		Warning.Printf("chown(%q, %d, %d): %s", file.Name(), uid, gid, err)
+	}
 }
@@ -0,0 +1,45 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"testing"
+)
+
+func TestLogfDisabledAllocs(t *testing.T) {
+	req := struct{ Path string }{"/"}
+	allocs := testing.AllocsPerRun(100, func() {
+		V(9).Logf("Request: %v", func() []interface{} { return []interface{}{req} })
+	})
+	if allocs != 0 {
+		t.Errorf("suppressed Logf allocated %v times per call, want 0", allocs)
+	}
+}
+
+func BenchmarkLogfDisabled(b *testing.B) {
+	req := struct{ Path string }{"/"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		V(9).Logf("Request: %v", func() []interface{} { return []interface{}{req} })
+	}
+}
+
+func BenchmarkPrintfDisabled(b *testing.B) {
+	req := struct{ Path string }{"/"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		V(9).Printf("Request: %v", req)
+	}
+}
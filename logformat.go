@@ -0,0 +1,345 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A LogFormat is a way of writing log records.
+type LogFormat string
+
+// Supported values of LogRecordFormat.
+const (
+	// FormatText is the default: a line starting with the pid, time and
+	// source location, like the standard log package.
+	FormatText LogFormat = "text"
+
+	// FormatJSON writes each record as a line of JSON with the fields
+	// time, level, msg, file, line, pid and generation, and daemon,
+	// correlation_id, code and stack if they apply.
+	FormatJSON LogFormat = "json"
+
+	// FormatGELF writes each record as a line of GELF 1.1, for Graylog.
+	// The fields other than those defined by GELF are those of
+	// FormatJSON, prefixed with an underscore.
+	FormatGELF LogFormat = "gelf"
+
+	// FormatRFC5424 writes each record as an RFC 5424 syslog message with
+	// the facility SyslogFacility, whose structured data (with the ID
+	// SyslogSDID) holds the generation and source location.  The MSGID is
+	// the ErrorCode of the record, if any.  The correlation ID, if any, is
+	// a parameter of the structured data.
+	FormatRFC5424 LogFormat = "rfc5424"
+)
+
+// LogRecordFormat is the format in which log records are written.  When it
+// is set to FormatGELF or FormatRFC5424 before ShipLogs is called with a tcp
+// or tls target, the records are framed as Graylog and syslog servers
+// expect: terminated by a null byte and preceded by their length,
+// respectively.
+var LogRecordFormat = FormatText
+
+// SyslogFacility is the facility of FormatRFC5424 records (3 is "daemon").
+var SyslogFacility = 3
+
+// SyslogSDID is the ID of the structured data element of FormatRFC5424
+// records.  The number after the @ is a private enterprise number, and
+// defaults to the one reserved for documentation (RFC 5612); set it to
+// your own organization's.
+var SyslogSDID = "daemon@32473"
+
+var logApp = filepath.Base(os.Args[0])
+
+func (f LogFormat) String() string {
+	return string(f)
+}
+
+// Set implements flag.Value.
+func (f *LogFormat) Set(s string) error {
+	switch v := LogFormat(s); v {
+	case FormatText, FormatJSON, FormatGELF, FormatRFC5424:
+		*f = v
+		return nil
+	}
+	return fmt.Errorf("log format %q: want text, json, gelf or rfc5424", s)
+}
+
+// LogFormatFlag registers a flag with the given name which sets the
+// LogRecordFormat.
+func LogFormatFlag(name string) {
+	flag.Var(&LogRecordFormat, name, "Format of log records: text, json, gelf or rfc5424")
+}
+
+// A logEntry is what a structured record is made from.
+type logEntry struct {
+	time   time.Time
+	level  Logger
+	msg    string
+	file   string
+	line   int
+	daemon string // name of the Daemon, if logged by one
+	id     string // correlation ID, if any
+	code   ErrorCode
+	stack  string
+}
+
+// newLogEntry collects the fields of a record.  The depth is interpreted
+// like the calldepth of log.Output, as seen from the caller of newLogEntry.
+func newLogEntry(l Logger, depth int, daemon, id, msg, stack string, code ErrorCode) *logEntry {
+	e := &logEntry{
+		time:   now(),
+		level:  l,
+		msg:    msg,
+		daemon: daemon,
+		id:     id,
+		code:   code,
+		stack:  stack,
+	}
+	if _, file, line, ok := runtime.Caller(depth); ok {
+		e.file, e.line = filepath.Base(file), line
+	}
+	return e
+}
+
+// levelName returns the name of a level in structured records.
+func levelName(l Logger) string {
+	switch {
+	case l == Fatal:
+		return "fatal"
+	case l == Exit:
+		return "exit"
+	case l == Error:
+		return "error"
+	case l == Warning:
+		return "warning"
+	case l == Info:
+		return "info"
+	}
+	return "verbose"
+}
+
+// severity returns the syslog severity of a level, which GELF also uses.
+func severity(l Logger) int {
+	switch {
+	case l <= Exit:
+		return 2 // critical
+	case l == Error:
+		return 3
+	case l == Warning:
+		return 4
+	case l == Info:
+		return 6
+	}
+	return 7 // debug
+}
+
+// levelOfSeverity is the inverse of severity.
+func levelOfSeverity(sev int) Logger {
+	switch {
+	case sev <= 3:
+		return Error
+	case sev <= 5:
+		return Warning
+	case sev == 6:
+		return Info
+	}
+	return Verbose
+}
+
+// format returns the record in the given format, ending in a newline.
+func (e *logEntry) format(f LogFormat) []byte {
+	switch f {
+	case FormatGELF:
+		return e.gelf()
+	case FormatRFC5424:
+		return e.rfc5424()
+	}
+	return e.json()
+}
+
+func (e *logEntry) json() []byte {
+	rec := struct {
+		Time       string `json:"time"`
+		Level      string `json:"level"`
+		Msg        string `json:"msg"`
+		File       string `json:"file,omitempty"`
+		Line       int    `json:"line,omitempty"`
+		PID        int    `json:"pid"`
+		Generation int    `json:"generation"`
+		Daemon     string `json:"daemon,omitempty"`
+		ID         string `json:"correlation_id,omitempty"`
+		Code       string `json:"code,omitempty"`
+		Stack      string `json:"stack,omitempty"`
+	}{
+		Time:       e.time.Format(time.RFC3339Nano),
+		Level:      levelName(e.level),
+		Msg:        e.msg,
+		File:       e.file,
+		Line:       e.line,
+		PID:        pid(),
+		Generation: Generation(),
+		Daemon:     e.daemon,
+		ID:         e.id,
+		Stack:      e.stack,
+	}
+	if e.code != 0 {
+		rec.Code = e.code.String()
+	}
+	return marshalLine(rec)
+}
+
+func (e *logEntry) gelf() []byte {
+	short, full := e.msg, ""
+	if i := strings.IndexByte(short, '\n'); i >= 0 || e.stack != "" {
+		full = e.msg
+		if e.stack != "" {
+			full += "\n" + e.stack
+		}
+		if i >= 0 {
+			short = short[:i]
+		}
+	}
+	rec := struct {
+		Version    string  `json:"version"`
+		Host       string  `json:"host"`
+		Short      string  `json:"short_message"`
+		Full       string  `json:"full_message,omitempty"`
+		Timestamp  float64 `json:"timestamp"`
+		Level      int     `json:"level"`
+		File       string  `json:"_file,omitempty"`
+		Line       int     `json:"_line,omitempty"`
+		PID        int     `json:"_pid"`
+		Generation int     `json:"_generation"`
+		App        string  `json:"_app"`
+		Daemon     string  `json:"_daemon,omitempty"`
+		ID         string  `json:"_correlation_id,omitempty"`
+		Code       string  `json:"_code,omitempty"`
+	}{
+		Version:    "1.1",
+		Host:       currentProviders().host,
+		Short:      short,
+		Full:       full,
+		Timestamp:  float64(e.time.UnixNano()/1e3) / 1e6,
+		Level:      severity(e.level),
+		File:       e.file,
+		Line:       e.line,
+		PID:        pid(),
+		Generation: Generation(),
+		App:        logApp,
+		Daemon:     e.daemon,
+		ID:         e.id,
+	}
+	if e.code != 0 {
+		rec.Code = e.code.String()
+	}
+	return marshalLine(rec)
+}
+
+func marshalLine(v interface{}) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v) // only strings and numbers, so it cannot fail
+	return buf.Bytes()
+}
+
+func (e *logEntry) rfc5424() []byte {
+	var buf bytes.Buffer
+	msgID := "-"
+	if e.code != 0 {
+		msgID = e.code.String()
+	}
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d %s [%s", SyslogFacility*8+severity(e.level),
+		e.time.Format("2006-01-02T15:04:05.000000Z07:00"), syslogName(currentProviders().host), syslogName(logApp),
+		pid(), msgID, SyslogSDID)
+	params := [][2]string{{"generation", strconv.Itoa(Generation())}}
+	if e.file != "" {
+		params = append(params, [2]string{"file", e.file}, [2]string{"line", strconv.Itoa(e.line)})
+	}
+	if e.daemon != "" {
+		params = append(params, [2]string{"daemon", e.daemon})
+	}
+	if e.id != "" {
+		params = append(params, [2]string{"correlation_id", e.id})
+	}
+	for _, p := range params {
+		fmt.Fprintf(&buf, " %s=\"%s\"", p[0], sdEscaper.Replace(p[1]))
+	}
+	buf.WriteString("] ")
+	buf.WriteString(e.msg)
+	if e.stack != "" {
+		buf.WriteString("\n" + e.stack)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// sdEscaper escapes the characters which are special in RFC 5424 parameter
+// values.
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// syslogName returns s as an RFC 5424 header field: printable ASCII without
+// spaces, or "-" if it is empty.
+func syslogName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formattedLevel returns the level of a record written in the given format.
+func formattedLevel(f LogFormat, rec []byte) Logger {
+	switch f {
+	case FormatJSON:
+		var r struct{ Level string }
+		if json.Unmarshal(rec, &r) == nil {
+			for l := Fatal; l <= Verbose; l++ {
+				if levelName(l) == r.Level {
+					return l
+				}
+			}
+		}
+		return Error
+	case FormatGELF:
+		var r struct{ Level *int }
+		if json.Unmarshal(rec, &r) == nil && r.Level != nil {
+			return levelOfSeverity(*r.Level)
+		}
+		return Error
+	case FormatRFC5424:
+		var pri int
+		if _, err := fmt.Sscanf(string(rec), "<%d>", &pri); err == nil {
+			return levelOfSeverity(pri % 8)
+		}
+		return Error
+	}
+	return textLevel(rec)
+}
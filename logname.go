@@ -0,0 +1,135 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// LogNameData is the data available to a templated log file name.  For
+// example, a log file of
+//
+//	/var/log/echo.{{.Date}}.{{.PID}}.log
+//
+// will write to a new file each day and in each process generation.  A
+// symlink named with each action replaced by "current" (in this case,
+// /var/log/echo.current.current.log) always points to the active file.
+type LogNameData struct {
+	Time time.Time // Time at which the name is being expanded
+	Date string    // Time formatted as YYYYMMDD
+	Host string    // Hostname
+	PID  int       // Process ID
+	Prog string    // Base name of the binary
+}
+
+// logRotateCheck is how often a templated log file name is re-expanded to
+// see if a new file should be opened.
+var logRotateCheck = time.Minute
+
+var logNameAction = regexp.MustCompile(`{{[^}]*}}`)
+
+func isLogNameTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+type logNameTemplate struct {
+	text string
+	tmpl *template.Template
+}
+
+func parseLogNameTemplate(s string) (*logNameTemplate, error) {
+	tmpl, err := template.New("logfile").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad log file template %q: %s", s, err)
+	}
+	return &logNameTemplate{text: s, tmpl: tmpl}, nil
+}
+
+func (t *logNameTemplate) expand() (string, error) {
+	now := now()
+	data := LogNameData{
+		Time: now,
+		Date: now.Format("20060102"),
+		Host: hostname(),
+		PID:  pid(),
+		Prog: filepath.Base(os.Args[0]),
+	}
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("expanding log file template %q: %s", t.text, err)
+	}
+	return buf.String(), nil
+}
+
+// link points the "current" symlink at the named file.
+func (t *logNameTemplate) link(name string) {
+	current := logNameAction.ReplaceAllString(t.text, "current")
+	if current == name {
+		return
+	}
+	target := name
+	if filepath.Dir(current) == filepath.Dir(name) {
+		target = filepath.Base(name)
+	}
+
+	// Create the new link to the side and rename it into place so that
+	// the current link always exists.
+	tmp := fmt.Sprintf("%s.%d", current, pid())
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		Warning.Printf("symlink %q -> %q: %s", current, target, err)
+		return
+	}
+	if err := os.Rename(tmp, current); err != nil {
+		os.Remove(tmp)
+		Warning.Printf("symlink %q -> %q: %s", current, target, err)
+	}
+}
+
+// rotateLogs periodically re-expands the log file template and switches to
+// the new file if the name has changed.
+func (f *logFileFlag) rotateLogs() {
+	for {
+		time.Sleep(logRotateCheck)
+
+		tmpl := f.template()
+		if tmpl == nil {
+			// Set since to a plain name
+			continue
+		}
+		name, err := tmpl.expand()
+		if err != nil {
+			Error.Printf("%s", err)
+			continue
+		}
+		if name == currentLogFile().Name() {
+			continue
+		}
+
+		Info.Printf("Rotating log file to %s", name)
+		if err := f.open(name); err != nil {
+			Error.Printf("rotating log file: %s", err)
+			continue
+		}
+		tmpl.link(name)
+	}
+}
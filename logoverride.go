@@ -0,0 +1,185 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A logOverride is the parsed form of SetLogOverrides.
+type logOverride map[string]Logger
+
+var (
+	overrideLock  sync.RWMutex
+	overrides     logOverride
+	overrideSites map[uintptr]siteOverride // cache of the override of each pc
+	overridden    int32                    // atomic; whether there are any overrides
+)
+
+// SetLogOverrides sets the log level of particular call sites, overriding
+// LogLevel for them.  The spec is a comma-separated list of key=level, where
+// the key is one of (from the most specific):
+//
+//	file.go:123    a single line of a source file
+//	file.go        a source file, by base name
+//	accept         a function or method, by name (without its receiver)
+//	daemon         a package, by name
+//
+// For example, "listen.go=4,accept=1" writes verbose messages up to V(4)
+// from listen.go, but only warnings and errors from functions named accept.
+// An empty spec removes all overrides.  Exit and Fatal messages are always
+// written.
+func SetLogOverrides(spec string) error {
+	o := logOverride{}
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		eq := strings.LastIndex(entry, "=")
+		if eq < 1 {
+			return fmt.Errorf("log override %q: want key=level", entry)
+		}
+		level, err := strconv.Atoi(entry[eq+1:])
+		if err != nil || level < 0 {
+			return fmt.Errorf("log override %q: level must be a number >= 0", entry)
+		}
+		o[entry[:eq]] = Logger(level)
+	}
+
+	overrideLock.Lock()
+	defer overrideLock.Unlock()
+	overrides, overrideSites = o, map[uintptr]siteOverride{}
+	set := int32(0)
+	if len(o) > 0 {
+		set = 1
+	}
+	atomic.StoreInt32(&overridden, set)
+	return nil
+}
+
+// LogOverrides returns the current overrides, in the form accepted by
+// SetLogOverrides.
+func LogOverrides() string {
+	overrideLock.RLock()
+	defer overrideLock.RUnlock()
+	return overrides.String()
+}
+
+func (o logOverride) String() string {
+	var entries []string
+	for key, level := range o {
+		entries = append(entries, fmt.Sprintf("%s=%d", key, level))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// logThreshold returns the level up to which messages are written from the
+// call site skip frames above the caller of logThreshold: LogLevel, unless it
+// is overridden.
+func logThreshold(skip int) Logger {
+	if atomic.LoadInt32(&overridden) == 0 {
+		return logLevel()
+	}
+	pc, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return logLevel()
+	}
+
+	overrideLock.RLock()
+	site, cached := overrideSites[pc]
+	overrideLock.RUnlock()
+	if cached {
+		return site.threshold()
+	}
+
+	var pkg, fn string
+	if f := runtime.FuncForPC(pc); f != nil {
+		// For example, "kylelemons.net/go/daemon.(*WaitListener).accept".
+		name := f.Name()
+		name = name[strings.LastIndex(name, "/")+1:]
+		pkg = name
+		if dot := strings.Index(name, "."); dot >= 0 {
+			pkg = name[:dot]
+		}
+		fn = name[strings.LastIndex(name, ".")+1:]
+	}
+	base := filepath.Base(file)
+
+	overrideLock.Lock()
+	defer overrideLock.Unlock()
+	for _, key := range []string{fmt.Sprintf("%s:%d", base, line), base, fn, pkg} {
+		if l, ok := overrides[key]; ok {
+			site = siteOverride{l, true}
+			break
+		}
+	}
+	overrideSites[pc] = site
+	return site.threshold()
+}
+
+// A siteOverride is the override of a call site, if it has one.  Sites
+// without one follow LogLevel as it changes.
+type siteOverride struct {
+	level Logger
+	ok    bool
+}
+
+func (s siteOverride) threshold() Logger {
+	if s.ok {
+		return s.level
+	}
+	return logLevel()
+}
+
+type logOverrideFlag struct{}
+
+func (logOverrideFlag) String() string     { return LogOverrides() }
+func (logOverrideFlag) Set(s string) error { return SetLogOverrides(s) }
+
+// LogOverridesFlag registers a flag with the given name (such as
+// "log-overrides") which sets SetLogOverrides.  The overrides can also be
+// changed at runtime with the "logoverrides" control command.
+func LogOverridesFlag(name string) {
+	flag.Var(logOverrideFlag{}, name, `Log levels of particular call sites, such as "listen.go=4,accept=1"`)
+}
+
+// logOverridesCommand implements the logoverrides control command.
+func logOverridesCommand(w io.Writer, args []string) error {
+	switch len(args) {
+	case 0:
+	case 1:
+		spec := args[0]
+		if spec == "-" {
+			spec = ""
+		}
+		if err := SetLogOverrides(spec); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("usage: logoverrides [spec|-]")
+	}
+	fmt.Fprintf(w, "log overrides: %q\n", LogOverrides())
+	return nil
+}
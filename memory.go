@@ -0,0 +1,158 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// MemoryCheck, if positive, causes Run and RunContext to compare the memory
+// usage of the process against HeapLimit and RSSLimit this often.  When
+// either limit is first exceeded, the MemoryActions are taken; they are not
+// taken again until usage has dropped back below the limits.  This gives a
+// leaky daemon a controlled way out instead of being killed for running out of
+// memory.
+var MemoryCheck time.Duration
+
+// HeapLimit and RSSLimit are the memory limits, in bytes, checked by
+// MemoryCheck.  A limit of zero is not checked.  RSSLimit is only supported
+// on Linux.
+var HeapLimit, RSSLimit uint64
+
+// A MemoryAction is something to do when a memory limit is exceeded.
+type MemoryAction int
+
+// Actions which can be combined in MemoryActions.
+const (
+	// MemoryProfile writes a heap profile to MemoryProfileDir and logs its
+	// name.
+	MemoryProfile MemoryAction = 1 << iota
+
+	// MemoryHooks calls the functions registered with OnMemoryLimit.
+	MemoryHooks
+
+	// MemoryRestart performs a graceful Restart, with LameDuck as the
+	// timeout.
+	MemoryRestart
+)
+
+// MemoryActions are the actions taken when a memory limit is exceeded.
+var MemoryActions = MemoryProfile | MemoryHooks
+
+// MemoryProfileDir is the directory to which MemoryProfile writes.
+var MemoryProfileDir = os.TempDir()
+
+// MemoryStats is the memory usage of the process.
+type MemoryStats struct {
+	Heap uint64 // Bytes of allocated heap objects
+	RSS  uint64 // Resident set size, or 0 if it is not supported
+}
+
+var (
+	memoryLock  sync.Mutex
+	memoryHooks []func(MemoryStats)
+	memoryOnce  sync.Once
+)
+
+// OnMemoryLimit registers a function to be called (if MemoryActions includes
+// MemoryHooks) when a memory limit is exceeded.
+func OnMemoryLimit(fn func(MemoryStats)) {
+	memoryLock.Lock()
+	defer memoryLock.Unlock()
+	memoryHooks = append(memoryHooks, fn)
+}
+
+// Memory returns the current memory usage of the process.
+func Memory() MemoryStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return MemoryStats{
+		Heap: ms.HeapAlloc,
+		RSS:  residentBytes(), // provided in OS-specific files
+	}
+}
+
+// over returns a description of the limit exceeded by s, if any.
+func (s MemoryStats) over() string {
+	switch {
+	case HeapLimit > 0 && s.Heap > HeapLimit:
+		return fmt.Sprintf("heap is %d bytes (limit %d)", s.Heap, HeapLimit)
+	case RSSLimit > 0 && s.RSS > RSSLimit:
+		return fmt.Sprintf("RSS is %d bytes (limit %d)", s.RSS, RSSLimit)
+	}
+	return ""
+}
+
+// watchMemory checks the memory usage every MemoryCheck.
+func watchMemory() {
+	exceeded := false
+	for range time.Tick(MemoryCheck) {
+		s := Memory()
+		over := s.over()
+		if over == "" || exceeded {
+			exceeded = over != ""
+			continue
+		}
+		exceeded = true
+		Warning.Printf("Memory limit exceeded: %s", over)
+		memoryExceeded(s, over)
+	}
+}
+
+func memoryExceeded(s MemoryStats, over string) {
+	if MemoryActions&MemoryProfile != 0 {
+		if name, err := writeHeapProfile(); err != nil {
+			Error.Printf("Failed to write heap profile: %s", err)
+		} else {
+			Info.Printf("Wrote heap profile to %s", name)
+		}
+	}
+	if MemoryActions&MemoryHooks != 0 {
+		memoryLock.Lock()
+		hooks := append([]func(MemoryStats){}, memoryHooks...)
+		memoryLock.Unlock()
+		for _, fn := range hooks {
+			fn(s)
+		}
+	}
+	if MemoryActions&MemoryRestart != 0 {
+		selfRestart(Reason{
+			Trigger:   "memory",
+			Initiator: over,
+			Timeout:   LameDuck,
+		})
+	}
+}
+
+// writeHeapProfile writes a heap profile to a new file in MemoryProfileDir.
+func writeHeapProfile() (string, error) {
+	name := filepath.Join(MemoryProfileDir, fmt.Sprintf("%s.%d.%s.heap",
+		filepath.Base(os.Args[0]), os.Getpid(), time.Now().Format("20060102-150405")))
+	file, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	if err := pprof.WriteHeapProfile(file); err != nil {
+		file.Close()
+		return "", err
+	}
+	return name, file.Close()
+}
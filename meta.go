@@ -0,0 +1,81 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"sync"
+)
+
+// A ConnMeta is a small key/value store attached to each connection accepted
+// by a WaitListener.  Middleware (PROXY protocol parsing, TLS, authentication)
+// can record what it learns about a connection, and handlers can read it back
+// with Meta, regardless of how many times the connection has been wrapped.
+//
+// As with context values, keys should be of an unexported type to avoid
+// collisions between packages.
+type ConnMeta struct {
+	lock   sync.RWMutex
+	values map[interface{}]interface{}
+}
+
+// Set associates value with key.
+func (m *ConnMeta) Set(key, value interface{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.values == nil {
+		m.values = make(map[interface{}]interface{})
+	}
+	m.values[key] = value
+}
+
+// Get returns the value associated with key, or nil.
+func (m *ConnMeta) Get(key interface{}) interface{} {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.values[key]
+}
+
+// Each calls fn for each key/value pair in the store.
+func (m *ConnMeta) Each(fn func(key, value interface{})) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for k, v := range m.values {
+		fn(k, v)
+	}
+}
+
+// A metaConn is a connection which carries a ConnMeta.
+type metaConn interface {
+	Meta() *ConnMeta
+}
+
+// Meta returns the metadata store for a connection accepted from a
+// WaitListener.  Wrapping connections (such as *tls.Conn) are unwrapped via
+// their NetConn method to find it.  If conn was not accepted from a
+// WaitListener, Meta returns nil.
+func Meta(conn net.Conn) *ConnMeta {
+	for conn != nil {
+		if mc, ok := conn.(metaConn); ok {
+			return mc.Meta()
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil
+}
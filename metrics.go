@@ -0,0 +1,164 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"time"
+)
+
+// Metrics is the interface through which this package reports its internal
+// instrumentation, so that the application can choose the backend.  Labels
+// are given as alternating names and values, and a given metric name is
+// always used with the same label names.  Implementations must be safe for
+// concurrent use, and must not log through this package.
+//
+// Adapters for Prometheus (promtext) and StatsD (statsd) are provided in the
+// subpackages of kylelemons.net/go/daemon/metrics; they only use the standard
+// library.  Other backends, such as OpenTelemetry, can be bridged by
+// implementing the four small interfaces.
+type Metrics interface {
+	Counter(name, help string, labels ...string) Counter
+	Gauge(name, help string, labels ...string) Gauge
+	Histogram(name, help string, labels ...string) Histogram
+}
+
+// A Counter is a metric which only increases.
+type Counter interface {
+	Add(delta float64)
+}
+
+// A Gauge is a metric which can be set to any value.
+type Gauge interface {
+	Set(value float64)
+}
+
+// A Histogram is a metric which records a distribution of observations.
+type Histogram interface {
+	Observe(value float64)
+}
+
+// metrics receives the package's instrumentation.
+var (
+	metrics    Metrics = nopMetrics{}
+	metricsSet bool
+)
+
+// MetricsInterval is how often Run and RunContext report the process-wide
+// metrics (uptime, file descriptors, and memory), if SetMetrics was called.
+var MetricsInterval = 10 * time.Second
+
+// SetMetrics sets the backend to which this package reports its metrics.  It
+// should be called before any listeners are created, since they look up
+// their metrics when they are created.  Passing nil disables metrics.
+func SetMetrics(m Metrics) {
+	metrics, metricsSet = m, m != nil
+	if m == nil {
+		metrics = nopMetrics{}
+	}
+}
+
+// Names of the metrics reported by this package.
+const (
+	metricAccepted        = "daemon_connections_accepted_total"
+	metricRejected        = "daemon_connections_rejected_total"
+	metricShed            = "daemon_connections_shed_total"
+	metricActive          = "daemon_connections_active"
+	metricAcceptErrors    = "daemon_accept_errors_total"
+	metricHandshakeFailed = "daemon_tls_handshake_failures_total"
+	metricQueueDepth      = "daemon_accept_queue_depth"
+	metricQueueFull       = "daemon_accept_queue_full_total"
+	metricPanics          = "daemon_handler_panics_total"
+	metricPanicSites      = "daemon_handler_panic_sites_total"
+	metricDrainSeconds    = "daemon_drain_seconds"
+	metricFDsOpen         = "daemon_fds_open"
+	metricFDsLimit        = "daemon_fds_limit"
+	metricHeapBytes       = "daemon_heap_bytes"
+	metricRSSBytes        = "daemon_rss_bytes"
+	metricUptimeSeconds   = "daemon_uptime_seconds"
+	metricGeneration      = "daemon_generation"
+	metricSelfProbeUp     = "daemon_self_probe_up"
+	metricSelfProbeTime   = "daemon_self_probe_seconds"
+	metricReaped          = "daemon_connections_reaped_total"
+	metricProxyFailed     = "daemon_proxy_header_failures_total"
+	metricConnLimited     = "daemon_connections_limit_reached_total"
+	metricRateLimited     = "daemon_accepts_rate_limited_total"
+	metricHighWater       = "daemon_connections_high_water"
+)
+
+// listenerMetrics are the metrics of a single WaitListener.
+type listenerMetrics struct {
+	accepted    Counter
+	rejected    Counter
+	shed        Counter
+	limited     Counter
+	rateLimited Counter
+	active      Gauge
+
+	// acceptErrors has a counter for each class of acceptErrorClass.
+	acceptErrors map[string]Counter
+}
+
+func newListenerMetrics(name, policy string) listenerMetrics {
+	m := listenerMetrics{
+		accepted:     metrics.Counter(metricAccepted, "Connections accepted", "listener", name),
+		rejected:     metrics.Counter(metricRejected, "Connections rejected by admission control", "listener", name),
+		shed:         metrics.Counter(metricShed, "Connections shed under overload", "listener", name, "policy", policy),
+		limited:      metrics.Counter(metricConnLimited, "Times a connection found MaxConns reached", "listener", name),
+		rateLimited:  metrics.Counter(metricRateLimited, "Accepts delayed by the AcceptRate", "listener", name),
+		active:       metrics.Gauge(metricActive, "Connections currently open", "listener", name),
+		acceptErrors: map[string]Counter{},
+	}
+	for _, class := range []string{"emfile", "econnaborted", "closed", "timeout", "other"} {
+		m.acceptErrors[class] = metrics.Counter(metricAcceptErrors, "Errors from accept, by class", "listener", name, "class", class)
+	}
+	return m
+}
+
+// reportMetrics reports the process-wide metrics every MetricsInterval.
+func reportMetrics() {
+	var (
+		uptime = metrics.Gauge(metricUptimeSeconds, "Seconds since the process started")
+		gen    = metrics.Gauge(metricGeneration, "Restarts leading to this process")
+		open   = metrics.Gauge(metricFDsOpen, "Open file descriptors")
+		limit  = metrics.Gauge(metricFDsLimit, "Limit on open file descriptors")
+		heap   = metrics.Gauge(metricHeapBytes, "Bytes of allocated heap objects")
+		rss    = metrics.Gauge(metricRSSBytes, "Resident set size in bytes")
+	)
+	gen.Set(float64(Generation()))
+	for ; ; time.Sleep(MetricsInterval) {
+		uptime.Set(Uptime().Seconds())
+		if fds, err := FDs(); err == nil {
+			open.Set(float64(fds.Open))
+			limit.Set(float64(fds.Limit))
+		}
+		m := Memory()
+		heap.Set(float64(m.Heap))
+		if m.RSS > 0 {
+			rss.Set(float64(m.RSS))
+		}
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, string, ...string) Counter     { return nopMetric{} }
+func (nopMetrics) Gauge(string, string, ...string) Gauge         { return nopMetric{} }
+func (nopMetrics) Histogram(string, string, ...string) Histogram { return nopMetric{} }
+
+type nopMetric struct{}
+
+func (nopMetric) Add(float64)     {}
+func (nopMetric) Set(float64)     {}
+func (nopMetric) Observe(float64) {}
@@ -0,0 +1,202 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package promtext implements daemon.Metrics by serving the metrics over HTTP
+// in the Prometheus text exposition format, without depending on the
+// Prometheus client library.
+//
+//	reg := promtext.New()
+//	daemon.SetMetrics(reg)
+//	http.Handle("/metrics", reg)
+package promtext
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"kylelemons.net/go/daemon"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Registry holds metrics and serves them to Prometheus.  It is safe for
+// concurrent use.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+// New returns an empty Registry.
+func New() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+type family struct {
+	name, help, kind string
+	series           map[string]*series // by formatted labels
+}
+
+type series struct {
+	lock    sync.Mutex
+	value   float64   // counter or gauge value, or histogram sum
+	count   uint64    // histogram observations
+	buckets []uint64  // histogram counts, parallel to bounds
+	bounds  []float64 // histogram bucket upper bounds
+}
+
+func (s *series) Add(delta float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.value += delta
+}
+
+func (s *series) Set(value float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.value = value
+}
+
+func (s *series) Observe(value float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.value += value
+	s.count++
+	for i, le := range s.bounds {
+		if value <= le {
+			s.buckets[i]++
+		}
+	}
+}
+
+// Counter implements daemon.Metrics.
+func (r *Registry) Counter(name, help string, labels ...string) daemon.Counter {
+	return r.get("counter", name, help, labels)
+}
+
+// Gauge implements daemon.Metrics.
+func (r *Registry) Gauge(name, help string, labels ...string) daemon.Gauge {
+	return r.get("gauge", name, help, labels)
+}
+
+// Histogram implements daemon.Metrics, using DefaultBuckets.
+func (r *Registry) Histogram(name, help string, labels ...string) daemon.Histogram {
+	return r.get("histogram", name, help, labels)
+}
+
+func (r *Registry) get(kind, name, help string, labels []string) *series {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, series: map[string]*series{}}
+		r.families[name] = f
+	}
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = new(series)
+		if kind == "histogram" {
+			s.bounds = DefaultBuckets
+			s.buckets = make([]uint64, len(s.bounds))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// formatLabels formats alternating names and values as {name="value",...}.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label to the formatted labels.
+func withLabel(labels, name, value string) string {
+	pair := name + "=" + strconv.Quote(value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo writes the metrics in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	var names []string
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		var keys []string
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			f.write(&b, key, f.series[key])
+		}
+	}
+	r.lock.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (f *family) write(b *strings.Builder, labels string, s *series) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if f.kind != "histogram" {
+		fmt.Fprintf(b, "%s%s %s\n", f.name, labels, formatFloat(s.value))
+		return
+	}
+	for i, le := range s.bounds {
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, withLabel(labels, "le", formatFloat(le)), s.buckets[i])
+	}
+	fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, withLabel(labels, "le", "+Inf"), s.count)
+	fmt.Fprintf(b, "%s_sum%s %s\n", f.name, labels, formatFloat(s.value))
+	fmt.Fprintf(b, "%s_count%s %d\n", f.name, labels, s.count)
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
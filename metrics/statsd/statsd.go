@@ -0,0 +1,118 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package statsd implements daemon.Metrics by sending the metrics to a StatsD
+// server over UDP.
+//
+//	c, err := statsd.Dial("127.0.0.1:8125", "myserver.")
+//	if err != nil { ... }
+//	daemon.SetMetrics(c)
+package statsd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"kylelemons.net/go/daemon"
+)
+
+// A Client sends metrics to a StatsD server.  It is safe for concurrent use.
+type Client struct {
+	// Tags, if set, sends labels as DogStatsD-style tags.  Otherwise the
+	// label values are appended to the metric name.
+	Tags bool
+
+	prefix string
+	lock   sync.Mutex
+	conn   net.Conn
+}
+
+// Dial returns a Client which sends to the StatsD server at addr, prefixing
+// every metric name with prefix.
+func Dial(addr, prefix string) (*Client, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{prefix: prefix, conn: conn}, nil
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+type metric struct {
+	c          *Client
+	name, tags string
+	kind       string // StatsD metric type
+}
+
+func (m metric) send(value float64) {
+	line := m.name + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + m.kind + m.tags
+	m.c.lock.Lock()
+	defer m.c.lock.Unlock()
+	// Errors are ignored: metrics are best-effort, and the server may
+	// simply not be running.
+	m.c.conn.Write([]byte(line))
+}
+
+func (m metric) Add(delta float64)     { m.send(delta) }
+func (m metric) Set(value float64)     { m.send(value) }
+func (m metric) Observe(value float64) { m.send(value) }
+
+func (c *Client) metric(kind, name string, labels []string) metric {
+	m := metric{c: c, name: c.prefix + name, kind: kind}
+	var tags []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		if c.Tags {
+			tags = append(tags, labels[i]+":"+labels[i+1])
+		} else {
+			m.name += "." + sanitize(labels[i+1])
+		}
+	}
+	if len(tags) > 0 {
+		m.tags = "|#" + strings.Join(tags, ",")
+	}
+	return m
+}
+
+// sanitize replaces the characters which are meaningful to StatsD.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Counter implements daemon.Metrics.
+func (c *Client) Counter(name, help string, labels ...string) daemon.Counter {
+	return c.metric("c", name, labels)
+}
+
+// Gauge implements daemon.Metrics.
+func (c *Client) Gauge(name, help string, labels ...string) daemon.Gauge {
+	return c.metric("g", name, labels)
+}
+
+// Histogram implements daemon.Metrics.  Observations are sent as StatsD
+// histograms ("h"), which most servers treat like timers.
+func (c *Client) Histogram(name, help string, labels ...string) daemon.Histogram {
+	return c.metric("h", name, labels)
+}
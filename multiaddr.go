@@ -0,0 +1,265 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MultiListener merges the connections accepted by several WaitListeners.
+// It is returned by Listen for a ListenFlag which is given more than one
+// address, for example
+//
+//	--http=0.0.0.0:80,[::]:80,10.0.0.5:8080
+//
+// Each address is bound (and passed on by Restart) as its own socket, and is
+// reported by Listeners under the flag name followed by "#1", "#2"... for the
+// addresses after the first.  A ListenFlag created with ServeWith serves each
+// of them directly, so its MultiListener should not also be accepted from.
+type MultiListener struct {
+	Listeners []*WaitListener // One for each address, in the order given
+
+	once     sync.Once
+	results  chan acceptResult
+	done     chan bool // closed by the first error, or Close
+	doneOnce sync.Once
+	err      error // returned by Accept once done
+}
+
+func newMultiListener(ws []*WaitListener) *MultiListener {
+	return &MultiListener{
+		Listeners: ws,
+		results:   make(chan acceptResult, len(ws)),
+		done:      make(chan bool),
+	}
+}
+
+// Accept returns the next connection accepted by any of the listeners.  Other
+// errors from a listener, such as running out of file descriptors, are
+// logged and retried with a backoff, but once one of the listeners is
+// stopped or closed, ErrStopped (or ErrClosed) is returned from then on.
+func (m *MultiListener) Accept() (net.Conn, error) {
+	m.once.Do(func() {
+		for _, w := range m.Listeners {
+			go m.accept(w)
+		}
+	})
+	select {
+	case r := <-m.results:
+		if r.err != nil {
+			m.finish(r.err)
+		}
+		return r.conn, r.err
+	case <-m.done:
+		return nil, m.err
+	}
+}
+
+// finish makes Accept return err from then on, and closes the connections
+// which the other listeners accept in the meantime (such as the dummy
+// connections made to stop them), so that they can still drain.
+func (m *MultiListener) finish(err error) {
+	m.doneOnce.Do(func() {
+		m.err = err
+		close(m.done)
+	})
+	m.drain()
+}
+
+// drain closes the connections waiting in m.results.
+func (m *MultiListener) drain() {
+	for {
+		select {
+		case r := <-m.results:
+			if r.conn != nil {
+				r.conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// accept passes the connections of w to Accept until it is stopped or
+// closed.
+func (m *MultiListener) accept(w *WaitListener) {
+	var delay time.Duration
+	for {
+		conn, err := w.Accept()
+		if err != nil && err != ErrStopped && err != ErrClosed {
+			delay = acceptBackoff(delay)
+			Warning.Printf("Accept on %s failed (retrying in %s): %s", w.Addr(), delay, err)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-m.done:
+				return
+			}
+		}
+		delay = 0
+		if err != nil {
+			// The results may be full of connections nobody will Accept.
+			select {
+			case m.results <- acceptResult{nil, err}:
+			case <-m.done:
+			}
+			return
+		}
+		select {
+		case m.results <- acceptResult{conn, nil}:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+		select {
+		case <-m.done:
+			// Sent after finish drained the results.
+			m.drain()
+			return
+		default:
+		}
+	}
+}
+
+// Close closes all of the listeners, returning the first error.
+func (m *MultiListener) Close() error {
+	m.finish(ErrClosed)
+	var err error
+	for _, w := range m.Listeners {
+		if cerr := w.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (m *MultiListener) Addr() net.Addr {
+	return m.Listeners[0].Addr()
+}
+
+// listenMulti binds each of the flag's addresses, and returns them merged
+// into a MultiListener.
+func (l *listenFlag) listenMulti() (net.Listener, error) {
+	if l.multi != nil {
+		return l.multi, nil
+	}
+	var ws []*WaitListener
+	for _, lf := range l.all() {
+		lis, err := lf.listen()
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, lis.(*WaitListener))
+	}
+	l.multi = newMultiListener(ws)
+	return l.multi, nil
+}
+
+// all returns the flag followed by its siblings, one for each address.
+func (l *listenFlag) all() []*listenFlag {
+	return append([]*listenFlag{l}, l.siblings...)
+}
+
+// setSiblings replaces the siblings of the flag with one for each of addrs,
+// with the flag's current configuration.
+func (l *listenFlag) setSiblings(addrs []string) error {
+	var siblings []*listenFlag
+	for i, addr := range addrs {
+		s := &listenFlag{
+			flag:   fmt.Sprintf("%s#%d", l.flag, i+1),
+			proto:  l.proto,
+			mode:   "tcp",
+			config: l.config,
+			base:   l.base,
+			daemon: l.daemon,
+			net:    l.net,
+		}
+		s.config.name = fmt.Sprintf("%s#%d", l.config.name, i+1)
+		if err := s.setAddr(addr); err != nil {
+			return err
+		}
+		siblings = append(siblings, s)
+	}
+	l.siblings, l.multi = siblings, nil
+	for _, lf := range l.all() {
+		lf.family = len(siblings) > 0
+	}
+	return nil
+}
+
+// siblingAddrs returns the addresses of the flag's siblings.
+func (l *listenFlag) siblingAddrs() []string {
+	var addrs []string
+	for _, s := range l.siblings {
+		addrs = append(addrs, s.configured())
+	}
+	return addrs
+}
+
+// network returns the network on which to bind the flag's address.  When a
+// flag has several addresses, an IP address binds only its own family, so
+// that 0.0.0.0:80 and [::]:80 can be given together.
+func (l *listenFlag) network() string {
+	if !l.family || l.net != "tcp" || l.laddr == nil || l.laddr.IP == nil {
+		return l.net
+	}
+	if l.laddr.IP.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// disjoint returns true if l and other bind different address families, so
+// that their addresses cannot overlap.
+func (l *listenFlag) disjoint(other *listenFlag) bool {
+	a, b := l.network(), other.network()
+	return a != b && (a == "tcp4" || a == "tcp6") && (b == "tcp4" || b == "tcp6")
+}
+
+// handoffAddr returns the flag value with which to pass the flag's listeners
+// in fds on to a child: their descriptors, or their addresses if they were
+// bound with ReusePort.  It returns false if any of them can't be passed on.
+func (l *listenFlag) handoffAddr(fds map[*listenFlag]int) (string, bool) {
+	var parts []string
+	for _, lf := range l.all() {
+		if fd, ok := fds[lf]; ok {
+			parts = append(parts, fmt.Sprintf("&%d", fd))
+		} else if lf.listener != nil && lf.listener.reused {
+			parts = append(parts, lf.listener.Addr().String())
+		} else {
+			return "", false
+		}
+	}
+	return strings.Join(parts, ","), true
+}
+
+// withSiblings returns ls with the siblings of each ListenFlag following it.
+func withSiblings(ls []Listenable) []Listenable {
+	var all []Listenable
+	for _, l := range ls {
+		all = append(all, l)
+		if lf, ok := l.(*listenFlag); ok {
+			for _, s := range lf.siblings {
+				all = append(all, s)
+			}
+		}
+	}
+	return all
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// A ListenOption configures the listener created by a Listenable.
+type ListenOption func(*listenConfig)
+
+// listenConfig holds the options for a single listener.
+type listenConfig struct {
+	name             string
+	tls              *tls.Config
+	handshakeTimeout time.Duration
+	admit            AdmissionFunc
+	serve            Handler
+	untracked        bool
+	logSample        uint64
+	shards           int
+	shardQueue       int
+	access           *accessLog
+	perIP            *ipLimit
+	overload         Overload
+	idle             IdleFunc
+	reusePort        bool
+	tap              *tap
+	keyLog           *keyLog // until it is opened
+	addr             string  // for NewListener
+	maxConns         int
+	maxConnsBlock    bool
+	acceptRate       float64
+	acceptBurst      int
+	highWater        []highWaterMark
+	goodbye          func(net.Conn)
+	accounting       bool
+	keyPair          *keyPairFiles // for TLSListenFlag
+	clientCAs        *clientCAs    // until they are loaded
+	sharePort        bool
+	reap             *reapLimits
+	proxy            *proxyProtocol
+}
+
+// Name sets the name of the listener, which is used in its metrics.  It
+// defaults to the flag name for a ListenFlag, and the address otherwise.
+func Name(name string) ListenOption {
+	return func(c *listenConfig) {
+		c.name = name
+	}
+}
+
+// DefaultHandshakeTimeout is the handshake timeout for TLS listeners which
+// do not specify one with HandshakeTimeout.
+var DefaultHandshakeTimeout = 10 * time.Second
+
+// TLS causes the listener to perform a TLS handshake, using the given
+// config, on each connection before it is returned from Accept.  The
+// underlying TCP socket is still passed on by Restart.
+func TLS(config *tls.Config) ListenOption {
+	return func(c *listenConfig) {
+		c.tls = config
+	}
+}
+
+// HandshakeTimeout sets the time allowed for a TLS handshake to complete
+// before the connection is closed.
+func HandshakeTimeout(d time.Duration) ListenOption {
+	return func(c *listenConfig) {
+		c.handshakeTimeout = d
+	}
+}
+
+// An AdmissionFunc decides whether an accepted connection should be handed to
+// the application.  Returning a non-nil error rejects the connection, which is
+// closed immediately.  The connection's Meta store is available, so admission
+// can be based on information recorded by earlier middleware.
+type AdmissionFunc func(conn net.Conn) error
+
+// Admission sets the function which is evaluated for every connection right
+// after it is accepted, before it is returned from Accept (and, for TLS
+// listeners, before the handshake).  This is the integration point for custom
+// authorization, geo-blocking, or load shedding policies.
+func Admission(fn AdmissionFunc) ListenOption {
+	return func(c *listenConfig) {
+		c.admit = fn
+	}
+}
+
+// ServeWith causes the listener to be served by h (see Serve) as soon as it
+// is listening, so that the application doesn't have to start the accept
+// loop itself.
+func ServeWith(h Handler) ListenOption {
+	return func(c *listenConfig) {
+		c.serve = h
+	}
+}
+
+// Untracked causes the listener to count its connections instead of
+// tracking each of them, which saves an allocation and a lock per connection
+// on listeners which accept at very high rates.  Wait works as usual, but the
+// connections are not returned by Conns, so they cannot be evicted or
+// abandoned, and they have no Meta store.
+func Untracked() ListenOption {
+	return func(c *listenConfig) {
+		c.untracked = true
+	}
+}
+
+// LogSample causes only one in every n connections accepted by the listener
+// to be logged (at Verbose) when it is accepted and closed, overriding
+// SetConnLogSample.  Sampled records include the rate, so that counts can be
+// scaled back up.  It can be changed later with WaitListener.SetLogSample.
+func LogSample(n int) ListenOption {
+	return func(c *listenConfig) {
+		if n > 0 {
+			c.logSample = uint64(n)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// An Overload policy decides what happens to a connection which exceeds a
+// limit of the listener, such as its PerIPLimit, or which is rejected by its
+// AdmissionFunc.  Rejected connections are counted by Rejected and in the
+// daemon_connections_rejected_total metric, and those which the policy
+// disposes of, rather than admitting after all, in the
+// daemon_connections_shed_total metric, labelled by Name.
+type Overload interface {
+	// Name identifies the policy in metrics.
+	Name() string
+
+	// Shed disposes of conn, which was rejected for the given reason.  The
+	// policy may call retry to check the limit again; if it returns true,
+	// the connection has been admitted after all, and Shed must return true
+	// without closing it.  Otherwise, Shed must close conn (perhaps later,
+	// from another goroutine) and return false.
+	Shed(conn net.Conn, reason error, retry func() bool) (admitted bool)
+}
+
+// OverloadPolicy sets the policy which sheds connections rejected by the
+// listener's limits.  By default, they are simply closed.
+func OverloadPolicy(p Overload) ListenOption {
+	return func(c *listenConfig) {
+		c.overload = p
+	}
+}
+
+// How long ShedBanner waits to write its banner.
+const bannerTimeout = time.Second
+
+// How often ShedQueue checks whether a queued connection can be admitted.
+const queuePoll = 10 * time.Millisecond
+
+// ShedReset resets rejected connections instead of closing them normally, so
+// that the client gets an error immediately and the daemon keeps no state
+// (such as TIME_WAIT) for them.
+var ShedReset Overload = resetOverload{}
+
+// ShedBanner writes banner to rejected connections before closing them, so
+// that clients of line-oriented protocols can tell why they were turned
+// away.
+func ShedBanner(banner string) Overload {
+	return bannerOverload(banner)
+}
+
+// ShedQueue holds rejected connections for up to timeout, admitting them if
+// the limit allows it in the meantime, and then sheds them with then (or
+// closes them, if then is nil).  While a connection is held, the listener
+// accepts no other connections (they wait in the kernel's backlog), so this is
+// best suited to limits which affect every client, or to listeners with
+// AcceptShards.  Held connections are shed at once when the listener is
+// stopped, so that they do not delay draining.
+func ShedQueue(timeout time.Duration, then Overload) Overload {
+	if then == nil {
+		then = closeOverload{}
+	}
+	return queueOverload{timeout, then}
+}
+
+// TarpitMax is the most connections ShedTarpit holds at once; beyond it,
+// rejected connections are reset instead.
+var TarpitMax = 1000
+
+// ShedTarpit holds rejected TCP connections open for hold, without reading
+// from them and with the smallest receive window the system allows, before
+// closing them.  This slows down scanners and brute-force clients, which
+// would otherwise simply reconnect after a reset.  Each held connection costs
+// a descriptor and a goroutine, so at most TarpitMax are held; they are also
+// released as soon as the daemon starts draining, so that they do not delay a
+// Restart or Shutdown.
+func ShedTarpit(hold time.Duration) Overload {
+	return &tarpitOverload{hold: hold}
+}
+
+type tarpitOverload struct {
+	hold time.Duration
+	held int32 // atomic
+}
+
+func (*tarpitOverload) Name() string { return "tarpit" }
+
+func (t *tarpitOverload) Shed(conn net.Conn, _ error, _ func() bool) bool {
+	if atomic.AddInt32(&t.held, 1) > int32(TarpitMax) {
+		atomic.AddInt32(&t.held, -1)
+		resetConn(conn)
+		return false
+	}
+	if tcp, ok := underlying(conn).(*net.TCPConn); ok {
+		clampWindow(tcp) // provided in OS-specific files
+	}
+	go func() {
+		defer atomic.AddInt32(&t.held, -1)
+		timer := time.NewTimer(t.hold)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-Lamed:
+		}
+		conn.Close()
+	}()
+	return false
+}
+
+type closeOverload struct{}
+
+func (closeOverload) Name() string { return "close" }
+
+func (closeOverload) Shed(conn net.Conn, _ error, _ func() bool) bool {
+	conn.Close()
+	return false
+}
+
+type resetOverload struct{}
+
+func (resetOverload) Name() string { return "reset" }
+
+func (resetOverload) Shed(conn net.Conn, _ error, _ func() bool) bool {
+	resetConn(conn)
+	return false
+}
+
+type bannerOverload string
+
+func (bannerOverload) Name() string { return "banner" }
+
+func (b bannerOverload) Shed(conn net.Conn, _ error, _ func() bool) bool {
+	conn.SetWriteDeadline(time.Now().Add(bannerTimeout))
+	conn.Write([]byte(b))
+	conn.Close()
+	return false
+}
+
+type queueOverload struct {
+	timeout time.Duration
+	then    Overload
+}
+
+func (queueOverload) Name() string { return "queue" }
+
+func (q queueOverload) Shed(conn net.Conn, reason error, retry func() bool) bool {
+	return q.queue(conn, reason, retry, nil)
+}
+
+// queue is Shed, which stops holding the connection once stop is closed.
+func (q queueOverload) queue(conn net.Conn, reason error, retry func() bool, stop <-chan bool) bool {
+	timeout := time.NewTimer(q.timeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(queuePoll)
+	defer poll.Stop()
+wait:
+	for {
+		select {
+		case <-poll.C:
+			if retry() {
+				return true
+			}
+		case <-timeout.C:
+			break wait
+		case <-stop:
+			break wait
+		}
+	}
+	return q.then.Shed(conn, reason, func() bool { return false })
+}
+
+// underlying unwraps conn via its NetConn methods.
+func underlying(conn net.Conn) net.Conn {
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = wrapper.NetConn()
+	}
+}
+
+// resetConn closes conn, resetting it if it is a TCP connection.
+func resetConn(conn net.Conn) {
+	if tcp, ok := underlying(conn).(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// shed passes a rejected connection to the listener's Overload policy,
+// returning whether it was admitted after all.
+func (w *WaitListener) shed(conn net.Conn, reason error, retry func() bool) bool {
+	atomic.AddUint64(&w.rejected, 1)
+	w.metrics.rejected.Add(1)
+	select {
+	case <-w.stop:
+		// Don't hold up Stop by queueing.
+		retry = func() bool { return false }
+	default:
+	}
+	var admitted bool
+	if q, ok := w.overload().(queueOverload); ok {
+		admitted = q.queue(conn, reason, retry, w.stop)
+	} else {
+		admitted = w.overload().Shed(conn, reason, retry)
+	}
+	if admitted {
+		return true
+	}
+	w.metrics.shed.Add(1)
+	Verbose.Printf("Rejected connection: (local) %s <- %s (remote): %s",
+		conn.LocalAddr(), conn.RemoteAddr(), reason)
+	return false
+}
+
+// overload returns the listener's Overload policy.
+func (w *WaitListener) overload() Overload {
+	if w.config.overload == nil {
+		return closeOverload{}
+	}
+	return w.config.overload
+}
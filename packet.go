@@ -0,0 +1,294 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxPacketSize is the size of the buffer into which WaitPacketConn.Serve
+// reads each packet; longer packets are truncated.
+var MaxPacketSize = 65535
+
+// A PacketHandler serves a single packet read from a packet socket.  It may
+// reply with pc.WriteTo.  The packet belongs to the handler.
+type PacketHandler interface {
+	ServePacket(pc net.PacketConn, from net.Addr, packet []byte)
+}
+
+// A PacketHandlerFunc is an ordinary function which serves a packet.
+type PacketHandlerFunc func(pc net.PacketConn, from net.Addr, packet []byte)
+
+// ServePacket calls f(pc, from, packet).
+func (f PacketHandlerFunc) ServePacket(pc net.PacketConn, from net.Addr, packet []byte) {
+	f(pc, from, packet)
+}
+
+// A WaitPacketConn is a packet socket created by a PacketFlag, which tracks
+// the packets being served by Serve so that a Restart or Shutdown can wait
+// for their handlers.  When the daemon stops, the socket stops reading
+// (reads return a timeout error) but stays open, so that the handlers can
+// still reply, until they have finished or the drain timeout passes.
+type WaitPacketConn struct {
+	net.PacketConn
+	flag string
+
+	lock    sync.Mutex
+	idle    *sync.Cond // signalled when active drops to 0
+	active  int
+	stopped bool
+}
+
+func newWaitPacketConn(pc net.PacketConn, name string) *WaitPacketConn {
+	w := &WaitPacketConn{PacketConn: pc, flag: name}
+	w.idle = sync.NewCond(&w.lock)
+	return w
+}
+
+// Serve reads packets from the socket and serves each of them with h in its
+// own goroutine.  If a handler panics, the panic is logged without bringing
+// down the process.  Serve returns nil once the socket is stopped (for
+// instance by Restart or Shutdown), or the first other read error.
+func (w *WaitPacketConn) Serve(h PacketHandler) error {
+	for {
+		buf := make([]byte, MaxPacketSize)
+		n, from, err := w.ReadFrom(buf)
+		if err != nil {
+			if w.isStopped() {
+				return nil
+			}
+			return err
+		}
+		w.lock.Lock()
+		w.active++
+		w.lock.Unlock()
+		go w.serve(h, from, buf[:n])
+	}
+}
+
+func (w *WaitPacketConn) serve(h PacketHandler, from net.Addr, packet []byte) {
+	defer func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		if w.active--; w.active == 0 {
+			w.idle.Broadcast()
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			Error.Printf("Packet handler for --%s panicked serving %s: %v\n%s", w.flag, from, r, stack())
+		}
+	}()
+	h.ServePacket(w, from, packet)
+}
+
+// Active returns the number of packets being served.
+func (w *WaitPacketConn) Active() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.active
+}
+
+// Stop stops the socket from reading any more packets, without closing it.
+func (w *WaitPacketConn) Stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.stopped {
+		return
+	}
+	w.stopped = true
+	w.SetReadDeadline(time.Unix(1, 0))
+	Verbose.Printf("Stopping packet socket: %s", w.LocalAddr())
+}
+
+func (w *WaitPacketConn) isStopped() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.stopped
+}
+
+// Wait waits for all of the packets being served to finish.
+func (w *WaitPacketConn) Wait() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for w.active > 0 {
+		w.idle.Wait()
+	}
+}
+
+// Dup duplicates the socket's underlying file descriptor, to pass it on to a
+// restarted version of this process.  The returned error, if any, is a
+// LifecycleError with code DupFailed.
+func (w *WaitPacketConn) Dup() (*os.File, error) {
+	filer, ok := w.PacketConn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, &LifecycleError{DupFailed, "dup", w.flag, fmt.Errorf("unknown packet socket type: %T", w.PacketConn)}
+	}
+	f, err := filer.File()
+	if err != nil {
+		return nil, &LifecycleError{DupFailed, "dup", w.flag, err}
+	}
+	return f, nil
+}
+
+// A PacketListenable is a Listenable for a packet socket.  Its Listen binds
+// the socket (or adopts it) and returns a nil listener; ListenPacket returns
+// the socket itself.
+type PacketListenable interface {
+	Listenable
+	ListenPacket() (*WaitPacketConn, error)
+}
+
+type packetFlag struct {
+	flag, proto string
+	net, addr   string
+	mode        string // "fd", "packet"
+	fd          int
+	conn        *WaitPacketConn
+}
+
+func (p *packetFlag) String() string {
+	if p.mode == "fd" {
+		return fmt.Sprintf("&%d", p.fd)
+	}
+	return p.addr
+}
+
+func (p *packetFlag) Set(s string) error {
+	if len(s) == 0 {
+		return fmt.Errorf("--%s requires an argument", p.flag)
+	}
+	if s[0] == '&' {
+		fd, err := strconv.Atoi(s[1:])
+		if err != nil {
+			return fmt.Errorf("failed to parse &fd: %s", err)
+		}
+		p.mode, p.fd = "fd", fd
+		return nil
+	}
+	p.mode, p.addr = "packet", s
+	return nil
+}
+
+// Listen binds the socket, if it is not bound yet.  Since there is no
+// net.Listener for a packet socket, it returns nil and any error.
+func (p *packetFlag) Listen() (net.Listener, error) {
+	_, err := p.ListenPacket()
+	return nil, err
+}
+
+func (p *packetFlag) ListenPacket() (*WaitPacketConn, error) {
+	if p.conn != nil {
+		return p.conn, nil
+	}
+	if fd, ok := inheritedFDs[p.flag]; ok {
+		// Passed by Restart, whatever the flag says
+		p.mode, p.fd = "fd", fd
+		delete(inheritedFDs, p.flag)
+	} else if fd, ok := systemdFD(p.flag); ok && p.mode != "fd" {
+		Verbose.Printf("Using fd %d from systemd for --%s", fd, p.flag)
+		p.mode, p.fd = "fd", fd
+	}
+
+	var (
+		pc  net.PacketConn
+		err error
+	)
+	if p.mode == "fd" {
+		f := os.NewFile(uintptr(p.fd), fmt.Sprintf("&%d", p.fd))
+		pc, err = net.FilePacketConn(f)
+		f.Close() // FilePacketConn dups the fd
+		if err != nil {
+			Error.Printf("Inherited fd %d for --%s is unusable (was it renumbered?): %s", p.fd, p.flag, err)
+			return nil, &LifecycleError{HandoffRejected, "adopt", p.flag, err}
+		}
+	} else if pc, err = net.ListenPacket(p.net, p.addr); err != nil {
+		return nil, &LifecycleError{BindFailed, "listen", p.flag, err}
+	}
+	Verbose.Printf("Listening for %s packets on: %s (from %s)", p.proto, pc.LocalAddr(), p.mode)
+	p.conn = newWaitPacketConn(pc, p.flag)
+	return p.conn, nil
+}
+
+// PacketFlag registers a flag, which, when set, causes the returned
+// PacketListenable to bind a packet socket (such as "udp") on the provided
+// address, or addr if the flag is not provided.  The given proto is used to
+// create the help text.  Like a ListenFlag, the flag may be set to "&fd" or
+// adopt a socket from systemd, and the socket is passed on by Restart: this
+// process stops reading from it, serves the packets it has already read, and
+// closes it once their handlers have finished (see WaitPacketConn).
+func PacketFlag(name, netw, addr, proto string) PacketListenable {
+	p := &packetFlag{
+		flag:  name,
+		proto: proto,
+		net:   netw,
+		addr:  addr,
+		mode:  "packet",
+	}
+	flag.Var(p, name, fmt.Sprintf("Address on which to receive %s packets", proto))
+	Register(p)
+	return p
+}
+
+// activePackets returns the WaitPacketConns of the registered PacketFlags
+// which are bound.
+func activePackets() []*WaitPacketConn {
+	var ws []*WaitPacketConn
+	for _, l := range registered() {
+		if p, ok := l.(*packetFlag); ok && p.conn != nil {
+			ws = append(ws, p.conn)
+		}
+	}
+	return ws
+}
+
+// stopPackets stops every bound packet socket and returns them.
+func stopPackets() []*WaitPacketConn {
+	ws := activePackets()
+	for _, w := range ws {
+		w.Stop()
+	}
+	return ws
+}
+
+// drainPackets waits for the packets being served by the sockets to finish,
+// for up to timeout, and then closes the sockets.  It returns a
+// LifecycleError with code DrainTimeout if they do not finish in time.
+func drainPackets(ws []*WaitPacketConn, timeout time.Duration) error {
+	defer func() {
+		for _, w := range ws {
+			w.Close()
+		}
+	}()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for _, w := range ws {
+			w.Wait()
+		}
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return &LifecycleError{DrainTimeout, "drain", "packets", ErrTimeout}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Panic describes a panic recovered from a connection handler by Serve.
+type Panic struct {
+	Time  time.Time
+	Value interface{} // The value passed to panic
+	Site  string      // Where the panic happened, such as "main.handle (server.go:42)"
+	Stack string      // Stack of the handler, from the panic up to Serve
+
+	Listener string    // Name of the listener, if accepted from a WaitListener
+	Remote   string    // Remote address of the connection
+	Local    string    // Local address of the connection
+	Meta     *ConnMeta // Metadata of the connection (see Meta), or nil
+}
+
+// A PanicSite counts the panics recovered at a single Site.
+type PanicSite struct {
+	Site  string
+	Count int
+	Last  Panic // The most recent panic at the site
+}
+
+var (
+	panicLock  sync.Mutex
+	panicHooks []func(Panic)
+	panicSites = map[string]*PanicSite{}
+)
+
+// OnPanic registers a function which is called with each panic recovered by
+// Serve, after it has been logged.  Callbacks are invoked synchronously, on
+// the goroutine of the handler which panicked.
+func OnPanic(fn func(Panic)) {
+	panicLock.Lock()
+	defer panicLock.Unlock()
+	panicHooks = append(panicHooks, fn)
+}
+
+// PanicSites returns the sites at which handlers have panicked, most
+// frequent first.
+func PanicSites() []PanicSite {
+	panicLock.Lock()
+	defer panicLock.Unlock()
+	var sites []PanicSite
+	for _, s := range panicSites {
+		sites = append(sites, *s)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].Count != sites[j].Count {
+			return sites[i].Count > sites[j].Count
+		}
+		return sites[i].Site < sites[j].Site
+	})
+	return sites
+}
+
+// recovered records, logs and reports a panic recovered while serving conn.
+// It must be called directly by the deferred function which recovered it.
+func recovered(conn net.Conn, value interface{}) {
+	p := Panic{
+		Time:   now(),
+		Value:  value,
+		Remote: conn.RemoteAddr().String(),
+		Local:  conn.LocalAddr().String(),
+		Meta:   Meta(conn),
+	}
+	if w := connListener(conn); w != nil {
+		p.Listener = w.name()
+	}
+	p.Site, p.Stack = panicStack()
+
+	metrics.Counter(metricPanics, "Connection handlers which panicked").Add(1)
+	metrics.Counter(metricPanicSites, "Connection handlers which panicked, by site", "site", p.Site).Add(1)
+	Error.Printf("Panic serving %s at %s: %v\n%s", p.Remote, p.Site, p.Value, p.Stack)
+
+	panicLock.Lock()
+	s, ok := panicSites[p.Site]
+	if !ok {
+		s = &PanicSite{Site: p.Site}
+		panicSites[p.Site] = s
+	}
+	s.Count++
+	s.Last = p
+	hooks := panicHooks
+	panicLock.Unlock()
+	for _, fn := range hooks {
+		fn(p)
+	}
+}
+
+// panicStack returns the site of the panic in progress on this goroutine and
+// its stack, trimmed to the frames between the panic and serveConn.
+func panicStack() (site, stack string) {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(1, pcs)])
+
+	var buf strings.Builder
+	panicking := false
+	for {
+		f, more := frames.Next()
+		switch {
+		case f.Function == "runtime.gopanic":
+			panicking = true
+		case !panicking:
+		case strings.HasSuffix(f.Function, ".serveConn"):
+			more = false
+		case site == "" && strings.HasPrefix(f.Function, "runtime."):
+			// Panics raised by the runtime (nil dereferences, index errors
+			// and so on) pass through a few of its frames first.
+		default:
+			if site == "" {
+				site = fmt.Sprintf("%s (%s:%d)", f.Function, filepath.Base(f.File), f.Line)
+			}
+			fmt.Fprintf(&buf, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	if site == "" {
+		site = "unknown"
+	}
+	return site, buf.String()
+}
+
+// connListener returns the WaitListener from which conn was accepted, if
+// any, unwrapping it as Meta does.
+func connListener(conn net.Conn) *WaitListener {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *waitConn:
+			return c.listener
+		case *countedConn:
+			return c.listener
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil
+}
+
+// panicsCommand implements the panics control command.
+func panicsCommand(w io.Writer, args []string) error {
+	sites := PanicSites()
+	if len(sites) == 0 {
+		fmt.Fprintf(w, "no panics\n")
+	}
+	for _, s := range sites {
+		fmt.Fprintf(w, "%d %s, last %s from %s: %v\n", s.Count, s.Site,
+			s.Last.Time.Format(time.RFC3339), s.Last.Remote, s.Last.Value)
+	}
+	return nil
+}
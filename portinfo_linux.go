@@ -0,0 +1,109 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tcpListen is the socket state of a listening socket in /proc/net/tcp.
+const tcpListen = "0A"
+
+// portHolders returns a description of the processes which hold a listening
+// TCP socket on the given port, as "pid N (name)".  Only processes whose /proc
+// entries are readable by this process can be found.
+func portHolders(port int) []string {
+	inodes := map[string]bool{}
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // skip the header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || fields[3] != tcpListen {
+				continue
+			}
+			colon := strings.LastIndex(fields[1], ":")
+			p, err := strconv.ParseInt(fields[1][colon+1:], 16, 32)
+			if err != nil || int(p) != port {
+				continue
+			}
+			inodes[fmt.Sprintf("socket:[%s]", fields[9])] = true
+		}
+		f.Close()
+	}
+	if len(inodes) == 0 {
+		return nil
+	}
+
+	var holders []string
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	seen := map[string]bool{}
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || !inodes[link] {
+			continue
+		}
+		pid := strings.Split(fd, "/")[2]
+		if seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		comm, _ := ioutil.ReadFile(filepath.Join("/proc", pid, "comm"))
+		holders = append(holders, fmt.Sprintf("pid %s (%s)", pid, strings.TrimSpace(string(comm))))
+	}
+	if len(holders) == 0 {
+		holders = append(holders, "an unknown process")
+	}
+	return holders
+}
+
+// holdsSocket reports whether the process with the given pid has a
+// descriptor for the socket with the given inode.  The second result is false
+// if the process's descriptors could not be read.
+func holdsSocket(pid int, ino uint64) (held, ok bool) {
+	fds, err := filepath.Glob(fmt.Sprintf("/proc/%d/fd/*", pid))
+	if err != nil || len(fds) == 0 {
+		return false, false
+	}
+	want := fmt.Sprintf("socket:[%d]", ino)
+	for _, fd := range fds {
+		if link, _ := os.Readlink(fd); link == want {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// zombie reports whether the process with the given pid has exited but not
+// yet been reaped.
+func zombie(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the command name, which is in parentheses.
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
@@ -16,6 +16,7 @@ package daemon
 
 import (
 	"flag"
+	"sync"
 )
 
 // A Privileges stores the desired privileges of a process
@@ -25,20 +26,53 @@ import (
 // capabilities.
 type Privileges struct {
 	Username string // User to whom to drop privileges
+
+	// Fixup, if set, is called while still privileged, just before
+	// dropping to uid and gid.  It can be used to chown or chmod any
+	// application-specific files (sockets, state directories, etc) which
+	// a restarted child, which starts out unprivileged, will need.
+	Fixup func(uid, gid int) error
 }
 
 // Drop drops to the configured privileges and returns
 // if any dropping was intended.  If dropped privileges
 // (that is, a nonzero Username) were requested but
 // failed, the process aborts for safety reasons.
+//
+// Before dropping, the files opened by this package (the log file, unless
+// LogFileOwnerFlags says otherwise, and the pidfile) are chowned to the
+// target user so that a process started by Restart, which is already
+// unprivileged, can reopen them.  If the process is already running as the
+// target user (as is the case in a restarted child), Drop does nothing beyond
+// verifying the user.
 func (p *Privileges) Drop() (dropped bool) {
 	if p.Username != "" {
-		chuser(p.Username)
+		chuser(p.Username, p.Fixup)
 		dropped = true
 	}
 	return dropped
 }
 
+// dropFiles is the list of files which should be chowned to the
+// unprivileged user when privileges are dropped.
+var (
+	dropFilesLock sync.Mutex
+	dropFiles     []string
+)
+
+// chownOnDrop registers the named file to be chowned when dropping
+// privileges.
+func chownOnDrop(path string) {
+	dropFilesLock.Lock()
+	defer dropFilesLock.Unlock()
+	for _, f := range dropFiles {
+		if f == path {
+			return
+		}
+	}
+	dropFiles = append(dropFiles, path)
+}
+
 // PrivilegesFlag registers a flag which, when set, will cause the returned Privileges
 // object to drop to the given username.  Recommended default value is "nobody".
 func PrivilegesFlag(name, def string) *Privileges {
@@ -17,12 +17,13 @@
 package daemon
 
 import (
+	"os"
 	"os/user"
 	"strconv"
 	"syscall"
 )
 
-func chuser(username string) (uid, gid int) {
+func chuser(username string, fixup func(uid, gid int) error) (uid, gid int) {
 	usr, err := user.Lookup(username)
 	if err != nil {
 		Fatal.Printf("failed to find user %q: %s", username, err)
@@ -38,6 +39,33 @@ func chuser(username string) (uid, gid int) {
 		Fatal.Printf("bad group ID %q: %s", usr.Gid, err)
 	}
 
+	if os.Getuid() == uid && os.Geteuid() == uid {
+		// We've already dropped (probably in a parent before Restart),
+		// so there's nothing left to fix up.
+		Verbose.Printf("Already running as %q (uid=%d)", username, uid)
+		return uid, gid
+	}
+
+	if os.Geteuid() == 0 {
+		chownLogFile(uid, gid)
+
+		dropFilesLock.Lock()
+		files := append([]string(nil), dropFiles...)
+		dropFilesLock.Unlock()
+		for _, f := range files {
+			if err := os.Chown(f, uid, gid); err != nil {
+				Warning.Printf("chown(%q, %d, %d): %s", f, uid, gid, err)
+				continue
+			}
+			Verbose.Printf("Transferred %q to %q", f, username)
+		}
+	}
+	if fixup != nil {
+		if err := fixup(uid, gid); err != nil {
+			Fatal.Printf("privilege fixup for %q failed: %s", username, err)
+		}
+	}
+
 	if err := syscall.Setgid(gid); err != nil {
 		Fatal.Printf("setgid(%d): %s", gid, err)
 	}
@@ -0,0 +1,60 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// A ProbeMode determines how a ProbeFlag responds to connections.
+type ProbeMode int
+
+const (
+	// ProbeEcho echoes back whatever the client sends.
+	ProbeEcho ProbeMode = iota
+
+	// ProbeBanner writes a fixed line of text and closes the connection.
+	ProbeBanner
+
+	// ProbeStatus writes the Status as JSON and closes the connection.
+	ProbeStatus
+)
+
+// ProbeTimeout bounds how long a probe connection may stay open, so that a
+// stuck monitor does not hold up a Restart.
+var ProbeTimeout = 10 * time.Second
+
+// ProbeFlag registers a ListenFlag for a built-in responder, which external
+// monitors can use to verify end-to-end that the daemon is accepting
+// connections even if the application's own protocol is hard to probe.  The
+// banner is only used by ProbeBanner.  The responder is started as soon as
+// the returned Listenable is listening.
+func ProbeFlag(name, addr string, mode ProbeMode, banner string) Listenable {
+	h := HandlerFunc(func(conn net.Conn) {
+		conn.SetDeadline(time.Now().Add(ProbeTimeout))
+		switch mode {
+		case ProbeEcho:
+			io.Copy(conn, conn)
+		case ProbeBanner:
+			fmt.Fprintln(conn, banner)
+		case ProbeStatus:
+			conn.Write(CurrentStatus().JSON())
+		}
+	})
+	return ListenFlag(name, "tcp", addr, "monitoring probes", ServeWith(h))
+}
@@ -0,0 +1,168 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	crand "crypto/rand"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Clock tells the time.
+type Clock interface {
+	Now() time.Time
+}
+
+// A Rand is a source of randomness.  A *rand.Rand from math/rand can be used
+// directly; the package serializes its calls.
+type Rand interface {
+	Int63n(n int64) int64
+	Read(p []byte) (n int, err error)
+}
+
+// Providers are the sources of time, randomness and identity used by the
+// package, which can be replaced (see SetProviders) to make its behavior
+// reproducible, for instance in tests.  Fields which are nil keep their
+// current providers.  The functions must be safe for concurrent use.
+//
+// The Clock gives the times which the package records and reports (in log
+// records, Records, Panics, the access log, taps, connection accounting and
+// Upstream.Resolved), and by which it evaluates the LogSchedule, Reap limits,
+// CRLs and the tokens of AcceptRate and TapRate.  Timeouts and deadlines,
+// including those on connections, always use the system clock, since they are
+// enforced by sleeping or by the kernel, as do Uptime and WarmUp.
+//
+// The Rand chooses the jitter of StartJitter and RestartWindow and the prefix
+// of correlation IDs.  The Hostname and PID are those reported in log records,
+// the names of log and spool files (see LogFileFlag and ShipLogs), Status and
+// the summaries; the real pid is still used where other processes depend on
+// it, such as the pidfile, Restart and the names of dumps, and in the prefix
+// of the text log, which is fixed before init.
+type Providers struct {
+	Clock    Clock                  // Defaults to the system clock
+	Rand     Rand                   // Defaults to a randomly seeded source
+	Hostname func() (string, error) // Defaults to os.Hostname
+	PID      func() int             // Defaults to os.Getpid
+}
+
+// providerSet is what SetProviders publishes: the Providers, with every
+// field set, and what is derived from them.
+type providerSet struct {
+	Providers
+	correlationPrefix string // see NewCorrelationID
+	host              string // reported in structured log records
+}
+
+var (
+	providerLock sync.Mutex // held by SetProviders
+	randLock     sync.Mutex // serializes calls to the Rand
+
+	// published holds the current *providerSet, which is replaced (never
+	// modified) by SetProviders, so that it can be read without locking.
+	published = func() *atomic.Value {
+		v := new(atomic.Value)
+		v.Store(newProviderSet(Providers{
+			Clock:    systemClock{},
+			Rand:     defaultRand{rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())))},
+			Hostname: os.Hostname,
+			PID:      os.Getpid,
+		}))
+		return v
+	}()
+)
+
+func newProviderSet(p Providers) *providerSet {
+	host, _ := p.Hostname()
+	return &providerSet{
+		Providers:         p,
+		correlationPrefix: newCorrelationPrefix(p.Rand),
+		host:              host,
+	}
+}
+
+// currentProviders returns the providers in use.
+func currentProviders() *providerSet {
+	return published.Load().(*providerSet)
+}
+
+// SetProviders replaces the package's providers of time, randomness and
+// identity with those which are set in p.  The providers belong to the
+// process, and are shared by every Daemon.  It is safe to call while the
+// package is in use, but times and IDs from before and after the call may not
+// be consistent with each other, so like SetMetrics, it is best called before
+// any listeners are created.
+func SetProviders(p Providers) {
+	providerLock.Lock()
+	defer providerLock.Unlock()
+	next := currentProviders().Providers
+	if p.Clock != nil {
+		next.Clock = p.Clock
+	}
+	if p.Rand != nil {
+		next.Rand = p.Rand
+	}
+	if p.Hostname != nil {
+		next.Hostname = p.Hostname
+	}
+	if p.PID != nil {
+		next.PID = p.PID
+	}
+	published.Store(newProviderSet(next))
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// defaultRand reads random bytes from crypto/rand, so that the default
+// correlation IDs are unpredictable.
+type defaultRand struct {
+	*rand.Rand
+}
+
+func (defaultRand) Read(p []byte) (int, error) { return crand.Read(p) }
+
+// now returns the time according to the Clock.
+func now() time.Time {
+	return currentProviders().Clock.Now()
+}
+
+// since returns the time elapsed since t according to the Clock.
+func since(t time.Time) time.Duration {
+	return now().Sub(t)
+}
+
+// randInt63n returns a random number in [0, n) from the Rand.
+func randInt63n(n int64) int64 {
+	r := currentProviders().Rand
+	randLock.Lock()
+	defer randLock.Unlock()
+	return r.Int63n(n)
+}
+
+// hostname returns the host name from the Hostname provider, or "" if it
+// fails.
+func hostname() string {
+	host, _ := currentProviders().Hostname()
+	return host
+}
+
+// pid returns the process ID to report.
+func pid() int {
+	return currentProviders().PID()
+}
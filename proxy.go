@@ -0,0 +1,327 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyHeaderTimeout bounds how long a listener with ProxyProtocol waits for
+// the PROXY header at the start of each connection.
+var ProxyHeaderTimeout = time.Second
+
+// ProxyProtocol causes the listener to read a PROXY protocol header (version
+// 1 or 2, as sent by HAProxy and most load balancers) at the start of each
+// connection, so that its RemoteAddr and LocalAddr, and so the logs,
+// PerIPLimit, Evict and AccessLog, are those of the client instead of the
+// proxy.  If trusted networks are given (see ParseCIDR), only connections
+// from them must send a header, and connections from elsewhere are used as
+// they are; otherwise every connection must send one.  A connection whose
+// header is missing or malformed is closed.
+//
+// Headers are read in their own goroutines, for up to ProxyHeaderTimeout, so
+// that clients which are slow to send them do not hold up the accept loop.  A
+// header for an unknown (or LOCAL, such as a health check) connection leaves
+// its addresses unchanged.
+func ProxyProtocol(trusted ...*net.IPNet) ListenOption {
+	return func(c *listenConfig) {
+		c.proxy = &proxyProtocol{trusted: trusted}
+	}
+}
+
+// proxyProtocol is the configuration of ProxyProtocol.
+type proxyProtocol struct {
+	trusted []*net.IPNet
+}
+
+// required returns true if conn must send a PROXY header.
+func (p *proxyProtocol) required(conn net.Conn) bool {
+	ip := remoteIP(conn)
+	if len(p.trusted) == 0 || ip == nil {
+		return true
+	}
+	for _, network := range p.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxyNets parses the networks of the "proxy" spec key, which are
+// separated by "+".
+func parseProxyNets(val string) (ListenOption, error) {
+	var trusted []*net.IPNet
+	if val != "" {
+		for _, s := range strings.Split(val, "+") {
+			network, err := ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			trusted = append(trusted, network)
+		}
+	}
+	return ProxyProtocol(trusted...), nil
+}
+
+// proxyState holds the state of a WaitListener with ProxyProtocol.
+type proxyState struct {
+	start    sync.Once
+	accepted chan acceptResult
+	done     chan bool // closed, after err is set, when the listener fails
+	err      error
+}
+
+// A proxyConn is a connection whose addresses were given by a PROXY header.
+type proxyConn struct {
+	net.Conn
+	r             *bufio.Reader // read beyond the header, until drained
+	remote, local net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.r != nil {
+		if c.r.Buffered() > 0 {
+			return c.r.Read(b)
+		}
+		c.r = nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr  { return c.local }
+
+// NetConn returns the connection from the proxy.
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// acceptProxied accepts the next connection from the underlying listener,
+// with its PROXY header read if the listener has ProxyProtocol.  Headers are
+// read in their own goroutines, and connections with bad headers are closed.
+func (w *WaitListener) acceptProxied() (net.Conn, error) {
+	if w.proxy == nil {
+		return w.Listener.Accept()
+	}
+	w.proxy.start.Do(func() {
+		w.proxy.accepted = make(chan acceptResult)
+		w.proxy.done = make(chan bool)
+		go w.proxyLoop()
+	})
+	select {
+	case res := <-w.proxy.accepted:
+		return res.conn, res.err
+	case <-w.proxy.done:
+		return nil, w.proxy.err
+	case <-w.stop:
+		return nil, ErrStopped
+	}
+}
+
+func (w *WaitListener) proxyLoop() {
+	for {
+		conn, err := w.Listener.Accept()
+		select {
+		case <-w.stop:
+			// Probably the noop connection from Stop
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		default:
+		}
+		if err != nil {
+			if acceptErrorClass(err) == "closed" {
+				w.proxy.err = err
+				close(w.proxy.done)
+				return
+			}
+			select {
+			case w.proxy.accepted <- acceptResult{nil, err}:
+			case <-w.stop:
+				return
+			}
+			continue
+		}
+		if !w.config.proxy.required(conn) {
+			go w.deliverProxied(conn)
+			continue
+		}
+		go w.readProxied(conn)
+	}
+}
+
+// readProxied reads the PROXY header of conn and passes it on to
+// acceptProxied.
+func (w *WaitListener) readProxied(conn net.Conn) {
+	pconn, err := readProxyHeader(conn)
+	if err != nil {
+		select {
+		case <-w.stop:
+		default:
+			metrics.Counter(metricProxyFailed, "PROXY headers which were missing or malformed", "listener", w.name()).Add(1)
+			Verbose.Printf("Bad PROXY header from %s: %s", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+	w.deliverProxied(pconn)
+}
+
+// deliverProxied passes conn on to acceptProxied, closing it if the listener
+// is stopped first.
+func (w *WaitListener) deliverProxied(conn net.Conn) {
+	select {
+	case w.proxy.accepted <- acceptResult{conn, nil}:
+	case <-w.stop:
+		conn.Close()
+	}
+}
+
+// proxyV1Prefix starts a version 1 PROXY header, and proxyV2Sig is the
+// signature which starts a version 2 one.
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// readProxyHeader reads the PROXY header from the start of conn, returning
+// the connection with the addresses it gives.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	pc := &proxyConn{Conn: conn, r: r, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	// Only peek as far as the shortest header could go, so that a header
+	// is never waiting on bytes the client will not send before the server
+	// speaks.
+	start, err := r.Peek(len(proxyV1Prefix))
+	switch {
+	case err != nil:
+		return nil, err
+	case bytes.Equal(start, proxyV1Prefix):
+		err = pc.readV1()
+	case bytes.Equal(start, proxyV2Sig[:len(start)]):
+		err = pc.readV2()
+	default:
+		err = errors.New("no PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 reads a version 1 (text) header, such as
+//
+//	PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n
+func (c *proxyConn) readV1() error {
+	line, err := c.r.ReadSlice('\n')
+	switch {
+	case err == bufio.ErrBufferFull || len(line) > 107:
+		return errors.New("v1 header too long")
+	case err != nil:
+		return err
+	case !bytes.HasSuffix(line, []byte("\r\n")):
+		return errors.New("v1 header does not end with CRLF")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	src, err := proxyAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := proxyAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+func proxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("bad address %q in v1 header", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port %q in v1 header", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 reads a version 2 (binary) header.
+func (c *proxyConn) readV2() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:len(proxyV2Sig)], proxyV2Sig) {
+		return errors.New("no PROXY header")
+	}
+	if v := hdr[12] >> 4; v != 2 {
+		return fmt.Errorf("unknown version %d", v)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+
+	command, family, transport := hdr[12]&0xf, hdr[13]>>4, hdr[13]&0xf
+	switch {
+	case command == 0:
+		// LOCAL: sent by the proxy itself
+		return nil
+	case command != 1:
+		return fmt.Errorf("unknown command %d", command)
+	case transport != 1:
+		// Not a stream, so not something we can describe
+		return nil
+	}
+	var size int
+	switch family {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return fmt.Errorf("v2 address block too short (%d bytes)", len(body))
+	}
+	ports := body[2*size:]
+	c.remote = &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(ports))}
+	c.local = &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"time"
+)
+
+// ReadinessTimeout, if positive, caps the time after the process started
+// within which every readiness check must pass, whatever their own timeouts.
+var ReadinessTimeout time.Duration
+
+// HoldUntilReady causes the connections accepted by listeners to be held
+// (as by AwaitDependencies) until the readiness checks registered while it
+// is set have passed, so that an instance which is bound but not yet ready,
+// such as the new generation of a Restart, does not serve them.
+var HoldUntilReady bool
+
+// How often a readiness check which has not passed is retried.
+const readinessRetry = 500 * time.Millisecond
+
+// ReadinessCheck registers a health check (see HealthCheck) which must also
+// pass before the daemon is ready: until it does, startup is not complete,
+// so readiness is not reported to the supervisor or to the parent of a
+// Restart, and connections are held if HoldUntilReady is set.  The check is
+// run every half second, starting immediately, until it passes.
+//
+// If timeout (or ReadinessTimeout) is positive and the check has not passed
+// within it, an error with the code ReadinessFailed is logged and the
+// process exits with StartupExitCode, so that traffic is not routed to an
+// instance which cannot serve it.
+func ReadinessCheck(name string, timeout time.Duration, check func() error) {
+	HealthCheck(name, check)
+	ready := StartupTask("ready:" + name)
+	holding := HoldUntilReady
+	if holding {
+		hold()
+	}
+	go func() {
+		awaitReadiness(&watchCheck{name: name, ping: check}, time.Now().Add(timeout), timeout > 0)
+		if holding {
+			release()
+		}
+		ready()
+	}()
+}
+
+// awaitReadiness runs c until it passes, exiting if it has not passed by the
+// deadline (if bounded) or the ReadinessTimeout.
+func awaitReadiness(c *watchCheck, deadline time.Time, bounded bool) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := c.check(HealthTimeout)
+		if err == nil {
+			if attempt > 1 {
+				Info.Printf("Readiness check %s passed after %s", c.name, time.Since(start))
+			}
+			return
+		}
+		limit, limited := deadline, bounded
+		if ReadinessTimeout > 0 {
+			// It may be set by a flag after the check is registered.
+			if max := StartTime().Add(ReadinessTimeout); !limited || max.Before(limit) {
+				limit, limited = max, true
+			}
+		}
+		if limited && !time.Now().Before(limit) {
+			Error.Printf("%s", &LifecycleError{ReadinessFailed, "ready", c.name, err})
+			exit(StartupExitCode)
+		}
+		if attempt == 1 {
+			Info.Printf("Waiting for readiness check %s: %s", c.name, err)
+		}
+		time.Sleep(readinessRetry)
+	}
+}
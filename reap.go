@@ -0,0 +1,160 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReapInterval is how often the connections of listeners with Reap are
+// checked.
+var ReapInterval = 10 * time.Second
+
+// Reap causes the listener's connections to be closed once they have been
+// idle (with no reads or writes) for longer than idle, or half-closed (a read
+// has returned EOF, but the connection is still open) for longer than
+// halfClosed; either may be zero to disable that check.  Each reaped
+// connection is logged and counted in the metrics.  Reaping keeps the
+// tracked connections honest, so that a drain is not held up by connections
+// which will never finish.  Since the connections are checked every
+// ReapInterval, they may outlive the limits by that much.  The connections of
+// Untracked listeners are not reaped.
+func Reap(idle, halfClosed time.Duration) ListenOption {
+	return func(c *listenConfig) {
+		c.reap = &reapLimits{idle, halfClosed}
+	}
+}
+
+type reapLimits struct {
+	idle, halfClosed time.Duration
+}
+
+// A reapState records the activity of a connection, as UnixNano times.
+type reapState struct {
+	active int64 // atomic; last read or write
+	eof    int64 // atomic; first read which returned EOF, or 0
+}
+
+func newReapState() *reapState {
+	return &reapState{active: now().UnixNano()}
+}
+
+// read notes a read which returned err.
+func (s *reapState) read(err error) {
+	now := now().UnixNano()
+	atomic.StoreInt64(&s.active, now)
+	if err == io.EOF {
+		atomic.CompareAndSwapInt64(&s.eof, 0, now)
+	}
+}
+
+// wrote notes a write.
+func (s *reapState) wrote() {
+	atomic.StoreInt64(&s.active, now().UnixNano())
+}
+
+// reason returns why the connection should be reaped under the limits, and
+// for how long it has been so, or "" if it should not.
+func (s *reapState) reason(limits *reapLimits, now time.Time) (string, time.Duration) {
+	if eof := atomic.LoadInt64(&s.eof); eof != 0 && limits.halfClosed > 0 {
+		if d := now.Sub(time.Unix(0, eof)); d > limits.halfClosed {
+			return "half_closed", d
+		}
+	}
+	if limits.idle > 0 {
+		if d := now.Sub(time.Unix(0, atomic.LoadInt64(&s.active))); d > limits.idle {
+			return "idle", d
+		}
+	}
+	return "", 0
+}
+
+var (
+	reapLock      sync.Mutex
+	reapListeners []*WaitListener
+	reapOnce      sync.Once
+)
+
+// reapConns adds w to the listeners whose connections are reaped.
+func reapConns(w *WaitListener) {
+	reapLock.Lock()
+	reapListeners = append(reapListeners, w)
+	reapLock.Unlock()
+	reapOnce.Do(func() { go reaper() })
+}
+
+func reaper() {
+	for {
+		time.Sleep(ReapInterval)
+		reapLock.Lock()
+		ws := append([]*WaitListener(nil), reapListeners...)
+		reapLock.Unlock()
+
+		var keep []*WaitListener
+		for _, w := range ws {
+			w.reap()
+			if w.state() != ListenerClosed {
+				keep = append(keep, w)
+			}
+		}
+		reapLock.Lock()
+		// Listeners added while reaping are at the end
+		reapListeners = append(keep, reapListeners[len(ws):]...)
+		reapLock.Unlock()
+	}
+}
+
+// reap closes the connections of w which are past its limits.
+func (w *WaitListener) reap() {
+	now := now()
+	for _, conn := range w.Conns() {
+		wc, ok := conn.(*waitConn)
+		if !ok || wc.reap == nil {
+			continue
+		}
+		why, d := wc.reap.reason(w.config.reap, now)
+		if why == "" {
+			continue
+		}
+		Info.Printf("Reaping connection (%s for %s): (local) %s <- %s (remote)", why, d.Round(time.Second), conn.LocalAddr(), conn.RemoteAddr())
+		metrics.Counter(metricReaped, "Connections closed by Reap", "listener", w.name(), "reason", why).Add(1)
+		conn.Close()
+	}
+}
+
+// parseReap parses the value of the reap spec key, IDLE[:HALFCLOSED].
+func parseReap(val string) (ListenOption, error) {
+	idleStr, halfStr, _ := cut(val, ":")
+	var idle, half time.Duration
+	var err error
+	if idleStr != "" {
+		if idle, err = time.ParseDuration(idleStr); err != nil {
+			return nil, err
+		}
+	}
+	if halfStr != "" {
+		if half, err = time.ParseDuration(halfStr); err != nil {
+			return nil, err
+		}
+	}
+	if idle <= 0 && half <= 0 {
+		return nil, fmt.Errorf("want reap=IDLE[:HALFCLOSED], got %q", val)
+	}
+	return Reap(idle, half), nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A Reason describes why a Shutdown or Restart is happening, so that hooks
+// and downstream log consumers can distinguish (for example) an operator's
+// restart from a self-initiated one.
+type Reason struct {
+	Trigger   string        // What triggered it, e.g. "signal", "call", "memory" or "schedule"
+	Signal    os.Signal     // The signal received, if Trigger is "signal"
+	Initiator string        // Who asked, e.g. the file:line of the caller
+	Timeout   time.Duration // The requested drain timeout
+
+	// ChildServing is set for a Shutdown which superseded a Restart whose
+	// child is left serving (see HandoffNone), so that hooks do not remove
+	// what the child still uses.
+	ChildServing bool
+}
+
+func (r Reason) String() string {
+	s := r.Trigger
+	if r.Signal != nil {
+		s += " " + r.Signal.String()
+	}
+	if r.Initiator != "" {
+		s += " from " + r.Initiator
+	}
+	return fmt.Sprintf("%s, timeout %s", s, r.Timeout)
+}
+
+// cause returns a short description of what triggered r.
+func (r Reason) cause() string {
+	if r.Signal != nil {
+		return r.Signal.String()
+	}
+	return r.Trigger
+}
+
+// selfRequests carries the Restarts which the daemon decides to perform
+// itself (e.g. for MaxUptime) to Run or RunContext.
+var selfRequests = make(chan Reason, 1)
+
+// selfRestart asks Run or RunContext to Restart for the given reason.  It
+// does nothing if a request is already pending.
+func selfRestart(r Reason) {
+	select {
+	case selfRequests <- r:
+	default:
+	}
+}
+
+// signalReason returns the Reason for a Shutdown or Restart caused by sig.
+func signalReason(sig os.Signal) Reason {
+	return Reason{
+		Trigger:   "signal",
+		Signal:    sig,
+		Initiator: "signal handler",
+		Timeout:   LameDuck,
+	}
+}
+
+// callReason returns the Reason for a Shutdown or Restart called directly,
+// with the initiator being the caller at the given depth.
+func callReason(timeout time.Duration, depth int) Reason {
+	r := Reason{
+		Trigger: "call",
+		Timeout: timeout,
+	}
+	if _, file, line, ok := runtime.Caller(depth + 1); ok {
+		r.Initiator = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	return r
+}
+
+type reasonHooks struct {
+	lock sync.Mutex
+	fns  []func(Reason)
+}
+
+func (h *reasonHooks) add(fn func(Reason)) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.fns = append(h.fns, fn)
+}
+
+func (h *reasonHooks) run(r Reason) {
+	h.lock.Lock()
+	fns := append([]func(Reason){}, h.fns...)
+	h.lock.Unlock()
+	for _, fn := range fns {
+		fn(r)
+	}
+}
+
+var shutdownHooks, restartHooks reasonHooks
+
+// OnShutdown registers a function to be called with the Reason when a
+// Shutdown begins, after Lamed is closed but before the listeners are.
+func OnShutdown(fn func(Reason)) {
+	shutdownHooks.add(fn)
+}
+
+// OnRestart registers a function to be called with the Reason when a
+// Restart begins, after Lamed is closed but before the listeners are stopped.
+func OnRestart(fn func(Reason)) {
+	restartHooks.add(fn)
+}
@@ -0,0 +1,133 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	rebindLock  sync.Mutex
+	rebindHooks []func(name string, old, new *WaitListener)
+)
+
+// OnRebind registers a function to be called when Rebind replaces the
+// listener of a ListenFlag, with the flag name, so that the application can
+// start accepting connections on the new listener.  (Listeners created with
+// ServeWith are served automatically.)  It is called once the new listener is
+// bound and before the old one is closed.
+func OnRebind(fn func(name string, old, new *WaitListener)) {
+	rebindLock.Lock()
+	defer rebindLock.Unlock()
+	rebindHooks = append(rebindHooks, fn)
+}
+
+// Rebind moves a Listenable returned by ListenFlag to a new address without
+// a Restart, for instance when a configuration reload changes it.  The new
+// address is bound with the same options and replaces the old listener, which
+// is returned by Listen from then on and passed on by later Restarts.  The
+// functions registered with OnRebind are called, and then the old listener is
+// closed and its connections are drained in the background for up to
+// timeout.
+//
+// If the flag is not listening yet, only its address is changed.  If it is
+// already listening on addr, Rebind does nothing.  If the new address cannot
+// be bound, the old listener is kept and a LifecycleError with code
+// BindFailed is returned, as it is for a unix socket or a flag with several
+// addresses, which cannot be rebound.  Rebind returns ErrStopping during a
+// Shutdown or Restart.
+func Rebind(l Listenable, addr string, timeout time.Duration) error {
+	lf, ok := l.(*listenFlag)
+	if !ok {
+		return fmt.Errorf("daemon: cannot rebind %T", l)
+	}
+	if lf.mode == "unix" || strings.HasPrefix(addr, unixPrefix) {
+		return &LifecycleError{BindFailed, "rebind", lf.flag, fmt.Errorf("unix sockets cannot be rebound")}
+	}
+	if len(lf.siblings) > 0 {
+		return &LifecycleError{BindFailed, "rebind", lf.flag, fmt.Errorf("flags with several addresses cannot be rebound")}
+	}
+	laddr, err := net.ResolveTCPAddr(lf.net, addr)
+	if err != nil {
+		return &LifecycleError{BindFailed, "rebind", lf.flag, err}
+	}
+
+	rebindLock.Lock()
+	defer rebindLock.Unlock()
+	old, w, err := lf.rebind(laddr)
+	if w == nil {
+		return err
+	}
+	for _, fn := range rebindHooks {
+		fn(lf.flag, old, w)
+	}
+
+	old.Close()
+	go func() {
+		if err := drain([]*WaitListener{old}, timeout); err != nil {
+			Warning.Printf("Connections to the old address of --%s (%s) did not drain: %s", lf.flag, old.Addr(), err)
+			return
+		}
+		Verbose.Printf("Drained the old address of --%s (%s)", lf.flag, old.Addr())
+	}()
+	return nil
+}
+
+// rebind binds laddr and makes it the flag's listener, returning the old
+// listener and the new one, which is nil if there was nothing to rebind.  A
+// Shutdown or Restart cannot begin meanwhile, so that the listener it passes
+// on is the new one.
+func (lf *listenFlag) rebind(laddr *net.TCPAddr) (old, w *WaitListener, err error) {
+	stoppingLock.Lock()
+	defer stoppingLock.Unlock()
+	if stopping != "" {
+		return nil, nil, ErrStopping
+	}
+	if old = lf.current(); old == nil {
+		lf.lock.Lock()
+		lf.mode, lf.laddr, lf.err = "tcp", laddr, nil
+		lf.lock.Unlock()
+		return nil, nil, nil
+	}
+	if sameAddr(laddr, old.Addr()) {
+		return old, nil, nil
+	}
+
+	under, err := listenTCP(&lf.config, lf.net, laddr)
+	if err != nil {
+		return old, nil, &LifecycleError{BindFailed, "rebind", lf.flag, err}
+	}
+	Info.Printf("Rebinding --%s from %s to %s", lf.flag, old.Addr(), under.Addr())
+	lf.lock.Lock()
+	lf.mode, lf.laddr = "tcp", laddr
+	lf.lock.Unlock()
+	return old, lf.start(under), nil
+}
+
+// sameAddr returns true if a listener on want would be listening on have.
+func sameAddr(want *net.TCPAddr, have net.Addr) bool {
+	h, ok := have.(*net.TCPAddr)
+	if !ok || want.Port != h.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return h.IP == nil || h.IP.IsUnspecified()
+	}
+	return want.IP.Equal(h.IP)
+}
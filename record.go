@@ -0,0 +1,80 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A Record is a single log message, as passed to error callbacks.
+type Record struct {
+	Time    time.Time
+	Level   Logger
+	Message string // Formatted message, without the level prefix
+	File    string // Base name of the source file which logged the message
+	Line    int    // Line number within File
+	Stack   string // Stack trace of all goroutines, only for Fatal records
+
+	// Code is the ErrorCode of the first LifecycleError among the
+	// arguments, if any, so that alerts can be routed by failure class.
+	Code ErrorCode
+}
+
+var (
+	errorHooksLock sync.Mutex
+	errorHooks     []func(Record)
+)
+
+// OnError registers a function which is called for every Error, Exit, and
+// Fatal record after it has been written to the log.  It is intended for
+// pushing alerts to an external system.  Callbacks are invoked synchronously,
+// in the order in which they were registered, and are guaranteed to return
+// before the process exits due to an Exit or Fatal record; they should
+// therefore time out on their own, and must not themselves log at Error or
+// higher.
+func OnError(fn func(Record)) {
+	errorHooksLock.Lock()
+	defer errorHooksLock.Unlock()
+	errorHooks = append(errorHooks, fn)
+}
+
+// runErrorHooks calls the error callbacks for a record logged at the given
+// level.  The depth is interpreted like the calldepth of log.Output, as seen
+// from the caller of runErrorHooks.
+func runErrorHooks(l Logger, msg, stack string, code ErrorCode, depth int) {
+	errorHooksLock.Lock()
+	hooks := errorHooks
+	errorHooksLock.Unlock()
+	if len(hooks) == 0 {
+		return
+	}
+
+	rec := Record{
+		Time:    now(),
+		Level:   l,
+		Message: msg,
+		Stack:   stack,
+		Code:    code,
+	}
+	if _, file, line, ok := runtime.Caller(depth); ok {
+		rec.File, rec.Line = filepath.Base(file), line
+	}
+	for _, fn := range hooks {
+		fn(rec)
+	}
+}
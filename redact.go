@@ -0,0 +1,68 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"regexp"
+	"sync"
+)
+
+var (
+	redactLock sync.Mutex
+	redactors  []func(string) string
+)
+
+// Redact registers a function which is applied to every log message before
+// it is written (or passed to the functions registered with OnError), so that
+// secrets and personal data can be masked centrally.  Redactors are applied in
+// the order they were registered, and must not log.  Stack traces are not
+// redacted.
+func Redact(fn func(msg string) string) {
+	redactLock.Lock()
+	defer redactLock.Unlock()
+	redactors = append(redactors, fn)
+}
+
+// RedactPattern registers a redactor which replaces every match of re with
+// repl, which is expanded as by regexp.ReplaceAllString, so that "${1}" can
+// keep part of the match.  For example:
+//
+//	daemon.RedactPattern(regexp.MustCompile(`(token=)\w+`), "${1}REDACTED")
+func RedactPattern(re *regexp.Regexp, repl string) {
+	Redact(func(msg string) string {
+		return re.ReplaceAllString(msg, repl)
+	})
+}
+
+// URLPassword matches the password in a URL with credentials, keeping the
+// rest of the URL in the groups named "pre" and "post", for RedactURLPasswords.
+var URLPassword = regexp.MustCompile(`(?P<pre>://[^/:@\s]*:)[^/@\s]*(?P<post>@)`)
+
+// RedactURLPasswords registers a redactor which replaces the passwords in
+// URLs, such as "postgres://user:secret@db/", with "REDACTED".
+func RedactURLPasswords() {
+	RedactPattern(URLPassword, "${pre}REDACTED${post}")
+}
+
+// redact applies the registered redactors to msg.
+func redact(msg string) string {
+	redactLock.Lock()
+	fns := redactors
+	redactLock.Unlock()
+	for _, fn := range fns {
+		msg = fn(msg)
+	}
+	return msg
+}
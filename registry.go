@@ -0,0 +1,232 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	registryLock sync.Mutex
+	registry     []Listenable
+)
+
+// Register adds a Listenable to the set which is started by ListenAll.
+// Listenables created by ListenFlag are registered automatically.
+func Register(l Listenable) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, l)
+}
+
+func registered() []Listenable {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	return withSiblings(registry)
+}
+
+// activeListeners returns the WaitListeners of the registered Listenables
+// which are currently listening.
+func activeListeners() []*WaitListener {
+	var ws []*WaitListener
+	for _, l := range registered() {
+		if lf, ok := l.(*listenFlag); ok {
+			if w := lf.current(); w != nil {
+				ws = append(ws, w)
+			}
+		}
+	}
+	return ws
+}
+
+// A ListenerState describes what a listener is doing.
+type ListenerState string
+
+// States reported in ListenerStatus.
+const (
+	ListenerIdle      ListenerState = "idle"      // Not listening yet
+	ListenerListening ListenerState = "listening" // Accepting connections
+	ListenerDraining  ListenerState = "draining"  // Stopped or closed, with connections open
+	ListenerClosed    ListenerState = "closed"    // Stopped or closed, with no connections
+)
+
+// ListenerStatus describes a single registered ListenFlag.
+type ListenerStatus struct {
+	Name       string // Flag name
+	Daemon     string `json:",omitempty"` // Name of the Daemon, if any
+	Proto      string
+	Configured string // Address from the flag (or its default), or &fd
+	Mode       string // "tcp" or "unix" to bind Configured, or "fd" if inherited
+	Addr       string `json:",omitempty"` // Bound address; empty if not listening
+	State      ListenerState
+	Listening  bool   // State is ListenerListening
+	Conns      int    // Open connections
+	Rejected   uint64 // See WaitListener.Rejected
+}
+
+// Listeners returns the status of every registered ListenFlag, in the order
+// they were registered.
+func Listeners() []ListenerStatus {
+	return listenerStatus(registered())
+}
+
+// listenerStatus returns the status of the ListenFlags among ls.
+func listenerStatus(ls []Listenable) []ListenerStatus {
+	statuses := []ListenerStatus{}
+	for _, l := range ls {
+		lf, ok := l.(*listenFlag)
+		if !ok {
+			continue
+		}
+		lf.lock.Lock()
+		s := ListenerStatus{
+			Name:       lf.flag,
+			Daemon:     lf.daemon,
+			Proto:      lf.proto,
+			Configured: lf.configured(),
+			Mode:       lf.mode,
+			State:      ListenerIdle,
+		}
+		w := lf.listener
+		lf.lock.Unlock()
+		if w != nil {
+			s.Addr = w.Addr().String()
+			s.State = w.state()
+			s.Listening = s.State == ListenerListening
+			s.Conns = w.Active()
+			s.Rejected = w.Rejected()
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// ListenErrors is returned by ListenAll when one or more registered
+// Listenables could not listen.
+type ListenErrors []error
+
+func (e ListenErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ListenAll attempts to listen on every registered Listenable, so that all
+// misconfigured listeners are reported at once rather than one per run.  If
+// two ListenFlags are configured with overlapping addresses, nothing is bound
+// and an error naming both flags is returned for each such pair.  The
+// listeners can then be retrieved by calling Listen on each Listenable.  If
+// any of them fail, the errors are returned as a ListenErrors, and if release
+// is true, the listeners which were successfully bound are closed again.
+func ListenAll(release bool) error {
+	return listenAll(registered(), release)
+}
+
+// listenAll implements ListenAll for the Listenables in ls.
+func listenAll(ls []Listenable, release bool) error {
+	watchStartupOnce()
+	if errs := addrConflicts(ls); len(errs) > 0 {
+		return errs
+	}
+
+	var (
+		errs  ListenErrors
+		bound []net.Listener
+	)
+	for _, l := range ls {
+		lis, err := l.Listen()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if lis != nil {
+			bound = append(bound, lis)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if release {
+		for _, lis := range bound {
+			lis.Close()
+		}
+		for _, l := range ls {
+			switch l := l.(type) {
+			case *listenFlag:
+				l.lock.Lock()
+				l.listener, l.multi = nil, nil
+				l.lock.Unlock()
+			case *controlFlag:
+				l.listener = nil
+			case *packetFlag:
+				if l.conn != nil {
+					l.conn.Close()
+					l.conn = nil
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// addrConflicts returns a BindFailed error for each pair of ListenFlags in ls
+// which would bind overlapping addresses.
+func addrConflicts(ls []Listenable) ListenErrors {
+	var (
+		errs  ListenErrors
+		flags []*listenFlag
+	)
+	for _, l := range ls {
+		lf, ok := l.(*listenFlag)
+		if !ok || lf.listener != nil || lf.binds() == nil {
+			continue
+		}
+		for _, other := range flags {
+			if !lf.disjoint(other) && overlaps(lf.binds(), other.binds()) {
+				errs = append(errs, lf.conflict(other.flag, other.binds()))
+			}
+		}
+		flags = append(flags, lf)
+	}
+	return errs
+}
+
+// overlaps returns true if listeners on a and b could not both be bound.
+func overlaps(a, b *net.TCPAddr) bool {
+	if a.Port == 0 || a.Port != b.Port {
+		return false
+	}
+	if a.IP == nil || a.IP.IsUnspecified() || b.IP == nil || b.IP.IsUnspecified() {
+		return true
+	}
+	return a.IP.Equal(b.IP)
+}
+
+// MustListenAll calls ListenAll, releasing any bound listeners and
+// exiting after logging every failure if any of them could not listen.
+func MustListenAll() {
+	err := ListenAll(true)
+	if err == nil {
+		return
+	}
+	for _, err := range err.(ListenErrors) {
+		Error.Printf("%s", err)
+	}
+	Exit.Printf("Failed to start %d listener(s)", len(err.(ListenErrors)))
+}
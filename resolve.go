@@ -0,0 +1,168 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResolveInterval is how often the addresses of Upstreams are re-resolved.
+var ResolveInterval = time.Minute
+
+// ResolveTimeout bounds each DNS lookup made for an Upstream.
+var ResolveTimeout = 5 * time.Second
+
+// An Upstream is a named outbound address (host:port) whose host is
+// re-resolved every ResolveInterval, so that a long-lived daemon follows DNS
+// changes instead of pinning the addresses it found at startup.  If a lookup
+// fails, the previous addresses continue to be used.
+type Upstream struct {
+	name       string
+	host, port string
+
+	lock     sync.Mutex
+	addrs    []string // "ip:port"
+	err      error    // from the last lookup
+	resolved time.Time
+}
+
+var (
+	upstreamLock sync.Mutex
+	upstreams    []*Upstream
+	upstreamOnce sync.Once
+)
+
+// Resolve returns an Upstream with the given name for the address, which is
+// resolved immediately.  Resolve only fails if hostport is malformed; a failed
+// lookup is reported by Err and retried in the background.
+func Resolve(name, hostport string) (*Upstream, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	u := &Upstream{name: name, host: host, port: port}
+	u.refresh()
+
+	upstreamLock.Lock()
+	upstreams = append(upstreams, u)
+	upstreamLock.Unlock()
+	upstreamOnce.Do(func() { go refreshUpstreams() })
+	return u, nil
+}
+
+// Name returns the name of the upstream.
+func (u *Upstream) Name() string {
+	return u.name
+}
+
+// Addrs returns the most recently resolved addresses, as "ip:port".
+func (u *Upstream) Addrs() []string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return append([]string(nil), u.addrs...)
+}
+
+// Err returns the error from the most recent lookup, if it failed.
+func (u *Upstream) Err() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.err
+}
+
+// Resolved returns the time of the most recent successful lookup.
+func (u *Upstream) Resolved() time.Time {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.resolved
+}
+
+// Dial connects to the first of the upstream's addresses which accepts a
+// connection.
+func (u *Upstream) Dial(network string, timeout time.Duration) (net.Conn, error) {
+	addrs := u.Addrs()
+	if len(addrs) == 0 {
+		if err := u.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("daemon: upstream " + u.name + " has no addresses")
+	}
+	var err error
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = net.DialTimeout(network, addr, timeout); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Invalidate re-resolves the upstream immediately.  It should be called when
+// the application reloads its configuration or sees connection failures.
+func (u *Upstream) Invalidate() {
+	u.refresh()
+}
+
+// InvalidateUpstreams re-resolves every Upstream immediately.
+func InvalidateUpstreams() {
+	upstreamLock.Lock()
+	us := append([]*Upstream(nil), upstreams...)
+	upstreamLock.Unlock()
+	for _, u := range us {
+		u.refresh()
+	}
+}
+
+func (u *Upstream) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupHost(ctx, u.host)
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.err = err
+	if err != nil {
+		Warning.Printf("Failed to resolve upstream %s (%s): %s", u.name, u.host, err)
+		return
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, u.port)
+	}
+	if old, now := sortedList(u.addrs), sortedList(addrs); old != now {
+		// Only log changes to the set; DNS servers often rotate the order.
+		Info.Printf("Upstream %s is now %s", u.name, now)
+	}
+	u.addrs, u.resolved = addrs, now()
+}
+
+func sortedList(addrs []string) string {
+	addrs = append([]string(nil), addrs...)
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
+}
+
+func refreshUpstreams() {
+	for {
+		time.Sleep(ResolveInterval)
+		InvalidateUpstreams()
+	}
+}
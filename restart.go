@@ -15,12 +15,16 @@
 package daemon
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,8 +35,121 @@ func init() {
 	stopOnce <- true
 }
 
-func copyFlags() (cmd *exec.Cmd, ports []*WaitListener) {
+// ErrStopping is returned (by Rebind, for instance) when a Shutdown or
+// Restart is requested while another is already in progress.
+var ErrStopping = errors.New("daemon: already stopping")
+
+// beginStop claims stopOnce for a Shutdown or Restart (stopShutdown or
+// stopRestart), or returns ErrStopping if another has already claimed it.
+func beginStop(kind string) error {
+	select {
+	case <-stopOnce:
+	default:
+		return ErrStopping
+	}
+	stoppingLock.Lock()
+	defer stoppingLock.Unlock()
+	stopping = kind
+	return nil
+}
+
+// lostStop is called by a Shutdown or Restart which lost the race to another,
+// which will exit the process.
+func lostStop(what string, r Reason) {
+	Warning.Printf("%s (%s) ignored: %s", what, r, ErrStopping)
+	select {}
+}
+
+// listenAddrsEnv is the environment variable in which the addresses of
+// the listeners passed to a child are recorded, so that the child can
+// verify that it received the descriptors it expected.
+const listenAddrsEnv = "DAEMON_LISTEN_ADDRS"
+
+// inheritedAddrs returns the addresses of the listeners passed from the
+// parent process, keyed by flag name.
+func inheritedAddrs() map[string]string {
+	addrs := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv(listenAddrsEnv), ",") {
+		if eq := strings.Index(pair, "="); eq > 0 {
+			addrs[pair[:eq]] = pair[eq+1:]
+		}
+	}
+	return addrs
+}
+
+// listenFDsEnv and listenFDNamesEnv are the environment variables in which
+// a parent passes the number of listeners it passes to the child and their
+// flag names, separated by colons, like LISTEN_FDS and LISTEN_FDNAMES in
+// sd_listen_fds(3).  The listeners are descriptors 3, 4, 5... in the order
+// they were registered, so the child can adopt them by name.
+const (
+	listenFDsEnv     = "DAEMON_LISTEN_FDS"
+	listenFDNamesEnv = "DAEMON_LISTEN_FDNAMES"
+)
+
+// inheritedFDs are the descriptors of the listeners passed from the parent
+// process, keyed by flag name.  Each is removed once it is adopted.
+var inheritedFDs = map[string]int{}
+
+func init() {
+	count, _ := strconv.Atoi(os.Getenv(listenFDsEnv))
+	names := strings.Split(os.Getenv(listenFDNamesEnv), ":")
+	for i := 0; i < count && i < len(names); i++ {
+		inheritedFDs[names[i]] = 3 + i
+	}
+	os.Unsetenv(listenFDsEnv)
+	os.Unsetenv(listenFDNamesEnv)
+}
+
+func copyFlags() (cmd *exec.Cmd, ports []*WaitListener, err error) {
 	cmd = exec.Command(os.Args[0])
+	var addrs, names []string
+
+	// The listeners come first in the extra files (which don't include
+	// stdin/out/err), in registration order.
+	fds := map[*listenFlag]int{}
+	packetFDs := map[*packetFlag]int{}
+	for _, l := range registered() {
+		if p, ok := l.(*packetFlag); ok && p.conn != nil {
+			file, dupErr := p.conn.Dup()
+			if dupErr != nil {
+				if err == nil {
+					err = dupErr
+				}
+				continue
+			}
+			packetFDs[p] = 3 + len(cmd.ExtraFiles)
+			cmd.ExtraFiles = append(cmd.ExtraFiles, file)
+			names = append(names, p.flag)
+			continue
+		}
+		lf, ok := l.(*listenFlag)
+		if !ok || lf.listener == nil {
+			continue
+		}
+
+		// return the port so it can be closed
+		ports = append(ports, lf.listener)
+		if lf.listener.reused {
+			// The child binds its own socket
+			continue
+		}
+		if injected(faultHandoff, lf.listener.name()) != nil {
+			continue
+		}
+
+		file, dupErr := lf.listener.Dup()
+		if dupErr != nil {
+			if err == nil {
+				err = dupErr
+			}
+			continue
+		}
+		fds[lf] = 3 + len(cmd.ExtraFiles)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, file)
+		names = append(names, lf.flag)
+		addrs = append(addrs, lf.flag+"="+lf.listener.Addr().String())
+	}
 
 	flag.VisitAll(func(f *flag.Flag) {
 		switch val := f.Value.(type) {
@@ -41,93 +158,205 @@ func copyFlags() (cmd *exec.Cmd, ports []*WaitListener) {
 				// flag hasn't been listened yet, so just pass through
 				break
 			}
-
-			// The extra files list doesn't include stdin/out/err
-			fd := 3 + len(cmd.ExtraFiles)
-
-			// Add this flag to the cmd
-			cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=&%d", f.Name, fd))
-			cmd.ExtraFiles = append(cmd.ExtraFiles, val.listener.File())
-
-			// return the port so it can be closed
-			ports = append(ports, val.listener)
+			if addr, ok := val.handoffAddr(fds); ok {
+				cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=%s%s", f.Name, addr, val.specSuffix()))
+			}
 			return
+		case *packetFlag:
+			if fd, ok := packetFDs[val]; ok {
+				cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=&%d", f.Name, fd))
+				return
+			}
 		case *forkFlag:
 			// Don't pass fork on to subprocesses
 			return
 		}
 		cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=%s", f.Name, f.Value))
 	})
-	return
+	cmd.Env = append(cmd.Env,
+		listenAddrsEnv+"="+strings.Join(addrs, ","),
+		listenFDsEnv+"="+strconv.Itoa(len(names)),
+		listenFDNamesEnv+"="+strings.Join(names, ":"))
+	passInherited(cmd)
+	return cmd, ports, err
 }
 
-func spawn(cmd *exec.Cmd) {
+// spawn starts the child described by cmd, whose environment so far holds
+// only this package's own variables.
+func spawn(cmd *exec.Cmd) error {
 	Verbose.Printf("Spawning process: %q %q", cmd.Args[0], cmd.Args[1:])
+	cmd.Env = append(childEnv(), cmd.Env...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	closeOnExec()
+	if err := injected(faultSpawn, ""); err != nil {
+		return &LifecycleError{SpawnFailed, "spawn", cmd.Args[0], err}
+	}
 	if err := cmd.Start(); err != nil {
-		Fatal.Printf("Exec failed: %s", err)
+		return &LifecycleError{SpawnFailed, "spawn", cmd.Args[0], err}
 	}
+	trackChild(cmd.Process)
+	return nil
 }
 
-// Restart re-execs the current process, passing all of the same flags,
-// except that ListenFlags will be replaced with "&fd" to copy the file
-// descriptor from this process.  Restart does not return.
+// Restart re-execs the current process, passing all of the same flags, except
+// that ListenFlags will be replaced with "&fd" to copy the file descriptor
+// from this process.  The descriptors are numbered 3, 4, 5... in the order the
+// ListenFlags were registered, and their flag names are passed in the
+// environment (as with LISTEN_FDS), so that the child adopts each by
+// name.  PacketFlags are passed on the same way, and listeners bound with
+// ReusePort are cut over instead.  The state of
+// components registered with RegisterState is passed along as well.  Once the
+// child has started, this process closes its copies of the listeners and
+// verifies that it no longer holds them, so that only the child accepts
+// connections.  Functions registered with OnRestart are called first, with a
+// Reason naming the caller.  The child's environment can be controlled with
+// ChildEnv, ScrubEnv and OnChildEnv.  Restart does not return; if a Shutdown or
+// Restart is already in progress, it logs a warning and waits for that one to
+// exit the process.
 func Restart(timeout time.Duration) {
-	<-stopOnce
+	restartFor(callReason(timeout, 1))
+}
+
+// restartFor performs a Restart for the given reason and exits.
+func restartFor(r Reason) {
+	err := restart(r)
+	if err == ErrStopping {
+		lostStop("Restart", r)
+	}
+	action := stopRestart
+	if s := superseded(); s != nil {
+		action, r = stopShutdown, *s
+	}
+	logExitSummary(action, r, err)
+	if err != nil {
+		Fatal.Printf("Restart (%s) failed: %s", r, err)
+	}
+	if action == stopShutdown {
+		Info.Printf("Shutdown complete (%s)", r)
+	} else {
+		Verbose.Printf("Restart complete (%s)", r)
+	}
+	exit(0)
+}
+
+// restart performs a Restart, returning once the connections to this
+// process have drained.  After an error, this process is no longer serving.
+func restart(r Reason) error {
+	if err := beginStop(stopRestart); err != nil {
+		return err
+	}
 	close(Lamed)
+	drainStart := startDrain()
+	Info.Printf("Restarting (%s)", r)
+	restartHooks.run(r)
 
-	cmd, ports := copyFlags()
+	cmd, ports, err := copyFlags()
+	if err != nil {
+		return err
+	}
+	cmd.Env = append(cmd.Env,
+		restartedAtEnv+"="+drainStart.Format(time.RFC3339Nano),
+		generationEnv+"="+strconv.Itoa(generation+1),
+		parentPIDEnv+"="+strconv.Itoa(os.Getpid()))
+	var passed []*WaitListener
 	for _, w := range ports {
+		if w.reused {
+			// Keeps accepting until the child is ready
+			continue
+		}
+		passed = append(passed, w)
 		w.Stop()
 		// Send noop connections to free up the accept loops
 		w.noop()
 	}
-	spawn(cmd)
-
-	// Wait for all connections to close out
-	done := make(chan bool)
-	go func() {
-		defer close(done)
-		for _, w := range ports {
-			w.Wait()
+	packets := stopPackets()
+	handed, files := passIdleConns(cmd)
+	cut := prepareCutOver(cmd, ports)
+	if err := passState(cmd); err != nil {
+		Error.Printf("Failed to pass state to child: %s", err)
+	}
+	atomic.StoreInt32(&sharingLogs, 1)
+	rec := handoffRecord{
+		Parent:     os.Getpid(),
+		Generation: generation,
+		Started:    drainStart,
+		Listeners:  map[string]string{},
+	}
+	for _, l := range registered() {
+		if lf, ok := l.(*listenFlag); ok && lf.listener != nil {
+			rec.Listeners[lf.flag] = lf.listener.Addr().String()
 		}
-	}()
-	select {
-	case <-done:
-	case <-time.After(timeout):
-		Fatal.Printf("Restart timed out after %s", timeout)
 	}
-	Verbose.Printf("Restart complete")
-	os.Exit(0)
+	journalHandoff(rec)
+	if err := spawn(cmd); err != nil {
+		return err
+	}
+	rec.Child = cmd.Process.Pid
+	journalHandoff(rec)
+	releaseIdleConns(handed, files)
+	restartSpawned(cmd.Process)
+	verifyHandoff(cmd, passed)
+	cut.finish(cmd.Process.Pid, r.Timeout-time.Since(drainStart))
+
+	// Wait for all connections to close out, within what is left of the
+	// timeout.
+	if err := drain(ports, r.Timeout-time.Since(drainStart)); err != nil {
+		return fmt.Errorf("timed out after %s: %w", r.Timeout, err)
+	}
+	if err := drainPackets(packets, r.Timeout-time.Since(drainStart)); err != nil {
+		return fmt.Errorf("timed out after %s: %w", r.Timeout, err)
+	}
+	return nil
 }
 
 // Shutdown closes all ListenFlags and waits for their connections to
-// finish.  Shutdown does not return.
+// finish.  Functions registered with OnShutdown are called first, with a
+// Reason naming the caller.  Shutdown does not return; like Restart, it
+// defers to a Shutdown or Restart which is already in progress.
 func Shutdown(timeout time.Duration) {
-	<-stopOnce
+	shutdownFor(callReason(timeout, 1))
+}
+
+// shutdownFor performs a Shutdown for the given reason and exits.
+func shutdownFor(r Reason) {
+	err := shutdown(r)
+	if err == ErrStopping {
+		lostStop("Shutdown", r)
+	}
+	logExitSummary(stopShutdown, r, err)
+	if err != nil {
+		Fatal.Printf("Shutdown (%s) failed: %s", r, err)
+	}
+	Info.Printf("Shutdown complete (%s)", r)
+	exit(0)
+}
+
+// shutdown performs a Shutdown, returning once the connections have
+// drained.
+func shutdown(r Reason) error {
+	if err := beginStop(stopShutdown); err != nil {
+		return err
+	}
 	close(Lamed)
+	drainStart := startDrain()
+	Info.Printf("Shutting down (%s)", r)
+	shutdownHooks.run(r)
 
-	_, ports := copyFlags()
+	ports := activeListeners()
 	for _, w := range ports {
 		w.Close()
 	}
+	packets := stopPackets()
 
 	// Wait for all connections to close out
-	done := make(chan bool)
-	go func() {
-		defer close(done)
-		for _, w := range ports {
-			w.Wait()
-		}
-	}()
-	select {
-	case <-done:
-	case <-time.After(timeout):
-		Fatal.Printf("Shutdown timed out after %s", timeout)
+	if err := drain(ports, r.Timeout); err != nil {
+		return fmt.Errorf("timed out after %s: %w", r.Timeout, err)
 	}
-	Info.Printf("Shutdown complete")
-	os.Exit(0)
+	if err := drainPackets(packets, r.Timeout-time.Since(drainStart)); err != nil {
+		return fmt.Errorf("timed out after %s: %w", r.Timeout, err)
+	}
+	return nil
 }
 
 // A Forker knows how to duplicate the main process by replicating its flags.
@@ -163,9 +392,14 @@ func (f *forkFlag) Fork() {
 		f.fork = false
 
 		Verbose.Printf("Forking into the background")
-		cmd, _ := copyFlags()
-		spawn(cmd)
-		os.Exit(0)
+		cmd, _, err := copyFlags()
+		if err != nil {
+			Fatal.Printf("Fork failed: %s", err)
+		}
+		if err := spawn(cmd); err != nil {
+			Fatal.Printf("Exec failed: %s", err)
+		}
+		exit(0)
 	}
 
 	pidfile, err := os.Create(f.pidfile)
@@ -177,6 +411,7 @@ func (f *forkFlag) Fork() {
 
 	fmt.Fprintf(pidfile, "%d\n", os.Getpid())
 	Verbose.Printf("Wrote PID to %s", f.pidfile)
+	chownOnDrop(f.pidfile)
 }
 
 // ForkPIDFlags registers two flags, with the given names, and returns a Forker
@@ -203,37 +438,167 @@ var Lamed = make(chan struct{})
 //   SIGTERM   - Calls Shutdown
 //   SIGHUP    - Calls Restart
 //   SIGUSR1   - Dumps a stack trace to the logs
+//   SIGUSR2   - Writes the Status to the logs (if it is added to Signals)
+//
+// A shutdown signal received during a Restart supersedes it: the new child
+// is told to shut down as well (see HandoffSignals), and this process exits
+// once it has drained.
+// A restart signal received during a Shutdown is ignored.  Any other signal
+// which would stop the daemon again terminates the process immediately.
 //
-// If another signal is received during Shutdown or Restart, the process
-// will terminate immediately.
+// The set of signals can be changed with Signals, and signals received
+// elsewhere can be fed in with HandleSignal.  See also SignalDryRun and
+// SignalConfirm.
+//
+// Calling Run marks the end of startup; see StartupTimeout.  Run also starts
+// the Watchdog, FDCheck, MemoryCheck and AnomalyCheck, if they are enabled,
+// and performs any Restarts scheduled by MaxUptime or RestartWindow.
 func Run() {
-	incoming := make(chan os.Signal, 10)
-	signal.Notify(incoming, signals...)
-	for sig := range incoming {
+	StartupComplete()
+	incoming := subscribe()
+	defer enterLoop()()
+	for {
+		var sig os.Signal
 		select {
-		case <-stopOnce:
-			stopOnce <- true
-		default:
-			Fatal.Printf("Aborted by signal during shutdown")
+		case ack := <-loopPing:
+			close(ack)
+			continue
+		case r := <-selfRequests:
+			select {
+			case <-stopOnce:
+				stopOnce <- true
+				go restartFor(r)
+			default:
+				// already stopping
+			}
+			continue
+		case sig = <-incoming:
 		}
 
-		switch sigAction(sig) {
+		if isStopping() {
+			if duringStop(sig) {
+				Fatal.Printf("Aborted by %s during shutdown", sig)
+			}
+			continue
+		}
+
+		switch filterSignal(sig) {
+		case sigIgnored:
 		case sigShutdown:
-			go Shutdown(LameDuck)
+			forwardToParent(sig)
+			go shutdownFor(signalReason(sig))
 		case sigRestart:
-			go Restart(LameDuck)
+			go restartFor(signalReason(sig))
 		case sigStackDump:
 			V(-5).Printf("Stack dump:\n" + stack())
+		case sigStatusDump:
+			go dumpStatus()
 		default:
 			Warning.Printf("Unknown signal: %s", sig)
 		}
 	}
 }
 
+// ErrShutdown and ErrRestarted are returned (possibly wrapped) by RunContext
+// when the daemon has finished a Shutdown or a Restart, respectively.
+var (
+	ErrShutdown  = errors.New("daemon: shut down")
+	ErrRestarted = errors.New("daemon: restarted")
+)
+
+// RunContext is like Run, but returns instead of exiting, so that it can be
+// embedded in programs which manage their own lifecycle.  It handles the same
+// signals as Run and returns when ctx is cancelled (with ctx.Err()) or once a
+// Shutdown or Restart triggered by a signal has drained (with an error
+// wrapping ErrShutdown or ErrRestarted, or the error which caused it to
+// fail).  Signals received during the Shutdown or Restart are arbitrated as
+// they are by Run, except that RunContext returns instead of terminating the
+// process.  If the signal loses to a Shutdown or Restart called directly,
+// RunContext keeps handling signals until that one exits the process.
+//
+// Since Lamed can only be closed once, the daemon cannot be restarted within
+// the same process after RunContext returns from a Shutdown or Restart.
+func RunContext(ctx context.Context) error {
+	StartupComplete()
+	incoming := subscribe()
+	defer signal.Stop(incoming)
+	defer enterLoop()()
+
+	var stopped chan error
+	stop := func(r Reason, fn func(Reason) error, done error) {
+		stopped = make(chan error, 1)
+		go func() {
+			action, what := stopShutdown, "Shutdown"
+			if done == ErrRestarted {
+				action, what = stopRestart, "Restart"
+			}
+			err := fn(r)
+			if err == ErrStopping {
+				// Lost to a Shutdown or Restart called directly, which
+				// will exit the process (see lostStop).
+				Warning.Printf("%s (%s) ignored: %s", what, r, err)
+				return
+			}
+			if s := superseded(); s != nil {
+				action, done, r = stopShutdown, ErrShutdown, *s
+			}
+			logExitSummary(action, r, err)
+			if err != nil {
+				stopped <- err
+				return
+			}
+			stopped <- fmt.Errorf("%w by %s", done, r.cause())
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-stopped:
+			return err
+		case ack := <-loopPing:
+			close(ack)
+		case r := <-selfRequests:
+			if stopped == nil {
+				stop(r, restart, ErrRestarted)
+			}
+		case sig := <-incoming:
+			if isStopping() {
+				if duringStop(sig) {
+					return fmt.Errorf("daemon: aborted by %s during shutdown", sig)
+				}
+				continue
+			}
+			switch filterSignal(sig) {
+			case sigIgnored:
+			case sigShutdown:
+				// Until the stop begins, isStopping is still false.
+				if stopped == nil {
+					forwardToParent(sig)
+					stop(signalReason(sig), shutdown, ErrShutdown)
+				}
+			case sigRestart:
+				if stopped == nil {
+					stop(signalReason(sig), restart, ErrRestarted)
+				}
+			case sigStackDump:
+				V(-5).Printf("Stack dump:\n" + stack())
+			case sigStatusDump:
+				go dumpStatus()
+			default:
+				Warning.Printf("Unknown signal: %s", sig)
+			}
+		}
+	}
+}
+
 // Return values for platform-specific sigAction
 const (
 	sigUnknown = iota
 	sigShutdown
 	sigRestart
 	sigStackDump
+	sigStatusDump
+	sigIgnored // not returned by sigAction; see filterSignal
 )
@@ -21,7 +21,11 @@ import (
 	"syscall"
 )
 
-var signals = []os.Signal{
+// Signals is the set of signals to which Run and RunContext subscribe.  It
+// can be restricted (even to nothing) before calling Run by programs which
+// receive some signals themselves; those can be passed on to the daemon with
+// HandleSignal.
+var Signals = []os.Signal{
 	syscall.SIGINT,
 	syscall.SIGTERM,
 	syscall.SIGHUP,
@@ -36,6 +40,17 @@ func sigAction(sig os.Signal) int {
 		return sigRestart
 	case syscall.SIGUSR1:
 		return sigStackDump
+	case syscall.SIGUSR2:
+		return sigStatusDump
 	}
 	return sigUnknown
 }
+
+// processAlive returns true if a process with the given pid exists and has
+// not exited.
+func processAlive(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	return !zombie(pid)
+}
@@ -0,0 +1,146 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ReusePort (Linux only) changes how Restart hands the listener to the
+// child, for a smoother cutover than stopping and draining.  The listener is
+// bound with SO_REUSEPORT, and instead of receiving its descriptor, the child
+// binds a socket of its own in the same reuseport group and attaches a BPF
+// program which steers new connections to it.  Meanwhile, this process keeps
+// accepting connections until the child has completed startup, and then
+// closes its socket after accepting any which were already queued, while its
+// established connections drain as usual.
+//
+// Both generations must be run by the same user.  On other platforms, and for
+// listeners passed as descriptors, ReusePort is ignored.
+func ReusePort() ListenOption {
+	return func(c *listenConfig) {
+		c.reusePort = true
+	}
+}
+
+// How long an old generation keeps accepting after the child is ready, to
+// pick up connections which were queued before the steering took effect.
+const cutOverGrace = 100 * time.Millisecond
+
+// listenReusePort binds a listener with SO_REUSEPORT and attaches the
+// steering program to its group.
+func listenReusePort(netw string, laddr *net.TCPAddr) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	under, err := lc.Listen(context.Background(), netw, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	raw, err := under.(*net.TCPListener).SyscallConn()
+	if err == nil {
+		err = steerToNewest(raw)
+	}
+	if err != nil {
+		Warning.Printf("Failed to attach reuseport steering to %s: %s", under.Addr(), err)
+	}
+	return under, nil
+}
+
+// readyEnv is the environment variable which holds the descriptor of a pipe
+// on which a child started by Restart reports that it has completed startup.
+const readyEnv = "DAEMON_READY_FD"
+
+// readyFile is the write end of the pipe, in a child which has one.
+var readyFile *os.File
+
+func init() {
+	if s := os.Getenv(readyEnv); s != "" {
+		if fd, err := strconv.Atoi(s); err == nil {
+			syscall.CloseOnExec(fd)
+			readyFile = os.NewFile(uintptr(fd), "ready")
+		}
+		os.Unsetenv(readyEnv)
+	}
+}
+
+// signalReady tells the parent, if it is waiting, that startup is complete.
+func signalReady() {
+	if readyFile != nil {
+		readyFile.Write([]byte{1})
+		readyFile.Close()
+		readyFile = nil
+	}
+}
+
+// A cutOver is a Restart of listeners bound with ReusePort.
+type cutOver struct {
+	ports []*WaitListener
+	r, w  *os.File // the pipe passed as readyEnv
+}
+
+// prepareCutOver arranges for cmd to report when it is ready, if any of ports
+// were bound with ReusePort, and returns nil otherwise.
+func prepareCutOver(cmd *exec.Cmd, ports []*WaitListener) *cutOver {
+	c := new(cutOver)
+	for _, w := range ports {
+		if w.reused {
+			c.ports = append(c.ports, w)
+		}
+	}
+	if len(c.ports) == 0 {
+		return nil
+	}
+	var err error
+	if c.r, c.w, err = os.Pipe(); err != nil {
+		Warning.Printf("Failed to create readiness pipe: %s", err)
+		c.r, c.w = nil, nil
+		return c
+	}
+	// The extra files list doesn't include stdin/out/err
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, c.w)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", readyEnv, fd))
+	return c
+}
+
+// finish waits up to timeout for the child to complete startup, and then
+// closes the listeners being cut over.
+func (c *cutOver) finish(pid int, timeout time.Duration) {
+	if c == nil {
+		return
+	}
+	ready := false
+	if c.r != nil {
+		c.w.Close()
+		c.r.SetReadDeadline(time.Now().Add(timeout))
+		n, _ := c.r.Read(make([]byte, 1))
+		c.r.Close()
+		ready = n > 0
+	}
+	if !ready {
+		Error.Printf("Pid %d did not report that it was ready within %s; closing listeners anyway", pid, timeout)
+	}
+	time.Sleep(cutOverGrace)
+	for _, w := range c.ports {
+		w.Close()
+		Verbose.Printf("Cut over %s (%s) from generation %d to pid %d", w.name(), w.Addr(), generation, pid)
+	}
+}
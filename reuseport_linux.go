@@ -0,0 +1,62 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Socket options missing from package syscall (from asm-generic/socket.h).
+const (
+	soReusePort           = 0xf
+	soAttachReusePortCBPF = 0x33
+)
+
+// reusePortSupported is whether ReusePort is implemented on this platform.
+const reusePortSupported = true
+
+// reusePortControl sets SO_REUSEPORT on a socket before it is bound.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// steerToNewest attaches a classic BPF program to the reuseport group of the
+// socket which selects the socket at index 1 for every new connection.  With
+// one generation's socket in the group, the index is out of range and the
+// kernel falls back to hashing, so the program is harmless; while a Restart
+// has two, it is the socket which joined last (the child's), since the kernel
+// moves the last socket into the slot of any which is closed.
+func steerToNewest(c syscall.RawConn) error {
+	filter := []syscall.SockFilter{{Code: syscall.BPF_RET | syscall.BPF_K, K: 1}}
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	var errno syscall.Errno
+	if cerr := c.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_SETSOCKOPT, fd, syscall.SOL_SOCKET, soAttachReusePortCBPF,
+			uintptr(unsafe.Pointer(&prog)), unsafe.Sizeof(prog), 0)
+	}); cerr != nil {
+		return cerr
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// +build !linux
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"syscall"
+)
+
+// reusePortSupported is whether ReusePort is implemented on this platform.
+const reusePortSupported = false
+
+// reusePortControl is not implemented on this platform.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// steerToNewest is not implemented on this platform.
+func steerToNewest(c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,342 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxUptime, if positive, causes Run and RunContext to perform a graceful
+// Restart (with LameDuck as the timeout) once the process has been running
+// this long.  This mitigates slow leaks and regularly exercises the restart
+// path.  If RestartWindow is also set, the Restart waits for the window.
+var MaxUptime time.Duration
+
+// RestartWindow, if set, is a daily window in local time, such as
+// "03:00-04:00", during which Run and RunContext perform a graceful Restart.
+// The time within the window is chosen at random, so that a fleet of daemons
+// does not restart at once.  Without MaxUptime, the Restart happens in the
+// first window which begins after the process started.
+var RestartWindow string
+
+var scheduleOnce sync.Once
+
+// A timeWindow is a daily window of local time.
+type timeWindow struct {
+	text       string
+	start, end time.Duration // since midnight
+}
+
+// parseWindow parses a window of the form "HH:MM-HH:MM".  The window may wrap
+// past midnight.
+func parseWindow(s string) (timeWindow, error) {
+	w := timeWindow{text: s}
+	var h1, m1, h2, m2 int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); err != nil {
+		return w, fmt.Errorf("window %q: want HH:MM-HH:MM", s)
+	}
+	for _, v := range [][2]int{{h1, m1}, {h2, m2}} {
+		if v[0] < 0 || v[0] > 23 || v[1] < 0 || v[1] > 59 {
+			return w, fmt.Errorf("window %q: invalid time %02d:%02d", s, v[0], v[1])
+		}
+	}
+	w.start = time.Duration(h1)*time.Hour + time.Duration(m1)*time.Minute
+	w.end = time.Duration(h2)*time.Hour + time.Duration(m2)*time.Minute
+	if w.start == w.end {
+		return w, fmt.Errorf("window %q is empty", s)
+	}
+	return w, nil
+}
+
+func (w timeWindow) String() string {
+	return w.text
+}
+
+// next returns the first occurrence of the window which ends after t, with
+// its start no earlier than t.  If within is false, the occurrence must also
+// start after t.
+func (w timeWindow) next(t time.Time, within bool) (start, end time.Time) {
+	length := w.end - w.start
+	if length < 0 {
+		length += 24 * time.Hour
+	}
+	y, m, d := t.Date()
+	for day := -1; ; day++ {
+		midnight := time.Date(y, m, d+day, 0, 0, 0, 0, t.Location())
+		start = midnight.Add(w.start)
+		end = start.Add(length)
+		if !end.After(t) || (!within && !start.After(t)) {
+			continue
+		}
+		if start.Before(t) {
+			start = t
+		}
+		return start, end
+	}
+}
+
+type windowFlag struct {
+	val *string
+}
+
+func (f *windowFlag) String() string {
+	if f.val == nil {
+		return ""
+	}
+	return *f.val
+}
+
+func (f *windowFlag) Set(s string) error {
+	if s != "" {
+		if _, err := parseWindow(s); err != nil {
+			return err
+		}
+	}
+	*f.val = s
+	return nil
+}
+
+// SelfRestartFlags registers two flags, with the given names, which set
+// MaxUptime and RestartWindow.
+func SelfRestartFlags(maxUptimeFlagName, windowFlagName string) {
+	flag.DurationVar(&MaxUptime, maxUptimeFlagName, MaxUptime, "Restart after running this long (0 to disable)")
+	flag.Var(&windowFlag{&RestartWindow}, windowFlagName, "Daily window in which to restart, e.g. 03:00-04:00 (if set)")
+}
+
+// selfRestartAt returns the time at which to restart, and why.
+func selfRestartAt() (time.Time, string, error) {
+	at, why := startTime.Add(MaxUptime), fmt.Sprintf("max uptime %s", MaxUptime)
+	if RestartWindow == "" {
+		return at, why, nil
+	}
+	w, err := parseWindow(RestartWindow)
+	if err != nil {
+		return at, why, err
+	}
+	if MaxUptime > 0 {
+		why += ", "
+	} else {
+		why = ""
+	}
+	why += "restart window " + w.String()
+
+	start, end := w.next(at, MaxUptime > 0)
+	if span := end.Sub(start); span > 0 {
+		start = start.Add(time.Duration(randInt63n(int64(span))))
+	}
+	return start, why, nil
+}
+
+// scheduleRestart waits until the scheduled time and restarts.
+func scheduleRestart() {
+	at, why, err := selfRestartAt()
+	if err != nil {
+		Error.Printf("Not scheduling self-restart: %s", err)
+		return
+	}
+	Info.Printf("Scheduled self-restart at %s (%s)", at.Format(time.RFC3339), why)
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-Lamed:
+		return
+	case <-timer.C:
+	}
+	selfRestart(Reason{
+		Trigger:   "schedule",
+		Initiator: why,
+		Timeout:   LameDuck,
+	})
+}
+
+// LogSchedule, if set, is a comma-separated list of daily windows in local
+// time with the LogLevel to use during each, such as "01:00-05:00=3" to log
+// verbosely during a nightly batch.  The schedule takes effect when Run or
+// RunContext starts; outside the windows, LogLevel is restored to what it
+// was then, or to what it was last set to (see SetLogLevel) other than by the
+// schedule.  If windows overlap, the first one listed wins.  It can be
+// changed while running with SetLogSchedule.
+var LogSchedule string
+
+// A levelWindow is a window of LogSchedule.
+type levelWindow struct {
+	timeWindow
+	level Logger
+}
+
+// parseLogSchedule parses a LogSchedule.
+func parseLogSchedule(s string) ([]levelWindow, error) {
+	var sched []levelWindow
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		eq := strings.Index(entry, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("log schedule %q: want HH:MM-HH:MM=level", entry)
+		}
+		w, err := parseWindow(entry[:eq])
+		if err != nil {
+			return nil, err
+		}
+		level, err := strconv.Atoi(entry[eq+1:])
+		if err != nil || level < 0 {
+			return nil, fmt.Errorf("log schedule %q: level must be a number >= 0", entry)
+		}
+		sched = append(sched, levelWindow{w, Logger(level)})
+	}
+	return sched, nil
+}
+
+// levelAt returns the level which the schedule sets at t (or base, outside
+// its windows) and when that next changes.
+func levelAt(sched []levelWindow, base Logger, t time.Time) (Logger, time.Time) {
+	level, within := base, false
+	var change time.Time
+	for _, w := range sched {
+		start, end := w.next(t, true)
+		boundary := start
+		if !start.After(t) {
+			boundary = end
+			if !within {
+				level, within = w.level, true
+			}
+		}
+		if change.IsZero() || boundary.Before(change) {
+			change = boundary
+		}
+	}
+	return level, change
+}
+
+var (
+	logScheduleLock    sync.Mutex
+	logScheduleOnce    sync.Once
+	logScheduleChanged = make(chan bool, 1)
+)
+
+// SetLogSchedule replaces the LogSchedule; an empty schedule restores the
+// LogLevel which is in effect outside its windows.
+func SetLogSchedule(s string) error {
+	if _, err := parseLogSchedule(s); err != nil {
+		return err
+	}
+	logScheduleLock.Lock()
+	LogSchedule = s
+	logScheduleLock.Unlock()
+	startLogSchedule()
+	select {
+	case logScheduleChanged <- true:
+	default:
+	}
+	return nil
+}
+
+// startLogSchedule starts scheduleLogLevels, if there is a schedule.
+func startLogSchedule() {
+	logScheduleLock.Lock()
+	defer logScheduleLock.Unlock()
+	if LogSchedule != "" {
+		logScheduleOnce.Do(func() { go scheduleLogLevels(logLevel()) })
+	}
+}
+
+// scheduleLogLevels sets LogLevel according to the LogSchedule, returning to
+// base outside its windows.  If the level is changed by hand, that becomes
+// the base.
+func scheduleLogLevels(base Logger) {
+	set := base // the level the schedule last set
+	for {
+		logScheduleLock.Lock()
+		spec := LogSchedule
+		logScheduleLock.Unlock()
+		sched, _ := parseLogSchedule(spec) // checked when it was set
+
+		if current := logLevel(); current != set {
+			base = current
+		}
+		level, change := levelAt(sched, base, now())
+		if level != logLevel() {
+			Info.Printf("Log level is now %d (log schedule %q)", level, spec)
+			SetLogLevel(level)
+		}
+		set = level
+
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !change.IsZero() {
+			timer = time.NewTimer(time.Until(change))
+			fire = timer.C
+		}
+		select {
+		case <-fire:
+		case <-logScheduleChanged:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+type logScheduleFlag struct{}
+
+func (logScheduleFlag) String() string {
+	logScheduleLock.Lock()
+	defer logScheduleLock.Unlock()
+	return LogSchedule
+}
+
+func (logScheduleFlag) Set(s string) error {
+	if _, err := parseLogSchedule(s); err != nil {
+		return err
+	}
+	logScheduleLock.Lock()
+	defer logScheduleLock.Unlock()
+	LogSchedule = s
+	return nil
+}
+
+// LogScheduleFlag registers a flag with the given name which sets the
+// LogSchedule.  It can also be changed while running with the
+// "logschedule" control command.
+func LogScheduleFlag(name string) {
+	flag.Var(logScheduleFlag{}, name, `Log levels for daily windows, e.g. "01:00-05:00=3" (if set)`)
+}
+
+// logScheduleCommand implements the logschedule control command.
+func logScheduleCommand(w io.Writer, args []string) error {
+	switch len(args) {
+	case 0:
+	case 1:
+		spec := args[0]
+		if spec == "-" {
+			spec = ""
+		}
+		if err := SetLogSchedule(spec); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("usage: logschedule [spec|-]")
+	}
+	fmt.Fprintf(w, "log schedule: %q, log level: %d\n", logScheduleFlag{}.String(), logLevel())
+	return nil
+}
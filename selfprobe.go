@@ -0,0 +1,301 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A SelfProbeMode determines what a SelfProbe checks on the connection it
+// makes to the daemon's own listener.
+type SelfProbeMode int
+
+const (
+	// SelfProbeConnect connects and waits for the connection to be
+	// accepted by the application, then closes it.
+	SelfProbeConnect SelfProbeMode = iota
+
+	// SelfProbeTLS is SelfProbeConnect with a TLS handshake.  The server's
+	// certificate is not verified, since it is not issued for loopback.
+	SelfProbeTLS
+
+	// SelfProbeHTTP makes a GET request for a path (with TLS if the
+	// listener has it), which must not fail with a 5xx status.
+	SelfProbeHTTP
+)
+
+// SelfProbeInterval is how often a SelfProbe runs.
+var SelfProbeInterval = 10 * time.Second
+
+// SelfProbeTimeout bounds each attempt of a SelfProbe.
+var SelfProbeTimeout = 5 * time.Second
+
+// SelfProbeFailures is how many consecutive attempts of a SelfProbe must fail
+// before the daemon is considered not live.
+var SelfProbeFailures = 3
+
+type selfProbe struct {
+	listener string
+	mode     SelfProbeMode
+	path     string
+
+	up      Gauge
+	latency Histogram
+
+	lock     sync.Mutex
+	failures int   // consecutive
+	err      error // from the last attempt
+}
+
+var (
+	selfProbeLock sync.Mutex
+	selfProbes    []*selfProbe
+
+	// selfProbing counts the attempts waiting to be accepted, by the local
+	// address of their connections in selfProbeConns.
+	selfProbing    int32 // atomic
+	selfProbeConns sync.Map
+)
+
+// SelfProbe periodically connects to the daemon's own listener, created by
+// the ListenFlag with the given name, and checks it as the mode says (the
+// path is only used by SelfProbeHTTP).  This catches a daemon whose process
+// is alive but whose accept loop or handlers are wedged: since the kernel
+// completes TCP handshakes on its own, the probe only passes once the
+// application has taken its connection from Accept.  The application's
+// handler sees the connection, which is closed without sending anything
+// unless the mode is SelfProbeHTTP; it comes from a loopback address, which
+// admission control must allow.  Listeners on unix sockets or with
+// ProxyProtocol cannot be probed, and their probes log a warning and stop.
+//
+// The result is the daemon's liveness signal: once SelfProbeFailures
+// attempts in a row have failed, the probe fails the watchdog (see
+// OnWatchdog and WatchdogPolicy) and LivenessHandler, and it is reported in
+// the metric daemon_self_probe_up.  Probing starts once startup is complete
+// and stops when the daemon begins to drain.
+func SelfProbe(listener string, mode SelfProbeMode, path string) {
+	p := &selfProbe{
+		listener: listener,
+		mode:     mode,
+		path:     path,
+		up:       metrics.Gauge(metricSelfProbeUp, "Whether the self-probe is passing", "listener", listener),
+		latency:  metrics.Histogram(metricSelfProbeTime, "Duration of self-probe attempts", "listener", listener),
+	}
+	selfProbeLock.Lock()
+	selfProbes = append(selfProbes, p)
+	selfProbeLock.Unlock()
+	OnWatchdog("self-probe --"+listener, p.status)
+	go p.run()
+}
+
+// LivenessHandler returns an http.Handler which reports whether the daemon is
+// live, for use by a supervisor such as a Kubernetes liveness probe: the
+// status is 503 if any SelfProbe is failing, and 200 otherwise.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selfProbeLock.Lock()
+		probes := append([]*selfProbe(nil), selfProbes...)
+		selfProbeLock.Unlock()
+		for _, p := range probes {
+			if err := p.status(); err != nil {
+				http.Error(w, fmt.Sprintf("self-probe --%s: %s", p.listener, err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// status returns the last error of the probe, if enough attempts have failed.
+func (p *selfProbe) status() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.failures < SelfProbeFailures {
+		return nil
+	}
+	return p.err
+}
+
+func (p *selfProbe) run() {
+	p.up.Set(1)
+	for ; ; time.Sleep(SelfProbeInterval) {
+		if IsDraining() {
+			return
+		}
+		if !Started() {
+			continue
+		}
+		start := time.Now()
+		err := p.attempt()
+		if err == errCannotProbe {
+			Warning.Printf("Self-probe of --%s stopped: %s", p.listener, err)
+			return
+		}
+		p.latency.Observe(time.Since(start).Seconds())
+
+		p.lock.Lock()
+		if err == nil {
+			if p.failures >= SelfProbeFailures {
+				Info.Printf("Self-probe of --%s is passing again", p.listener)
+			}
+			p.failures = 0
+		} else {
+			if p.failures++; p.failures == SelfProbeFailures {
+				Error.Printf("Self-probe of --%s failed %d times: %s", p.listener, p.failures, err)
+			}
+		}
+		p.err = err
+		failing := p.failures >= SelfProbeFailures
+		p.lock.Unlock()
+		if failing {
+			p.up.Set(0)
+		} else {
+			p.up.Set(1)
+		}
+	}
+}
+
+// attempt probes the listener once.
+func (p *selfProbe) attempt() error {
+	var w *WaitListener
+	if lf := findListenFlag(p.listener); lf != nil {
+		w = lf.current()
+	}
+	if w == nil {
+		return fmt.Errorf("--%s is not listening", p.listener)
+	}
+	if _, ok := w.Addr().(*net.TCPAddr); !ok || w.config.proxy != nil {
+		return errCannotProbe
+	}
+	addr := loopback(w.Addr())
+	secure := w.tls != nil
+	deadline := time.Now().Add(SelfProbeTimeout)
+
+	if p.mode == SelfProbeHTTP {
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		client := &http.Client{
+			Timeout: SelfProbeTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				DisableKeepAlives: true,
+			},
+		}
+		resp, err := client.Get(scheme + "://" + addr + p.path)
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 == 5 {
+			return fmt.Errorf("GET %s: %s", p.path, resp.Status)
+		}
+		return nil
+	}
+
+	accepted := make(chan bool)
+	atomic.AddInt32(&selfProbing, 1)
+	defer atomic.AddInt32(&selfProbing, -1)
+	conn, key, err := dialProbe(addr, accepted)
+	if err != nil {
+		return err
+	}
+	defer selfProbeConns.Delete(key)
+	defer conn.Close()
+
+	if p.mode == SelfProbeTLS {
+		tconn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		tconn.SetDeadline(deadline)
+		if err := tconn.Handshake(); err != nil {
+			return err
+		}
+	}
+	select {
+	case <-accepted:
+		return nil
+	case <-time.After(time.Until(deadline)):
+		return errors.New("connection was not accepted within " + SelfProbeTimeout.String())
+	}
+}
+
+// errCannotProbe is returned by attempt for a listener which a probe's
+// connection cannot be recognized on.
+var errCannotProbe = errors.New("only TCP listeners without ProxyProtocol can be probed")
+
+// dialProbe connects to addr from a local port chosen beforehand, so that
+// the connection is registered in selfProbeConns, under the key returned,
+// before it can be accepted.
+func dialProbe(addr string, accepted chan bool) (conn net.Conn, key string, err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	for tries := 1; ; tries++ {
+		// Have the kernel choose a free port by listening on it briefly.
+		l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return nil, "", err
+		}
+		local := l.Addr().(*net.TCPAddr)
+		l.Close()
+
+		key = local.String()
+		selfProbeConns.Store(key, accepted)
+		dialer := net.Dialer{LocalAddr: local, Timeout: SelfProbeTimeout}
+		if conn, err = dialer.Dial("tcp", addr); err == nil {
+			return conn, key, nil
+		}
+		selfProbeConns.Delete(key)
+		// EADDRINUSE means the port was taken in the meantime.
+		if tries == 3 || !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, "", err
+		}
+	}
+}
+
+// selfProbeAccepted notes that conn has been accepted, if it is a probe.
+func selfProbeAccepted(conn net.Conn) {
+	if accepted, ok := selfProbeConns.Load(conn.RemoteAddr().String()); ok {
+		close(accepted.(chan bool))
+	}
+}
+
+// loopback returns the address at which to reach addr from this host.
+func loopback(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+	ip := tcp.IP
+	switch {
+	case ip == nil || ip.Equal(net.IPv4zero):
+		ip = net.IPv4(127, 0, 0, 1)
+	case ip.Equal(net.IPv6unspecified):
+		ip = net.IPv6loopback
+	}
+	return net.JoinHostPort(ip.String(), fmt.Sprint(tcp.Port))
+}
@@ -0,0 +1,78 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"time"
+)
+
+// A Handler serves a single connection.  The connection is closed when
+// ServeConn returns.
+type Handler interface {
+	ServeConn(conn net.Conn)
+}
+
+// A HandlerFunc is an ordinary function which serves a connection.
+type HandlerFunc func(conn net.Conn)
+
+// ServeConn calls f(conn).
+func (f HandlerFunc) ServeConn(conn net.Conn) {
+	f(conn)
+}
+
+// Serve accepts connections from l and serves each of them with h in its own
+// goroutine.  If a handler panics, the panic is logged and the connection is
+// closed without bringing down the process; see OnPanic and PanicSites.
+// Serve returns nil once the listener is stopped or closed (for instance by
+// Restart or Shutdown).  Temporary accept errors, such as running out of file
+// descriptors, are logged and retried with a backoff, as net/http does; any
+// other accept error is returned.
+func Serve(l net.Listener, h Handler) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		switch {
+		case err == ErrStopped, err == ErrClosed:
+			return nil
+		case err == nil:
+			delay = 0
+			go serveConn(conn, h)
+			continue
+		case acceptErrorClass(err) == "closed":
+			return nil
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			return err
+		}
+		delay = acceptBackoff(delay)
+		Warning.Printf("Accept on %s failed (retrying in %s): %s", l.Addr(), delay, err)
+		time.Sleep(delay)
+	}
+}
+
+func serveConn(conn net.Conn, h Handler) {
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			recovered(conn, r)
+		}
+	}()
+	if a := accountOf(conn); a != nil {
+		a.begin()
+		defer a.end()
+	}
+	h.ServeConn(conn)
+}
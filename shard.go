@@ -0,0 +1,136 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AcceptShards causes the listener to run n goroutines which accept
+// connections concurrently, feeding a queue of up to queue connections from
+// which Accept returns them.  This smooths out accept latency during
+// connection storms on machines with many cores.  When the queue is full, the
+// accept goroutines wait (and the kernel's backlog takes up the slack), which
+// is reported in the daemon_accept_queue_full_total metric.
+func AcceptShards(n, queue int) ListenOption {
+	return func(c *listenConfig) {
+		if n > 1 {
+			c.shards, c.shardQueue = n, queue
+		}
+	}
+}
+
+// shardState holds the state of a WaitListener with AcceptShards.
+type shardState struct {
+	start    sync.Once
+	accepted chan acceptResult
+
+	depth Gauge
+	full  Counter
+}
+
+func newShardState(w *WaitListener) *shardState {
+	return &shardState{
+		depth: metrics.Gauge(metricQueueDepth, "Accepted connections waiting for Accept", "listener", w.name()),
+		full:  metrics.Counter(metricQueueFull, "Times the accept queue was full", "listener", w.name()),
+	}
+}
+
+// acceptShard returns the next connection accepted by the shards.
+func (w *WaitListener) acceptShard() (net.Conn, error) {
+	w.shards.start.Do(func() {
+		w.shards.accepted = make(chan acceptResult, w.config.shardQueue)
+		var wg sync.WaitGroup
+		for i := 0; i < w.config.shards; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.shardLoop()
+			}()
+		}
+		go func() {
+			wg.Wait()
+			w.shards.drain()
+		}()
+	})
+	res, ok := <-w.shards.accepted
+	if !ok {
+		return nil, ErrStopped
+	}
+	w.shards.depth.Set(float64(len(w.shards.accepted)))
+	return res.conn, res.err
+}
+
+func (w *WaitListener) shardLoop() {
+	for {
+		conn, err := w.accept()
+		if err != nil {
+			select {
+			case <-w.stop:
+				// Woken up by Stop (see wakeShards)
+				return
+			default:
+			}
+		}
+		res := acceptResult{conn, err}
+		select {
+		case w.shards.accepted <- res:
+		default:
+			w.shards.full.Add(1)
+			select {
+			case w.shards.accepted <- res:
+			case <-w.stop:
+				// Nobody may be left to Accept it.
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+		}
+		w.shards.depth.Set(float64(len(w.shards.accepted)))
+		if err == ErrStopped {
+			return
+		}
+	}
+}
+
+// drain closes the connections still queued once the shards have stopped,
+// since Serve stops calling Accept at the first ErrStopped, and then closes
+// the queue so that any later Accept returns ErrStopped.
+func (s *shardState) drain() {
+	for {
+		select {
+		case res := <-s.accepted:
+			if res.conn != nil {
+				res.conn.Close()
+			}
+		default:
+			close(s.accepted)
+			s.depth.Set(0)
+			return
+		}
+	}
+}
+
+// wakeShards causes any shards waiting in Accept to return, since Stop
+// itself does not interrupt Accept.  The deadline only applies to this
+// process's copy of the socket.
+func (w *WaitListener) wakeShards() {
+	if d, ok := w.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+		d.SetDeadline(time.Now())
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"net"
+)
+
+// SharePorts causes every TCP ListenFlag to behave as if it had SharePort.
+var SharePorts = false
+
+// SharePort (Linux and macOS) binds the listener with SO_REUSEPORT, so that
+// several instances of the daemon, each started independently, can listen on
+// the same port at once, for deploys which overlap the old and new versions
+// instead of passing descriptors with Restart.  The kernel spreads new
+// connections across the instances; an instance stops receiving them when it
+// stops listening, as in a Shutdown.  Each instance must set SharePort
+// (including the first), and on Linux they must be run by the same user.
+// Restart passes the listener on as usual.
+//
+// Unlike ReusePort, SharePort does not change how Restart hands the listener
+// to the child; ReusePort takes precedence if both are set.  On other
+// platforms, SharePort is ignored.
+func SharePort() ListenOption {
+	return func(c *listenConfig) {
+		c.sharePort = true
+	}
+}
+
+// listenTCP binds a TCP listener on laddr, sharing its port if c (or
+// SharePorts) asks for it.
+func listenTCP(c *listenConfig, netw string, laddr *net.TCPAddr) (net.Listener, error) {
+	if !(c.sharePort || SharePorts) || !sharePortSupported {
+		return net.ListenTCP(netw, laddr)
+	}
+	lc := net.ListenConfig{Control: sharePortControl}
+	return lc.Listen(context.Background(), netw, laddr.String())
+}
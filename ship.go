@@ -0,0 +1,474 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogSpoolMax is the most bytes of records which ShipLogs keeps in its spool
+// while the collector is unreachable or slow.  As the spool fills, records are
+// dropped by level: Verbose once it is half full, Info once it is three
+// quarters full, and anything once it is full.
+var LogSpoolMax int64 = 256 << 20
+
+// How much ShipLogs sends at once, and the size of each file in the spool.
+const (
+	shipBatch    = 1 << 20
+	spoolSegment = 4 << 20
+)
+
+// How long ShipLogs waits between attempts to reach the collector, and
+// between looks for spools left by previous generations.
+const (
+	shipRetryMin = time.Second
+	shipRetryMax = 30 * time.Second
+	shipIdle     = 5 * time.Second
+	shipTimeout  = 10 * time.Second
+)
+
+var errSpoolFull = errors.New("daemon: log spool is full")
+
+// ShipLogs forwards every log record to a remote collector, in addition to
+// the other destinations.  The target is a URL:
+//
+//	tcp://host:port      records are written to a TCP connection
+//	tls://host:port      likewise, over TLS
+//	http://host/path     records are POSTed in batches, one per line
+//	https://host/path    likewise, over TLS
+//
+// Only HTTP acknowledges each batch; with tcp and tls, records written just
+// as the collector goes away can be lost.
+//
+// Records are first appended to a spool of files in spoolDir, from which
+// they are sent in order, so that an outage of the collector only delays
+// them (up to LogSpoolMax).  Spools left behind by processes which have
+// exited, such as the previous generation after a Restart, are sent first;
+// likewise, records which have not been sent when the process exits are sent
+// by the next process of the same name to ship from spoolDir.  Records which
+// do not fit in the spool are counted as Failed in LogSinks.  ShipLogs may
+// only be called once.
+func ShipLogs(target, spoolDir string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "tcp", "tls", "http", "https":
+	default:
+		return fmt.Errorf("log shipping target %q: scheme must be tcp, tls, http or https", target)
+	}
+	sinkLock.Lock()
+	shipping := shipSink != nil
+	sinkLock.Unlock()
+	if shipping {
+		return errors.New("daemon: ShipLogs has already been called")
+	}
+	if err := os.MkdirAll(spoolDir, 0700); err != nil {
+		return err
+	}
+	s := &logShipper{
+		target: u,
+		dir:    spoolDir,
+		prefix: fmt.Sprintf("%s.%d", filepath.Base(os.Args[0]), pid()),
+		format: LogRecordFormat,
+		wake:   make(chan bool, 1),
+	}
+	if err := s.rotate(); err != nil {
+		return err
+	}
+	go s.run()
+
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	shipSink = newLogSink("ship "+target, s)
+	logger.SetOutput(processSinks())
+	return nil
+}
+
+type logShipFlag struct {
+	target, spoolDir string
+}
+
+func (f *logShipFlag) String() string {
+	return f.target
+}
+
+func (f *logShipFlag) Set(s string) error {
+	if s == "" {
+		return nil
+	}
+	if err := ShipLogs(s, f.spoolDir); err != nil {
+		return err
+	}
+	f.target = s
+	return nil
+}
+
+// LogShipFlag registers a flag with the given name which, when set, calls
+// ShipLogs with its value and spoolDir.
+func LogShipFlag(name, spoolDir string) {
+	flag.Var(&logShipFlag{spoolDir: spoolDir}, name, "URL of a log collector to which to ship logs (if set)")
+}
+
+// A logShipper spools records to files named <prefix>.<seq>.spool, and
+// sends them from a separate goroutine.  Each record in the spool is
+// preceded by its length, as four big-endian bytes.
+type logShipper struct {
+	target *url.URL
+	dir    string
+	prefix string
+	format LogFormat // LogRecordFormat when ShipLogs was called
+	wake   chan bool
+
+	lock    sync.Mutex
+	cur     *os.File // newest segment, being appended to
+	curSeq  int
+	curSize int64
+	pending int64 // bytes spooled but not yet sent
+
+	conn   net.Conn // for tcp and tls
+	client http.Client
+}
+
+// Write spools a record; it is called by the sink's goroutine.
+func (s *logShipper) Write(rec []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	full := float64(s.pending) / float64(LogSpoolMax)
+	switch level := formattedLevel(s.format, rec); {
+	case full >= 1,
+		full >= 0.75 && level >= Info,
+		full >= 0.5 && level >= Verbose:
+		return 0, errSpoolFull
+	}
+	n := len(rec)
+	rec = s.streamFrame(rec)
+
+	frame := make([]byte, 4+len(rec))
+	binary.BigEndian.PutUint32(frame, uint32(len(rec)))
+	copy(frame[4:], rec)
+	if _, err := s.cur.Write(frame); err != nil {
+		return 0, err
+	}
+	s.curSize += int64(len(frame))
+	s.pending += int64(len(frame))
+	if s.curSize >= spoolSegment {
+		s.rotateLocked()
+	}
+	select {
+	case s.wake <- true:
+	default:
+	}
+	return n, nil
+}
+
+// streamFrame returns a record framed as collectors of its format expect on
+// a stream: GELF over TCP is terminated by a null byte, and syslog over TCP
+// is preceded by its length (RFC 6587).  Records sent over HTTP are left as
+// lines.
+func (s *logShipper) streamFrame(rec []byte) []byte {
+	if s.target.Scheme != "tcp" && s.target.Scheme != "tls" {
+		return rec
+	}
+	switch s.format {
+	case FormatGELF:
+		return append(bytes.TrimSuffix(rec, []byte("\n")), 0)
+	case FormatRFC5424:
+		rec = bytes.TrimSuffix(rec, []byte("\n"))
+		return append([]byte(strconv.Itoa(len(rec))+" "), rec...)
+	}
+	return rec
+}
+
+// textLevel returns the level of a FormatText record, which follows the
+// first ": " (after the file and line).
+func textLevel(rec []byte) Logger {
+	i := bytes.Index(rec, []byte(": "))
+	if i < 0 || len(rec) < i+5 || string(rec[i+3:i+5]) != ": " {
+		return Error
+	}
+	switch rec[i+2] {
+	case 'W':
+		return Warning
+	case 'I':
+		return Info
+	case 'V':
+		return Verbose
+	}
+	return Error
+}
+
+func (s *logShipper) rotate() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rotateLocked()
+}
+
+// rotateLocked starts a new segment; the old one is removed by the sender
+// once it has been sent.
+func (s *logShipper) rotateLocked() error {
+	file, err := os.OpenFile(s.segment(s.prefix, s.curSeq+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if s.cur != nil {
+		s.cur.Close()
+	}
+	s.cur, s.curSize = file, 0
+	s.curSeq++
+	return nil
+}
+
+func (s *logShipper) segment(prefix string, seq int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s.%d.spool", prefix, seq))
+}
+
+// A spoolFile is a segment of a spool, to be sent from offset.
+type spoolFile struct {
+	name   string
+	prefix string
+	seq    int
+	offset int64
+}
+
+// segments returns the segments to send, oldest first: those of processes
+// which have exited, and then this process's.
+func (s *logShipper) segments() []spoolFile {
+	names, _ := filepath.Glob(filepath.Join(s.dir, filepath.Base(os.Args[0])+".*.*.spool"))
+	var files []spoolFile
+	for _, name := range names {
+		base := strings.TrimSuffix(filepath.Base(name), ".spool")
+		dot := strings.LastIndex(base, ".")
+		seq, err := strconv.Atoi(base[dot+1:])
+		if err != nil {
+			continue
+		}
+		prefix := base[:dot]
+		pid, err := strconv.Atoi(prefix[strings.LastIndex(prefix, ".")+1:])
+		if err != nil || (prefix != s.prefix && processAlive(pid)) {
+			continue
+		}
+		files = append(files, spoolFile{name: name, prefix: prefix, seq: seq})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if own := a.prefix == s.prefix; own != (b.prefix == s.prefix) {
+			return !own
+		}
+		if a.prefix != b.prefix {
+			return a.prefix < b.prefix
+		}
+		return a.seq < b.seq
+	})
+	for i := range files {
+		files[i].offset = s.sentOffset(files[i])
+	}
+	return files
+}
+
+// The offset file of a spool records how much of which segment has been
+// sent, so that a spool which is picked up after its process exits is not
+// sent twice.
+func (s *logShipper) offsetFile(prefix string) string {
+	return filepath.Join(s.dir, prefix+".offset")
+}
+
+func (s *logShipper) sentOffset(f spoolFile) int64 {
+	b, _ := ioutil.ReadFile(s.offsetFile(f.prefix))
+	var seq int
+	var off int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seq, &off); err != nil || seq != f.seq {
+		return 0
+	}
+	return off
+}
+
+func (s *logShipper) saveOffset(f spoolFile) {
+	ioutil.WriteFile(s.offsetFile(f.prefix), []byte(fmt.Sprintf("%d %d\n", f.seq, f.offset)), 0600)
+}
+
+// run sends the spool to the collector.
+func (s *logShipper) run() {
+	backoff, failing := shipRetryMin, false
+	for {
+		sent := false
+		for _, f := range s.segments() {
+			batch, n := readSpool(f.name, f.offset)
+			if n == 0 {
+				s.finish(f)
+				continue
+			}
+			if err := s.send(batch); err != nil {
+				if !failing {
+					Warning.Printf("Failed to ship logs to %s (spooling in %s): %s", s.target, s.dir, err)
+				}
+				failing = true
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > shipRetryMax {
+					backoff = shipRetryMax
+				}
+				sent = true // retry at once
+				break
+			}
+			if failing {
+				Info.Printf("Shipping logs to %s again", s.target)
+			}
+			backoff, failing = shipRetryMin, false
+
+			f.offset += n
+			s.saveOffset(f)
+			if f.prefix == s.prefix {
+				s.lock.Lock()
+				s.pending -= n
+				s.lock.Unlock()
+			}
+			sent = true
+			break
+		}
+		if !sent {
+			select {
+			case <-s.wake:
+			case <-time.After(shipIdle):
+			}
+		}
+	}
+}
+
+// finish removes a segment which has been sent, unless it is still being
+// written.
+func (s *logShipper) finish(f spoolFile) {
+	if f.prefix == s.prefix {
+		s.lock.Lock()
+		current := f.seq == s.curSeq
+		s.lock.Unlock()
+		if current {
+			return
+		}
+	}
+	os.Remove(f.name)
+	if f.prefix != s.prefix {
+		if rest, _ := filepath.Glob(filepath.Join(s.dir, f.prefix+".*.spool")); len(rest) == 0 {
+			os.Remove(s.offsetFile(f.prefix))
+		}
+	}
+}
+
+// readSpool reads up to shipBatch bytes of whole records from a segment,
+// starting at offset, and returns the records and the number of bytes of the
+// segment they took up.
+func readSpool(name string, offset int64) ([]byte, int64) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, 0
+	}
+	defer file.Close()
+	buf := make([]byte, shipBatch)
+	n, _ := file.ReadAt(buf, offset)
+	buf = buf[:n]
+
+	var recs []byte
+	var used int64
+	for len(buf) >= 4 {
+		size := int(binary.BigEndian.Uint32(buf))
+		if len(buf) < 4+size {
+			if used == 0 && size > shipBatch-4 {
+				// Too big to send in a batch; skip it.
+				return nil, 4 + int64(size)
+			}
+			break
+		}
+		recs = append(recs, buf[4:4+size]...)
+		buf = buf[4+size:]
+		used += 4 + int64(size)
+	}
+	return recs, used
+}
+
+// send sends a batch of records to the collector.
+func (s *logShipper) send(batch []byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	switch s.target.Scheme {
+	case "http", "https":
+		s.client.Timeout = shipTimeout
+		resp, err := s.client.Post(s.target.String(), "text/plain; charset=utf-8", bytes.NewReader(batch))
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("collector returned %s", resp.Status)
+		}
+		return nil
+	}
+
+	if s.conn != nil && !peerOpen(s.conn) {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: shipTimeout}
+		var err error
+		if s.target.Scheme == "tls" {
+			s.conn, err = tls.DialWithDialer(dialer, "tcp", s.target.Host, &tls.Config{ServerName: s.target.Hostname()})
+		} else {
+			s.conn, err = dialer.Dial("tcp", s.target.Host)
+		}
+		if err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(shipTimeout))
+	if _, err := s.conn.Write(batch); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// peerOpen reports whether the collector has not closed conn.  A write to a
+// connection closed by the peer appears to succeed, losing the records, so
+// the connection is checked before each batch; collectors send nothing, so
+// anything other than a timeout from a read means it is closed.  (With a
+// deadline which has already passed, the read would not be attempted.)
+func peerOpen(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,106 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// signalQueue receives the signals to be handled by Run or RunContext.
+var signalQueue = make(chan os.Signal, 10)
+
+// subscribe arranges for Signals to be delivered to signalQueue.
+func subscribe() chan os.Signal {
+	installSignalOptions() // provided in OS-specific files
+
+	// With no signals, Notify would subscribe to all of them.
+	if len(Signals) > 0 {
+		signal.Notify(signalQueue, Signals...)
+	}
+	return signalQueue
+}
+
+// HandleSignal passes a signal received by the application to Run or
+// RunContext, which handles it exactly as though it had been received
+// directly.  It can be used with any signal understood by the daemon, even
+// if it is not in Signals.
+func HandleSignal(sig os.Signal) {
+	signalQueue <- sig
+}
+
+// IgnoreSIGPIPE, if set, causes Run and RunContext to ignore SIGPIPE, so that
+// writing to a closed standard output or error (e.g. a log pipe whose reader
+// has gone away) returns EPIPE instead of killing the process.
+var IgnoreSIGPIPE = false
+
+// WatchChildren, if set, causes Run and RunContext to handle SIGCHLD by
+// reaping children started by this package (i.e. by Restart), logging their
+// exit status.  This catches a restarted child which dies while this process
+// is still draining.  Other children are left alone, so that exec.Cmd.Wait
+// elsewhere in the program continues to work.
+var WatchChildren = false
+
+// SignalDryRun, if set, causes Run and RunContext to log each signal they
+// receive and the action they would have taken, without taking it.  This is
+// useful in staging to verify supervisor integration without actually
+// restarting or shutting down.
+var SignalDryRun = false
+
+// SignalConfirm, if positive, requires a signal which would cause a Shutdown
+// or Restart to be received a second time within this long before it is acted
+// upon.  The first signal is only logged.
+var SignalConfirm time.Duration
+
+var sigActionNames = map[int]string{
+	sigUnknown:    "none",
+	sigShutdown:   "shutdown",
+	sigRestart:    "restart",
+	sigStackDump:  "stack dump",
+	sigStatusDump: "status dump",
+}
+
+var (
+	confirmLock sync.Mutex
+	confirmSig  os.Signal
+	confirmBy   time.Time
+)
+
+// filterSignal returns the action to take for a signal, applying
+// SignalDryRun and SignalConfirm.  It returns sigIgnored if no action should
+// be taken.
+func filterSignal(sig os.Signal) int {
+	action := sigAction(sig)
+	if SignalDryRun {
+		Info.Printf("Received %s; would %s (dry run)", sig, sigActionNames[action])
+		return sigIgnored
+	}
+	if SignalConfirm <= 0 || (action != sigShutdown && action != sigRestart) {
+		return action
+	}
+
+	confirmLock.Lock()
+	defer confirmLock.Unlock()
+	if confirmSig == sig && time.Now().Before(confirmBy) {
+		confirmSig = nil
+		Info.Printf("Received %s again; confirmed %s", sig, sigActionNames[action])
+		return action
+	}
+	confirmSig, confirmBy = sig, time.Now().Add(SignalConfirm)
+	Warning.Printf("Received %s; send it again within %s to confirm %s", sig, SignalConfirm, sigActionNames[action])
+	return sigIgnored
+}
@@ -0,0 +1,73 @@
+// +build linux darwin
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	childLock sync.Mutex
+	children  = map[int]bool{}
+	childOnce sync.Once
+)
+
+// trackChild records a child started by spawn, for WatchChildren.
+func trackChild(p *os.Process) {
+	childLock.Lock()
+	defer childLock.Unlock()
+	children[p.Pid] = true
+}
+
+func installSignalOptions() {
+	if IgnoreSIGPIPE {
+		signal.Ignore(syscall.SIGPIPE)
+	}
+	if WatchChildren {
+		childOnce.Do(func() {
+			sigchld := make(chan os.Signal, 1)
+			signal.Notify(sigchld, syscall.SIGCHLD)
+			go reapChildren(sigchld)
+		})
+	}
+}
+
+// reapChildren waits for SIGCHLD and reaps any of our children which have
+// exited.
+func reapChildren(sigchld chan os.Signal) {
+	for range sigchld {
+		childLock.Lock()
+		for pid := range children {
+			var status syscall.WaitStatus
+			wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+			if err != nil || wpid != pid {
+				continue
+			}
+			delete(children, pid)
+			if status.Signaled() {
+				Error.Printf("Child %d was killed by %s", pid, status.Signal())
+			} else {
+				Warning.Printf("Child %d exited with status %d", pid, status.ExitStatus())
+			}
+			childExited(pid)
+		}
+		childLock.Unlock()
+	}
+}
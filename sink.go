@@ -0,0 +1,389 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogSinkBuffer is the number of records which can be queued for each log
+// destination before records destined for it are dropped.  It must be set
+// before any log files are opened.
+var LogSinkBuffer = 1024
+
+// LogCrashSafe, if set, changes how records are written to log files: Error,
+// Exit and Fatal records are written and then fdatasync'd one by one, so that
+// the last error before a crash is on disk, while other records are buffered
+// and written every LogBufferFlush (or before the next error), without
+// waiting for them and without syncing.  By default, Warning and higher
+// records are waited for (up to LogFlushTimeout) and synced, while other
+// records are queued without waiting.  It must be set before any log files
+// are opened.
+var LogCrashSafe = false
+
+// LogBufferFlush is how often records buffered by LogCrashSafe are written.
+var LogBufferFlush = time.Second
+
+// How many bytes of records LogCrashSafe buffers before writing them.
+const logBufferSize = 64 << 10
+
+// LogFlushTimeout is the maximum amount of time that a record will wait for
+// each log destination to catch up before that destination is considered
+// stalled and is no longer waited on.
+var LogFlushTimeout = 1 * time.Second
+
+// A logSink is a single destination for log records.  Each sink has its own
+// queue and writer goroutine, so that a slow or failing destination (e.g. a
+// log file on a hung NFS mount) only causes records destined for it to be
+// dropped, and does not stall logging to the others.
+type logSink struct {
+	name  string
+	w     io.Writer
+	file  *os.File // w, if it is a log file shared with other generations
+	raw   bool     // records are not lines, so drops are not noted in w
+	queue chan sinkItem
+
+	mu     sync.RWMutex // held for reading while sending on queue
+	closed bool         // queue has been closed
+
+	stalled int32 // set when a flush has timed out, until the queue empties
+
+	written uint64
+	dropped uint64
+	failed  uint64
+}
+
+type sinkItem struct {
+	rec   []byte
+	flush chan bool // if non-nil, closed when everything before it is written
+	sync  bool      // if flushing, whether to also Sync the file
+}
+
+func newLogSink(name string, w io.Writer) *logSink {
+	s := &logSink{
+		name:  name,
+		w:     w,
+		queue: make(chan sinkItem, LogSinkBuffer),
+	}
+	go s.run()
+	return s
+}
+
+// newRawSink returns a sink for records which are not log lines, such as
+// those of an access log or tap, so that drops are not noted in w.
+func newRawSink(name string, w io.Writer) *logSink {
+	s := &logSink{
+		name:  name,
+		w:     w,
+		raw:   true,
+		queue: make(chan sinkItem, LogSinkBuffer),
+	}
+	go s.run()
+	return s
+}
+
+// newFileSink returns a sink for a log file which may be shared with other
+// generations.
+func newFileSink(file *os.File) *logSink {
+	s := &logSink{
+		name:  file.Name(),
+		w:     file,
+		file:  file,
+		queue: make(chan sinkItem, LogSinkBuffer),
+	}
+	go s.run()
+	return s
+}
+
+func (s *logSink) run() {
+	var (
+		reported uint64
+		buffer   = LogCrashSafe && s.file != nil
+		pending  []byte // buffered records
+		records  uint64 // in pending
+		tick     <-chan time.Time
+	)
+	if buffer {
+		ticker := time.NewTicker(LogBufferFlush)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	// writeOut writes the buffered records, in a single write so that they
+	// do not interleave with those of another generation.
+	writeOut := func() {
+		if records == 0 {
+			return
+		}
+		if _, err := s.write(pending); err != nil {
+			atomic.AddUint64(&s.failed, records)
+		} else {
+			atomic.AddUint64(&s.written, records)
+		}
+		pending, records = pending[:0], 0
+	}
+
+	for {
+		if len(s.queue) == 0 {
+			// Caught up, even if the timed out flush was never queued.
+			atomic.StoreInt32(&s.stalled, 0)
+		}
+		var item sinkItem
+		select {
+		case <-tick:
+			writeOut()
+			continue
+		case i, ok := <-s.queue:
+			if !ok {
+				writeOut()
+				if c, ok := s.w.(io.Closer); ok && s.w != io.Writer(os.Stderr) {
+					c.Close()
+				}
+				return
+			}
+			item = i
+		}
+
+		if item.flush != nil {
+			writeOut()
+			if f, ok := s.w.(*os.File); ok && item.sync {
+				if buffer {
+					datasync(f) // provided in OS-specific files
+				} else {
+					f.Sync()
+				}
+			}
+			atomic.StoreInt32(&s.stalled, 0)
+			close(item.flush)
+			continue
+		}
+
+		if dropped := atomic.LoadUint64(&s.dropped); dropped > reported && !s.raw {
+			writeOut()
+			fmt.Fprintf(s.w, "%s[daemon: dropped %d log records destined for %s]\n", logPrefix, dropped-reported, s.name)
+			reported = dropped
+		}
+		if buffer {
+			if len(pending)+len(item.rec) > logBufferSize {
+				writeOut()
+			}
+			pending = append(pending, item.rec...)
+			records++
+			continue
+		}
+		if _, err := s.write(item.rec); err != nil {
+			atomic.AddUint64(&s.failed, 1)
+			continue
+		}
+		atomic.AddUint64(&s.written, 1)
+	}
+}
+
+// write writes a single record, holding a lock on the file while another
+// generation may be writing to it.
+func (s *logSink) write(rec []byte) (int, error) {
+	if s.file != nil && logsShared() {
+		defer lockFile(s.file)()
+	}
+	return s.w.Write(rec)
+}
+
+// send queues a record without blocking.  Records sent after the sink is
+// closed are dropped.
+func (s *logSink) send(rec []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+	select {
+	case s.queue <- sinkItem{rec: rec}:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// flush waits up to timeout for the sink to write (and optionally Sync)
+// everything queued so far.  Sinks which have already timed out are not waited
+// on again until they catch up.
+func (s *logSink) flush(timeout time.Duration, sync bool) bool {
+	if atomic.LoadInt32(&s.stalled) != 0 {
+		return false
+	}
+	done := make(chan bool)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	s.mu.RLock()
+	if s.closed {
+		// A closed sink writes out what is queued on its own.
+		s.mu.RUnlock()
+		return true
+	}
+	select {
+	case s.queue <- sinkItem{flush: done, sync: sync}:
+		s.mu.RUnlock()
+	case <-deadline.C:
+		s.mu.RUnlock()
+		atomic.StoreInt32(&s.stalled, 1)
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-deadline.C:
+		atomic.StoreInt32(&s.stalled, 1)
+		return false
+	}
+}
+
+// close stops the sink (and closes its file) once everything queued has been
+// written.  It is safe to call while other goroutines are logging to it.
+func (s *logSink) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+}
+
+// A logTee copies each record to all of its sinks.
+type logTee []*logSink
+
+func (t logTee) Write(p []byte) (int, error) {
+	for _, s := range t {
+		// The log package reuses its buffer, so each sink gets a copy.
+		s.send(append([]byte(nil), p...))
+	}
+	return len(p), nil
+}
+
+var (
+	sinkLock   sync.Mutex
+	stderrSink = newLogSink("stderr", os.Stderr)
+	fileSink   *logSink
+	shipSink   *logSink // see ShipLogs
+)
+
+// processSinks returns the destinations of the process's log.  The caller
+// must hold sinkLock.
+func processSinks() logTee {
+	sinks := logTee{stderrSink}
+	for _, s := range []*logSink{fileSink, shipSink} {
+		if s != nil {
+			sinks = append(sinks, s)
+		}
+	}
+	return sinks
+}
+
+// setLogFile directs log output to standard error and the given file, which
+// becomes the log file.
+func setLogFile(file *os.File) {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+
+	logFile = file
+	old := fileSink
+	fileSink = newFileSink(file)
+	logger.SetOutput(processSinks())
+	if old != nil {
+		old.close()
+	}
+}
+
+// currentLogFile returns the log file, which may be changed by rotation.
+func currentLogFile() *os.File {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	return logFile
+}
+
+// flushLogs waits for all healthy log destinations to catch up.
+func flushLogs(sync bool) {
+	sinkLock.Lock()
+	sinks := processSinks()
+	sinkLock.Unlock()
+	sinks = append(sinks, daemonSinks()...)
+	for _, s := range sinks {
+		s.flush(LogFlushTimeout, sync)
+	}
+}
+
+// exit flushes the logs and exits with the given code.
+func exit(code int) {
+	flushLogs(true)
+	os.Exit(code)
+}
+
+// LogSinkStats holds the statistics for a single log destination.
+type LogSinkStats struct {
+	Name    string // File name or "stderr"
+	Written uint64 // Records successfully written
+	Dropped uint64 // Records dropped because the destination fell behind
+	Failed  uint64 // Records whose write returned an error
+	Stalled bool   // The destination did not catch up within LogFlushTimeout
+}
+
+// LogSinks returns the statistics for each current log destination, including
+// the access logs and taps of the listeners.  Their drops are only reported
+// here (and not in what they write), since they are not the daemon's logs.
+func LogSinks() []LogSinkStats {
+	sinkLock.Lock()
+	sinks := processSinks()
+	sinkLock.Unlock()
+	sinks = append(sinks, daemonSinks()...)
+	sinks = append(sinks, listenerSinks()...)
+
+	var stats []LogSinkStats
+	for _, s := range sinks {
+		stats = append(stats, LogSinkStats{
+			Name:    s.name,
+			Written: atomic.LoadUint64(&s.written),
+			Dropped: atomic.LoadUint64(&s.dropped),
+			Failed:  atomic.LoadUint64(&s.failed),
+			Stalled: atomic.LoadInt32(&s.stalled) != 0,
+		})
+	}
+	return stats
+}
+
+// listenerSinks returns the access log and tap sinks of the active listeners,
+// each only once even if it is shared.
+func listenerSinks() []*logSink {
+	seen := make(map[*logSink]bool)
+	var sinks []*logSink
+	for _, w := range activeListeners() {
+		var ss []*logSink
+		if w.config.access != nil {
+			ss = append(ss, w.config.access.sink)
+		}
+		if w.config.tap != nil {
+			ss = append(ss, w.config.tap.sink)
+		}
+		for _, s := range ss {
+			if !seen[s] {
+				seen[s] = true
+				sinks = append(sinks, s)
+			}
+		}
+	}
+	return sinks
+}
@@ -0,0 +1,325 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+)
+
+// SniffTimeout bounds how long a SniffMux waits for the first bytes of a
+// connection.  Connections which send nothing in time (such as those of
+// protocols in which the server speaks first) are passed to its Default.
+var SniffTimeout = 2 * time.Second
+
+// sniffMax is the most a SniffMux reads before giving up on its Sniffers.
+const sniffMax = 1024
+
+// A SniffResult is the verdict of a Sniffer.
+type SniffResult int
+
+// Verdicts of a Sniffer.
+const (
+	SniffNo   SniffResult = iota // Not the sniffer's protocol
+	SniffYes                     // The sniffer's protocol
+	SniffMore                    // Too few bytes to tell
+)
+
+// A Sniffer examines the first bytes sent on a connection (of which there is
+// at least one) to decide whether they belong to its protocol.
+type Sniffer func(head []byte) SniffResult
+
+// SniffPrefix returns a Sniffer which matches connections starting with any
+// of the given prefixes, such as the magic number of a custom protocol.
+func SniffPrefix(prefixes ...string) Sniffer {
+	return func(head []byte) SniffResult {
+		verdict := SniffNo
+		for _, p := range prefixes {
+			switch {
+			case bytes.HasPrefix(head, []byte(p)):
+				return SniffYes
+			case len(head) < len(p) && bytes.HasPrefix([]byte(p), head):
+				verdict = SniffMore
+			}
+		}
+		return verdict
+	}
+}
+
+// SniffTLS matches a TLS ClientHello.
+func SniffTLS(head []byte) SniffResult {
+	// A handshake record (22) of version 3.x, i.e. SSL 3.0 to TLS 1.3
+	switch {
+	case head[0] != 22:
+		return SniffNo
+	case len(head) < 3:
+		return SniffMore
+	case head[1] == 3 && head[2] <= 4:
+		return SniffYes
+	}
+	return SniffNo
+}
+
+// SniffHTTP matches HTTP/1.x requests, by their methods, and the HTTP/2
+// connection preface of prior-knowledge (h2c) clients.
+var SniffHTTP = SniffPrefix("GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ",
+	"PATCH ", "CONNECT ", "TRACE ", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// A SniffMux is a Handler which dispatches connections to other Handlers
+// based on the first bytes the client sends, so that a single listener can
+// serve several protocols, such as TLS, plain HTTP and a custom one, e.g.
+//
+//	mux := daemon.NewSniffMux()
+//	mux.Handle("tls", daemon.SniffTLS, tlsHandler)
+//	srv := &http.Server{Handler: h}
+//	go srv.Serve(mux.Listener("http", daemon.SniffHTTP))
+//	daemon.ListenFlag("port", "tcp", ":8000", "mixed", daemon.ServeWith(mux))
+//
+// Each connection is served through the WaitListener which accepted it, so
+// it is tracked and drained as usual whichever branch serves it.
+type SniffMux struct {
+	// Default handles connections which no Sniffer matches.  If it is nil,
+	// such connections are closed.
+	Default Handler
+
+	lock     sync.Mutex
+	branches []sniffBranch
+	stats    map[string]*SniffStats
+}
+
+type sniffBranch struct {
+	name  string
+	sniff Sniffer
+	h     Handler
+}
+
+// SniffStats holds the connection counts for one branch of a SniffMux.
+type SniffStats struct {
+	Active int64 // Connections currently being served
+	Total  int64 // Connections served, including active ones
+}
+
+// NewSniffMux returns an empty SniffMux.
+func NewSniffMux() *SniffMux {
+	return &SniffMux{stats: make(map[string]*SniffStats)}
+}
+
+// Handle registers the handler for connections matched by sniff, under the
+// given name (for Stats).  The Sniffers are tried in the order in which they
+// are registered, and the first to match is used.
+func (m *SniffMux) Handle(name string, sniff Sniffer, h Handler) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.branches = append(m.branches, sniffBranch{name, sniff, h})
+}
+
+// Listener registers a branch like Handle, whose connections are instead
+// returned by the Accept of the returned listener, so that it can be served
+// by a server which takes a net.Listener, such as an http.Server.  Each
+// connection remains open (and tracked by its WaitListener) until the server
+// closes it.  The listener must be served until it is closed; closing it
+// only stops it from accepting, and closes the connections which arrive for
+// it afterwards.
+func (m *SniffMux) Listener(name string, sniff Sniffer) net.Listener {
+	l := &sniffListener{
+		name:   name,
+		conns:  make(chan net.Conn),
+		closed: make(chan bool),
+	}
+	m.Handle(name, sniff, l)
+	return l
+}
+
+// ServeConn reads the first bytes of conn and dispatches it to the handler
+// of the first Sniffer which matches them.
+func (m *SniffMux) ServeConn(conn net.Conn) {
+	m.lock.Lock()
+	branches := m.branches
+	m.lock.Unlock()
+
+	name, h, head := "", m.Default, m.sniff(conn, branches)
+	for _, b := range branches {
+		if len(head) > 0 && b.sniff(head) == SniffYes {
+			name, h = b.name, b.h
+			break
+		}
+	}
+
+	m.lock.Lock()
+	st := m.stats[name]
+	if st == nil {
+		st = new(SniffStats)
+		m.stats[name] = st
+	}
+	st.Active++
+	st.Total++
+	m.lock.Unlock()
+
+	defer func() {
+		m.lock.Lock()
+		st.Active--
+		m.lock.Unlock()
+	}()
+
+	if h == nil {
+		Verbose.Printf("No handler for the protocol from %s (starting %q)", conn.RemoteAddr(), head)
+		conn.Close()
+		return
+	}
+	h.ServeConn(&sniffedConn{Conn: conn, head: head})
+}
+
+// sniff reads from conn until one of the branches matches, none of them can,
+// or SniffTimeout or sniffMax is reached, and returns what was read.
+func (m *SniffMux) sniff(conn net.Conn, branches []sniffBranch) []byte {
+	conn.SetReadDeadline(time.Now().Add(SniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, sniffMax)
+	var n int
+	for n < len(buf) {
+		read, err := conn.Read(buf[n:])
+		n += read
+		if err != nil || n == 0 {
+			break
+		}
+		more := false
+		for _, b := range branches {
+			switch b.sniff(buf[:n]) {
+			case SniffYes:
+				return buf[:n]
+			case SniffMore:
+				more = true
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return buf[:n]
+}
+
+// Stats returns the connection counts for each branch.  Connections served
+// by the Default are counted under "".
+func (m *SniffMux) Stats() map[string]SniffStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats := make(map[string]SniffStats, len(m.stats))
+	for name, st := range m.stats {
+		stats[name] = *st
+	}
+	return stats
+}
+
+// A sniffedConn replays the bytes read by a SniffMux before reading from
+// the connection.
+type sniffedConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	if len(c.head) > 0 {
+		n := copy(b, c.head)
+		c.head = c.head[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// NetConn returns the connection which was sniffed.
+func (c *sniffedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// A sniffListener is the listener of a SniffMux branch.
+type sniffListener struct {
+	name      string
+	conns     chan net.Conn
+	closed    chan bool
+	closeOnce sync.Once
+
+	lock sync.Mutex
+	addr net.Addr // of the latest connection
+}
+
+// ServeConn passes conn to Accept, and waits for it to be closed.
+func (l *sniffListener) ServeConn(conn net.Conn) {
+	c := &branchConn{Conn: conn, done: make(chan bool)}
+	l.lock.Lock()
+	l.addr = conn.LocalAddr()
+	l.lock.Unlock()
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		return
+	}
+	<-c.done
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (l *sniffListener) Close() error {
+	err := ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = nil
+	})
+	return err
+}
+
+// Addr returns the local address of the latest connection, or a placeholder
+// naming the branch if there has been none.
+func (l *sniffListener) Addr() net.Addr {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.addr == nil {
+		return sniffAddr(l.name)
+	}
+	return l.addr
+}
+
+type sniffAddr string
+
+func (a sniffAddr) Network() string { return "sniff" }
+func (a sniffAddr) String() string  { return string(a) }
+
+// A branchConn is a connection passed to the Accept of a sniffListener, whose
+// Close lets the SniffMux's ServeConn return.
+type branchConn struct {
+	net.Conn
+	done      chan bool
+	closeOnce sync.Once
+}
+
+func (c *branchConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.done) })
+	return err
+}
+
+// NetConn returns the connection from the SniffMux.
+func (c *branchConn) NetConn() net.Conn {
+	return c.Conn
+}
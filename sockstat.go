@@ -0,0 +1,108 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A SocketStat is the kernel's view of a TCP socket, as shown by ss(8).
+type SocketStat struct {
+	State    string // Such as "LISTEN", "ESTAB" or "TIME-WAIT"
+	Local    string
+	Remote   string
+	Listener string // Name of the listener whose port this is, if any
+
+	// For a listening socket, RecvQ is the number of connections waiting to
+	// be accepted and SendQ is the size of the backlog.  Otherwise they are
+	// the bytes waiting to be read and to be acknowledged by the peer.
+	RecvQ, SendQ uint32
+
+	Timer   string        // Pending timer, such as "keepalive" or "on" (retransmit); "" if none
+	Expires time.Duration // Until the Timer fires
+	RTT     time.Duration // Smoothed round trip time
+	Retrans uint32        // Total retransmitted segments
+	Cwnd    uint32        // Congestion window, in segments
+	Inode   uint64        // Zero for sockets not yet accepted, and TIME-WAIT
+}
+
+// SocketStats returns the kernel's statistics for the TCP sockets of this
+// process, and for those on the ports of its listeners which it holds no
+// descriptor for (connections waiting to be accepted, and in TIME-WAIT).
+// Unlike ss, it needs no privileges.  It is only supported on Linux, where
+// the statistics come from sock_diag(7).
+func SocketStats() ([]SocketStat, error) {
+	stats, err := tcpSocketStats() // provided in OS-specific files
+	if err != nil {
+		return nil, err
+	}
+	ports := map[string]string{}
+	for _, ls := range Listeners() {
+		if _, port, err := net.SplitHostPort(ls.Addr); err == nil && ls.Addr != "" {
+			ports[port] = ls.Name
+		}
+	}
+	owned := ownedSockets()
+
+	var mine []SocketStat
+	for _, s := range stats {
+		if _, port, err := net.SplitHostPort(s.Local); err == nil {
+			s.Listener = ports[port]
+		}
+		if owned[s.Inode] || (s.Inode == 0 && s.Listener != "") {
+			mine = append(mine, s)
+		}
+	}
+	return mine, nil
+}
+
+// socketsCommand implements the sockets control command.
+func socketsCommand(w io.Writer, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: sockets [listener]")
+	}
+	stats, err := SocketStats()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "State\tRecv-Q\tSend-Q\tLocal\tRemote\tListener\tInfo\n")
+	for _, s := range stats {
+		if len(args) == 1 && s.Listener != args[0] {
+			continue
+		}
+		var info []string
+		if s.RTT > 0 {
+			info = append(info, "rtt:"+s.RTT.String())
+		}
+		if s.Cwnd > 0 {
+			info = append(info, fmt.Sprintf("cwnd:%d", s.Cwnd))
+		}
+		if s.Retrans > 0 {
+			info = append(info, fmt.Sprintf("retrans:%d", s.Retrans))
+		}
+		if s.Timer != "" {
+			info = append(info, fmt.Sprintf("timer:(%s,%s)", s.Timer, s.Expires))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", s.State, s.RecvQ, s.SendQ,
+			s.Local, s.Remote, s.Listener, strings.Join(info, " "))
+	}
+	return tw.Flush()
+}
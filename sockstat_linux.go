@@ -0,0 +1,199 @@
+// +build linux
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Constants and structures of sock_diag(7).
+const (
+	sockDiagByFamily = 20
+	inetDiagInfo     = 2
+	tcpAllStates     = 1<<12 - 1
+)
+
+type inetDiagSockID struct {
+	SPort, DPort [2]byte // big-endian
+	Src, Dst     [16]byte
+	If           uint32
+	Cookie       [2]uint32
+}
+
+type inetDiagReqV2 struct {
+	Family, Protocol, Ext, Pad uint8
+	States                     uint32
+	ID                         inetDiagSockID
+}
+
+type inetDiagMsg struct {
+	Family, State, Timer, Retrans uint8
+	ID                            inetDiagSockID
+	Expires, RQueue, WQueue       uint32
+	UID, Inode                    uint32
+}
+
+// Names of the TCP states, as used by ss.
+var tcpStates = map[uint8]string{
+	1: "ESTAB", 2: "SYN-SENT", 3: "SYN-RECV", 4: "FIN-WAIT-1", 5: "FIN-WAIT-2",
+	6: "TIME-WAIT", 7: "UNCONN", 8: "CLOSE-WAIT", 9: "LAST-ACK", 10: "LISTEN",
+	11: "CLOSING",
+}
+
+// Names of the timers of inet_diag_msg.
+var tcpTimers = map[uint8]string{1: "on", 2: "keepalive", 3: "timewait", 4: "persist"}
+
+// tcpSocketStats dumps every TCP socket visible to this process.
+func tcpSocketStats() ([]SocketStat, error) {
+	var stats []SocketStat
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		s, err := inetDiag(family)
+		if err != nil {
+			return nil, fmt.Errorf("sock_diag: %s", err)
+		}
+		stats = append(stats, s...)
+	}
+	return stats, nil
+}
+
+func inetDiag(family uint8) ([]SocketStat, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	req := struct {
+		hdr syscall.NlMsghdr
+		req inetDiagReqV2
+	}{
+		hdr: syscall.NlMsghdr{
+			Type:  sockDiagByFamily,
+			Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_DUMP,
+			Seq:   1,
+		},
+		req: inetDiagReqV2{
+			Family:   family,
+			Protocol: syscall.IPPROTO_TCP,
+			Ext:      1 << (inetDiagInfo - 1),
+			States:   tcpAllStates,
+		},
+	}
+	req.hdr.Len = uint32(unsafe.Sizeof(req))
+	b := (*[unsafe.Sizeof(req)]byte)(unsafe.Pointer(&req))[:]
+	if err := syscall.Sendto(fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var stats []SocketStat
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return stats, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if code := *(*int32)(unsafe.Pointer(&m.Data[0])); code != 0 {
+						return nil, syscall.Errno(-code)
+					}
+				}
+				return stats, nil
+			}
+			if len(m.Data) < int(unsafe.Sizeof(inetDiagMsg{})) {
+				continue
+			}
+			stats = append(stats, parseDiagMsg(m.Data))
+		}
+	}
+}
+
+// parseDiagMsg parses an inet_diag_msg and its attributes.
+func parseDiagMsg(data []byte) SocketStat {
+	msg := *(*inetDiagMsg)(unsafe.Pointer(&data[0]))
+	ipLen := net.IPv4len
+	if msg.Family == syscall.AF_INET6 {
+		ipLen = net.IPv6len
+	}
+	addr := func(ip [16]byte, port [2]byte) string {
+		return net.JoinHostPort(net.IP(ip[:ipLen]).String(), strconv.Itoa(int(port[0])<<8|int(port[1])))
+	}
+	s := SocketStat{
+		State:   tcpStates[msg.State],
+		Local:   addr(msg.ID.Src, msg.ID.SPort),
+		Remote:  addr(msg.ID.Dst, msg.ID.DPort),
+		RecvQ:   msg.RQueue,
+		SendQ:   msg.WQueue,
+		Timer:   tcpTimers[msg.Timer],
+		Expires: time.Duration(msg.Expires) * time.Millisecond,
+		Inode:   uint64(msg.Inode),
+	}
+
+	// The attributes are each a struct rtattr followed by their payload,
+	// aligned to four bytes.
+	for attrs := data[unsafe.Sizeof(msg):]; len(attrs) >= 4; {
+		n := int(*(*uint16)(unsafe.Pointer(&attrs[0])))
+		typ := *(*uint16)(unsafe.Pointer(&attrs[2]))
+		if n < 4 || n > len(attrs) {
+			break
+		}
+		if typ == inetDiagInfo {
+			var info syscall.TCPInfo
+			copy((*[unsafe.Sizeof(info)]byte)(unsafe.Pointer(&info))[:], attrs[4:n])
+			s.RTT = time.Duration(info.Rtt) * time.Microsecond
+			s.Retrans = info.Total_retrans
+			s.Cwnd = info.Snd_cwnd
+		}
+		if n = (n + 3) &^ 3; n > len(attrs) {
+			break
+		}
+		attrs = attrs[n:]
+	}
+	return s
+}
+
+// ownedSockets returns the inodes of the sockets this process has open.
+func ownedSockets() map[uint64]bool {
+	owned := map[uint64]bool{}
+	fds, _ := ioutil.ReadDir("/proc/self/fd")
+	for _, fd := range fds {
+		link, err := os.Readlink("/proc/self/fd/" + fd.Name())
+		if err != nil {
+			continue
+		}
+		var ino uint64
+		if _, err := fmt.Sscanf(link, "socket:[%d]", &ino); err == nil {
+			owned[ino] = true
+		}
+	}
+	return owned
+}
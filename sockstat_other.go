@@ -0,0 +1,31 @@
+// +build !linux
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+)
+
+// tcpSocketStats is not implemented on this platform.
+func tcpSocketStats() ([]SocketStat, error) {
+	return nil, errors.New("daemon: socket statistics are only supported on Linux")
+}
+
+// ownedSockets is not implemented on this platform.
+func ownedSockets() map[uint64]bool {
+	return nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A specKey is a key which may be given in the value of a ListenFlag to
+// configure the listener, such as "tls=cert.pem:key.pem".
+type specKey struct {
+	bare  bool // may be given without a value
+	parse func(base *listenConfig, val string) (ListenOption, error)
+}
+
+// specKeys are the keys accepted in a listener spec (see ListenFlag).
+var specKeys = map[string]specKey{
+	"name": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return Name(val), nil
+	}},
+	"tls": {parse: func(base *listenConfig, val string) (ListenOption, error) {
+		certFile, keyFile, ok := cut(val, ":")
+		if !ok {
+			return nil, fmt.Errorf("want tls=cert:key, got %q", val)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config := new(tls.Config)
+		if base.tls != nil {
+			config = base.tls.Clone()
+		}
+		config.Certificates = []tls.Certificate{cert}
+		return TLS(config), nil
+	}},
+	"handshake": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, err
+		}
+		return HandshakeTimeout(d), nil
+	}},
+	"untracked": {bare: true, parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return Untracked(), nil
+	}},
+	"reuseport": {bare: true, parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return ReusePort(), nil
+	}},
+	"reap": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return parseReap(val)
+	}},
+	"maxconns": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return parseMaxConns(val)
+	}},
+	"rate": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return parseAcceptRate(val)
+	}},
+	"highwater": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return parseHighWater(val)
+	}},
+	"proxy":      {bare: true, parse: parseProxyKey},
+	"proxyproto": {bare: true, parse: parseProxyKey},
+	"shareport": {bare: true, parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return SharePort(), nil
+	}},
+	"accounting": {bare: true, parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return Accounting(), nil
+	}},
+	"logsample": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, err
+		}
+		return LogSample(n), nil
+	}},
+	"accesslog": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		w, err := openAccessLog(val)
+		if err != nil {
+			return nil, err
+		}
+		return AccessLog(w, CommonAccessFormat), nil
+	}},
+	"perip": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, err
+		}
+		return PerIPLimit(n), nil
+	}},
+	"clientca": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		caFile, crlFile, _ := cut(val, ":")
+		return ClientCAs(caFile, crlFile), nil
+	}},
+	"keylog": {bare: true, parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return KeyLog(val), nil
+	}},
+	"tap": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		return parseTap(val)
+	}},
+	"shards": {parse: func(_ *listenConfig, val string) (ListenOption, error) {
+		n, queue, err := parseShards(val)
+		if err != nil {
+			return nil, err
+		}
+		return AcceptShards(n, queue), nil
+	}},
+}
+
+// parseProxyKey parses the proxy (or proxyproto) key.
+func parseProxyKey(_ *listenConfig, val string) (ListenOption, error) {
+	return parseProxyNets(val)
+}
+
+// parseShards parses "n" or "n:queue".
+func parseShards(val string) (n, queue int, err error) {
+	ns, qs, hasQueue := cut(val, ":")
+	if n, err = strconv.Atoi(ns); err != nil {
+		return 0, 0, err
+	}
+	if !hasQueue {
+		return n, n, nil
+	}
+	if queue, err = strconv.Atoi(qs); err != nil {
+		return 0, 0, err
+	}
+	return n, queue, nil
+}
+
+// specKeyNames returns the sorted names of the spec keys, for errors.
+func specKeyNames() string {
+	var names []string
+	for name := range specKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseSpec splits a listener spec into its addresses (of which there are
+// none if they were not given) and the rest of the spec, and parses the rest
+// into options to be applied on top of base.
+func parseSpec(base *listenConfig, s string) (addrs []string, rest string, opts []ListenOption, err error) {
+	var keep []string
+	for i, field := range strings.Split(s, ",") {
+		key, val, hasVal := cut(field, "=")
+		if key == "addr" && hasVal {
+			addrs = append(addrs, val)
+			continue
+		}
+		sk, ok := specKeys[key]
+		if !ok && !hasVal && (i == 0 || strings.Contains(field, ":") || strings.HasPrefix(field, "&")) {
+			addrs = append(addrs, field)
+			continue
+		}
+		switch {
+		case !ok:
+			return nil, "", nil, fmt.Errorf("unknown listener option %q (want addr or one of %s)", key, specKeyNames())
+		case !hasVal && !sk.bare:
+			return nil, "", nil, fmt.Errorf("listener option %q requires a value", key)
+		}
+		opt, err := sk.parse(base, val)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("listener option %q: %s", key, err)
+		}
+		opts = append(opts, opt)
+		keep = append(keep, field)
+	}
+	return addrs, strings.Join(keep, ","), opts, nil
+}
+
+// closeReplaced closes the access log and tap which the spec of a flag which
+// has been set again opened into old, unless they are still in use by config,
+// so that their files and goroutines are not leaked.  Those given as options
+// (in base) belong to the caller and are left open.
+func closeReplaced(old, config, base *listenConfig) {
+	if a := old.access; a != nil && a != config.access && a != base.access {
+		a.sink.close()
+	}
+	if t := old.tap; t != nil && t != config.tap && t != base.tap {
+		t.sink.close()
+	}
+}
+
+// cut splits s around the first sep, if any.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
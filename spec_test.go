@@ -0,0 +1,95 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate and its key to dir.
+func writeKeyPair(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestParseSpec(t *testing.T) {
+	certFile, keyFile := writeKeyPair(t, t.TempDir())
+	spec := "addr=:443,tls=" + certFile + ":" + keyFile + ",proxyproto,maxconns=5000,name=public"
+
+	addrs, _, opts, err := parseSpec(&listenConfig{}, spec)
+	if err != nil {
+		t.Fatalf("parseSpec(%q): %s", spec, err)
+	}
+	if want := []string{":443"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("addrs = %q, want %q", addrs, want)
+	}
+	var c listenConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.tls == nil || len(c.tls.Certificates) != 1 {
+		t.Errorf("tls = %v, want one certificate", c.tls)
+	}
+	if c.proxy == nil {
+		t.Errorf("proxy is not set")
+	}
+	if c.maxConns != 5000 {
+		t.Errorf("maxConns = %d, want 5000", c.maxConns)
+	}
+	if c.name != "public" {
+		t.Errorf("name = %q, want %q", c.name, "public")
+	}
+}
+
+func TestParseSpecUnknown(t *testing.T) {
+	if _, _, _, err := parseSpec(&listenConfig{}, ":80,proxyprotocol"); err == nil {
+		t.Errorf("parseSpec accepted an unknown key")
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"flag"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StartupTimeout, if positive, is the time budget for starting the daemon.
+// If startup has not completed this long after the process started, the
+// names of the pending components are logged along with a stack dump of all
+// goroutines and the process exits with StartupExitCode, so that a daemon
+// stuck in initialization can be detected and restarted by its supervisor.
+//
+// Startup is complete once StartupComplete has been called (Run and
+// RunContext call it), every function returned by StartupTask has been
+// called, and every registered ListenFlag is listening.  Startup is only
+// watched once the program uses it: from the first StartupTask,
+// StartupTimeoutFlag, ListenAll or StartupComplete.
+var StartupTimeout time.Duration
+
+// StartupExitCode is the exit status used when StartupTimeout is exceeded.
+var StartupExitCode = 3
+
+// How often the startup deadline is checked.
+const startupPoll = 100 * time.Millisecond
+
+var (
+	startupLock    sync.Mutex
+	startupPending = map[string]int{}
+	startupMain    bool
+	startupDone    bool
+	startupWatch   sync.Once
+)
+
+// watchStartupOnce starts watchStartup, if it has not been started.
+func watchStartupOnce() {
+	startupWatch.Do(func() { go watchStartup() })
+}
+
+// StartupTimeoutFlag registers a flag with the given name which sets
+// StartupTimeout.
+func StartupTimeoutFlag(name string) *time.Duration {
+	watchStartupOnce()
+	flag.DurationVar(&StartupTimeout, name, StartupTimeout, "Maximum time allowed for startup (0 to disable)")
+	return &StartupTimeout
+}
+
+// StartupTask records that the named component is starting, and returns a
+// function which should be called once it is ready.  Startup is not complete
+// until every such function has been called.
+func StartupTask(name string) (ready func()) {
+	watchStartupOnce()
+	startupLock.Lock()
+	defer startupLock.Unlock()
+	startupPending[name]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			startupLock.Lock()
+			defer startupLock.Unlock()
+			if startupPending[name]--; startupPending[name] <= 0 {
+				delete(startupPending, name)
+			}
+		})
+	}
+}
+
+// StartupComplete records that main has finished initializing the daemon,
+// and logs a summary of the flags and listeners as a single line of JSON.
+// It is called by Run and RunContext, and only needs to be called directly
+// by programs which do not use either of them.
+func StartupComplete() {
+	watchStartupOnce()
+	startupLock.Lock()
+	startupMain = true
+	startupLock.Unlock()
+	checkJournal()
+	logStartupSummary()
+}
+
+// pendingStartup returns what startup is still waiting for, or nil if it
+// is complete.
+func pendingStartup() []string {
+	startupLock.Lock()
+	defer startupLock.Unlock()
+
+	var pending []string
+	for name := range startupPending {
+		pending = append(pending, name)
+	}
+	for _, l := range registered() {
+		if lf, ok := l.(*listenFlag); ok && lf.current() == nil {
+			pending = append(pending, "--"+lf.flag)
+		}
+	}
+	sort.Strings(pending)
+	if !startupMain {
+		pending = append(pending, "main")
+	}
+	return pending
+}
+
+// watchStartup waits for startup to complete, and exits if it takes longer
+// than StartupTimeout.
+func watchStartup() {
+	for {
+		time.Sleep(startupPoll)
+		select {
+		case <-Lamed:
+			// Already stopping; the shutdown has its own deadline.
+			return
+		default:
+		}
+
+		pending := pendingStartup()
+		if len(pending) == 0 {
+			startupLock.Lock()
+			startupDone = true
+			startupLock.Unlock()
+			completeHandoff()
+			signalReady()
+			Verbose.Printf("Startup complete after %s", Uptime())
+			return
+		}
+		if StartupTimeout > 0 && Uptime() > StartupTimeout {
+			Error.Printf("Startup did not complete within %s; waiting for %s\nStack dump:\n%s",
+				StartupTimeout, strings.Join(pending, ", "), stack())
+			exit(StartupExitCode)
+		}
+	}
+}
+
+// Started returns true once startup has completed.
+func Started() bool {
+	startupLock.Lock()
+	defer startupLock.Unlock()
+	return startupDone
+}
@@ -0,0 +1,142 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// stateEnv is the environment variable which holds the descriptor of the
+// state snapshot passed to a restarted child.
+const stateEnv = "DAEMON_STATE_FD"
+
+// A stateBlob is the saved state of one component.
+type stateBlob struct {
+	Version int
+	Data    []byte
+}
+
+type stateComponent struct {
+	version int
+	save    func() ([]byte, error)
+}
+
+var (
+	stateLock       sync.Mutex
+	stateComponents = map[string]stateComponent{}
+	inheritedState  map[string]stateBlob // nil until loaded
+)
+
+// RegisterState registers a component whose (small) state should survive
+// Restart, such as rate-limiter buckets or token caches.
+//
+// When Restart is called, save is called for each component and the blobs
+// are written, along with their versions, to an unlinked temporary file whose
+// descriptor is passed to the child.  When the child registers a component of
+// the same name, restore is called immediately with the version and data
+// saved by the parent, so that it can migrate state from older versions.
+// Restore is not called if the process was not started by Restart or if the
+// parent did not save the component.
+func RegisterState(name string, version int, save func() ([]byte, error), restore func(version int, data []byte) error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	stateComponents[name] = stateComponent{version, save}
+
+	if inheritedState == nil {
+		inheritedState = loadState()
+	}
+	blob, ok := inheritedState[name]
+	if !ok {
+		return
+	}
+	delete(inheritedState, name)
+	if err := restore(blob.Version, blob.Data); err != nil {
+		Error.Printf("Failed to restore state for %q (version %d): %s", name, blob.Version, err)
+		return
+	}
+	Verbose.Printf("Restored state for %q (version %d, %d bytes)", name, blob.Version, len(blob.Data))
+}
+
+// loadState reads the state snapshot passed by the parent, if any.
+func loadState() map[string]stateBlob {
+	state := map[string]stateBlob{}
+	envFD := os.Getenv(stateEnv)
+	if envFD == "" {
+		return state
+	}
+	os.Unsetenv(stateEnv)
+
+	fd, err := strconv.Atoi(envFD)
+	if err != nil {
+		Warning.Printf("bad %s %q: %s", stateEnv, envFD, err)
+		return state
+	}
+	f := os.NewFile(uintptr(fd), "state")
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&state); err != nil {
+		Error.Printf("Failed to read state snapshot: %s", err)
+	}
+	return state
+}
+
+// passState saves the registered components' state and arranges for it to
+// be passed to cmd.
+func passState(cmd *exec.Cmd) error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if len(stateComponents) == 0 {
+		return nil
+	}
+
+	state := make(map[string]stateBlob, len(stateComponents))
+	for name, c := range stateComponents {
+		data, err := c.save()
+		if err != nil {
+			Error.Printf("Failed to save state for %q: %s", name, err)
+			continue
+		}
+		state[name] = stateBlob{c.version, data}
+	}
+
+	f, err := ioutil.TempFile("", "daemon-state-")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name()) // the child only needs the descriptor
+	if err := gob.NewEncoder(f).Encode(state); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		f.Close()
+		return err
+	}
+
+	// The file stays open in this process until it exits, since the
+	// descriptor is only copied when the child is started.
+	// The extra files list doesn't include stdin/out/err
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", stateEnv, fd))
+	Verbose.Printf("Saved state for %d component(s)", len(state))
+	return nil
+}
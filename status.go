@@ -0,0 +1,107 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Version is the version of the program, as reported in the Status.  It can
+// be set by main or at link time with -ldflags "-X".
+var Version = ""
+
+// Status is a snapshot of the state of the daemon.  The control socket, the
+// status handler, and the status dump signal all report it, so every surface
+// shows the same data.
+type Status struct {
+	Version    string
+	PID        int
+	Generation int // See Generation
+	Started    time.Time
+	Uptime     string
+	Ready      bool // Startup is complete
+	WarmingUp  bool `json:",omitempty"` // See WarmUp
+	LogLevel   int
+
+	LastRestart  time.Time // Zero if not started by Restart
+	Draining     bool      // Shutting down or restarting
+	DrainStarted time.Time // Zero if not draining
+	Stopping     string    `json:",omitempty"` // "restart" or "shutdown" while draining
+	Superseded   string    `json:",omitempty"` // The Shutdown which superseded a Restart
+
+	Listeners []ListenerStatus
+	Health    []HealthResult
+}
+
+// CurrentStatus returns the Status of the daemon.  It runs the health checks,
+// so it may take up to HealthTimeout.
+func CurrentStatus() Status {
+	s := Status{
+		Version:      Version,
+		PID:          pid(),
+		Generation:   Generation(),
+		Started:      StartTime(),
+		Uptime:       Uptime().String(),
+		Ready:        Started(),
+		WarmingUp:    WarmingUp(),
+		LogLevel:     int(logLevel()),
+		LastRestart:  LastRestartTime(),
+		Draining:     IsDraining(),
+		DrainStarted: DrainStartedAt(),
+		Health:       Health(),
+	}
+	stoppingLock.Lock()
+	s.Stopping = stopping
+	if supersededBy != nil {
+		s.Stopping = stopShutdown
+		s.Superseded = supersededBy.String()
+	}
+	stoppingLock.Unlock()
+	s.Listeners = Listeners()
+	return s
+}
+
+// JSON returns the status as indented JSON.
+func (s Status) JSON() []byte {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		// Status only contains types which can be marshaled.
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+// StatusHandler returns an http.Handler which serves the CurrentStatus as
+// JSON.  The response status is 503 if any health check is failing.
+func StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := CurrentStatus()
+		w.Header().Set("Content-Type", "application/json")
+		for _, h := range s.Health {
+			if !h.OK {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				break
+			}
+		}
+		w.Write(s.JSON())
+	})
+}
+
+// dumpStatus writes the Status to the logs.
+func dumpStatus() {
+	Info.Printf("Status:\n%s", CurrentStatus().JSON())
+}
@@ -0,0 +1,144 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SummaryRedact lists flags whose values are replaced in the startup summary,
+// such as those which hold secrets.
+var SummaryRedact []string
+
+// Connection counts across all listeners, for the exit summary.
+var (
+	connsServed uint64 // atomic
+	connsOpen   int64  // atomic
+	connsPeak   int64  // atomic
+)
+
+// connOpened and connClosed maintain the process-wide connection counts.
+func connOpened() {
+	atomic.AddUint64(&connsServed, 1)
+	open := atomic.AddInt64(&connsOpen, 1)
+	for {
+		peak := atomic.LoadInt64(&connsPeak)
+		if open <= peak || atomic.CompareAndSwapInt64(&connsPeak, peak, open) {
+			return
+		}
+	}
+}
+
+func connClosed() {
+	atomic.AddInt64(&connsOpen, -1)
+}
+
+// startupSummary is logged once startup is complete.
+type startupSummary struct {
+	Event      string // "startup"
+	Version    string
+	PID        int
+	Generation int
+	Startup    string // Time taken since the process started
+	Flags      map[string]string
+	Listeners  []ListenerStatus
+	Insecure   []string `json:",omitempty"` // Debugging options which weaken security
+}
+
+// exitSummary is logged when a Shutdown or Restart finishes.
+type exitSummary struct {
+	Event      string // "exit"
+	Version    string
+	PID        int
+	Generation int
+	Action     string // "restart" or "shutdown"
+	Reason     string
+	Uptime     string
+	Drain      string // Time taken to drain connections
+	Served     uint64 // Connections accepted by this process
+	Peak       int64  // Most connections open at once
+	Error      string `json:",omitempty"`
+}
+
+var startupSummaryOnce sync.Once
+
+// logStartupSummary logs the startup summary, the first time it is called.
+func logStartupSummary() {
+	startupSummaryOnce.Do(func() {
+		s := startupSummary{
+			Event:      "startup",
+			Version:    Version,
+			PID:        pid(),
+			Generation: Generation(),
+			Startup:    Uptime().String(),
+			Flags:      map[string]string{},
+			Listeners:  Listeners(),
+		}
+		flag.VisitAll(func(f *flag.Flag) {
+			s.Flags[f.Name] = f.Value.String()
+		})
+		for _, name := range SummaryRedact {
+			if _, ok := s.Flags[name]; ok {
+				s.Flags[name] = "REDACTED"
+			}
+		}
+		insecureLock.Lock()
+		s.Insecure = append(s.Insecure, insecureNotes...)
+		insecureLock.Unlock()
+		logSummary(s)
+		for _, note := range s.Insecure {
+			Warning.Printf("INSECURE: %s", note)
+		}
+	})
+}
+
+// logExitSummary logs the summary of a finished Shutdown or Restart.
+func logExitSummary(action string, r Reason, err error) {
+	s := exitSummary{
+		Event:      "exit",
+		Version:    Version,
+		PID:        pid(),
+		Generation: Generation(),
+		Action:     action,
+		Reason:     r.String(),
+		Uptime:     Uptime().String(),
+		Served:     atomic.LoadUint64(&connsServed),
+		Peak:       atomic.LoadInt64(&connsPeak),
+	}
+	if start := DrainStartedAt(); !start.IsZero() {
+		s.Drain = time.Since(start).String()
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	logSummary(s)
+}
+
+// logSummary logs a summary record as a single line of JSON.
+func logSummary(s interface{}) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		// Summaries only contain types which can be marshaled.
+		panic(err)
+	}
+	Info.Printf("Summary: %s", bytes.TrimSpace(buf.Bytes()))
+}
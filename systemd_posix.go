@@ -0,0 +1,110 @@
+// +build linux darwin
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ErrNoNotifySocket is returned by SdNotify when the process was not started
+// by systemd with notification enabled.
+var ErrNoNotifySocket = errors.New("daemon: NOTIFY_SOCKET not set")
+
+// FDStore causes every listener created by ListenFlag to be parked in
+// systemd's file descriptor store (see FileDescriptorStoreMax= in
+// systemd.service(5)) as soon as it is listening.  If the process later
+// crashes, systemd passes the stored sockets back via LISTEN_FDS when it
+// restarts the service, and ListenFlag adopts them by flag name, so the port
+// is never closed.
+var FDStore = false
+
+// SdNotify sends a state notification (e.g. "READY=1") to systemd, passing
+// along any given files.  It returns ErrNoNotifySocket if the process is not
+// being supervised by systemd.
+func SdNotify(state string, files ...*os.File) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return ErrNoNotifySocket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var oob []byte
+	if len(files) > 0 {
+		fds := make([]int, len(files))
+		for i, f := range files {
+			fds[i] = int(f.Fd())
+		}
+		oob = syscall.UnixRights(fds...)
+	}
+	_, _, err = conn.WriteMsgUnix([]byte(state), oob, nil)
+	return err
+}
+
+// storeListener parks a copy of the listener in systemd's fd store under
+// the given name, replacing any previous one.
+func storeListener(name string, w *WaitListener) {
+	file, err := w.Dup()
+	if err != nil {
+		Warning.Printf("Failed to store --%s with systemd: %s", name, err)
+		return
+	}
+	defer file.Close()
+
+	SdNotify("FDSTOREREMOVE=1\nFDNAME=" + name)
+	if err := SdNotify("FDSTORE=1\nFDNAME="+name, file); err != nil {
+		Warning.Printf("Failed to store --%s with systemd: %s", name, err)
+		return
+	}
+	Verbose.Printf("Stored --%s (%s) with systemd", name, w.Addr())
+}
+
+var (
+	systemdOnce sync.Once
+	systemdFDs  map[string]int
+)
+
+// systemdFD returns the descriptor passed by systemd (via socket activation
+// or the fd store) with the given name, if any.
+func systemdFD(name string) (int, bool) {
+	systemdOnce.Do(func() {
+		systemdFDs = map[string]int{}
+		if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+			return
+		}
+		count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < count; i++ {
+			fd := 3 + i
+			syscall.CloseOnExec(fd)
+			if i < len(names) && names[i] != "" {
+				systemdFDs[names[i]] = fd
+			}
+		}
+	})
+	fd, ok := systemdFDs[name]
+	return fd, ok
+}
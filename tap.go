@@ -0,0 +1,335 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TapConnBytes is how many bytes of each tapped connection, in both
+// directions together, are copied to the tap.
+var TapConnBytes = 64 << 10
+
+// TapRate is how many bytes per second a tap may copy, across all of its
+// connections; a chunk beyond it is not copied, which leaves a gap in the
+// capture of its connection.
+var TapRate = 1 << 20
+
+var (
+	tapRedactLock sync.Mutex
+	tapRedactors  []func([]byte) []byte
+)
+
+// RedactTap registers a function which is applied to the bytes of every
+// tapped read or write before they are copied to the tap, so that secrets
+// can be masked.  The function may modify and return its argument, and must
+// return a slice of the same length, so that the stream stays in sequence.
+// Since reads and writes split the stream arbitrarily, it should only match
+// what cannot span them, or accept that some matches are missed.
+func RedactTap(fn func(data []byte) []byte) {
+	tapRedactLock.Lock()
+	defer tapRedactLock.Unlock()
+	tapRedactors = append(tapRedactors, fn)
+}
+
+// Tap copies the bytes read and written on one in every sample connections
+// of the listener, up to TapConnBytes each and TapRate in all, to w as a
+// pcap capture (with synthetic IP and TCP headers), so that a protocol can
+// be debugged on a live daemon with tools such as Wireshark, which need no
+// privileges to read it.  The capture header is written to w immediately;
+// w can be a file or a connection to a tap socket, for example:
+//
+//	socat UNIX-LISTEN:/tmp/tap.sock - | wireshark -k -i -
+//
+// Bytes which are not copied leave gaps in the TCP sequence, which tools
+// report as segments not captured.  On TLS listeners the bytes are
+// encrypted; the KeyLog option lets Wireshark decrypt them.  Untracked
+// listeners do not support taps.
+func Tap(w io.Writer, sample int) ListenOption {
+	return newTap(w, sample, true)
+}
+
+// newTap returns a Tap option, which writes the pcap header if asked to.
+func newTap(w io.Writer, sample int, header bool) ListenOption {
+	if sample < 1 {
+		sample = 1
+	}
+	t := &tap{
+		sink:   newRawSink("tap", w),
+		sample: uint64(sample),
+	}
+	if header {
+		t.sink.send(pcapHeader())
+	}
+	return func(c *listenConfig) {
+		c.tap = t
+	}
+}
+
+// A tap is where a listener's tapped connections are copied.
+type tap struct {
+	sink   *logSink
+	sample uint64
+
+	conns uint64 // atomic; accepted, for sampling
+
+	lock   sync.Mutex
+	tokens int // bytes which may be copied, refilled at TapRate
+	refill time.Time
+}
+
+// tapFile opens a tap for the spec key: a unix socket at path if there is
+// one, or else a capture file, which is appended to if it exists.
+func tapFile(path string, sample int) (ListenOption, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("tap: %s", err)
+		}
+		return Tap(conn, sample), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("tap: %s", err)
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		// Written by an earlier generation, so the header is there.
+		return newTap(f, sample, false), nil
+	}
+	return Tap(f, sample), nil
+}
+
+// parseTap parses the value of the "tap" spec key, "PATH" or "PATH:N".
+func parseTap(val string) (ListenOption, error) {
+	path, sample := val, 1
+	for i := len(val) - 1; i >= 0; i-- {
+		if val[i] == ':' {
+			if n, err := strconv.Atoi(val[i+1:]); err == nil {
+				path, sample = val[:i], n
+			}
+			break
+		}
+	}
+	return tapFile(path, sample)
+}
+
+// allow takes n bytes from the rate limit, reporting whether they may be
+// copied.
+func (t *tap) allow(n int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := now()
+	if !t.refill.IsZero() {
+		t.tokens += int(now.Sub(t.refill).Seconds() * float64(TapRate))
+	} else {
+		t.tokens = TapRate
+	}
+	if t.tokens > TapRate {
+		t.tokens = TapRate
+	}
+	t.refill = now
+	if n > t.tokens {
+		return false
+	}
+	t.tokens -= n
+	return true
+}
+
+// stream returns the stream for a new connection, or nil if it is not
+// sampled.
+func (t *tap) stream(conn net.Conn) *tapStream {
+	if atomic.AddUint64(&t.conns, 1)%t.sample != 1%t.sample {
+		return nil
+	}
+	client, _ := conn.RemoteAddr().(*net.TCPAddr)
+	server, _ := conn.LocalAddr().(*net.TCPAddr)
+	if client == nil || server == nil {
+		return nil
+	}
+	s := &tapStream{tap: t, client: client, server: server, budget: TapConnBytes}
+	if c4, s4 := client.IP.To4(), server.IP.To4(); c4 != nil && s4 != nil {
+		s.client = &net.TCPAddr{IP: c4, Port: client.Port}
+		s.server = &net.TCPAddr{IP: s4, Port: server.Port}
+	}
+	// The handshake, so that tools pick up the stream from the start.
+	s.packet(true, tcpSYN, nil)
+	s.seq[0]++
+	s.packet(false, tcpSYN|tcpACK, nil)
+	s.seq[1]++
+	s.packet(true, tcpACK, nil)
+	return s
+}
+
+// TCP flags.
+const (
+	tcpFIN = 1 << 0
+	tcpSYN = 1 << 1
+	tcpPSH = 1 << 3
+	tcpACK = 1 << 4
+)
+
+// A tapStream is a tapped connection.
+type tapStream struct {
+	tap            *tap
+	client, server *net.TCPAddr
+
+	lock   sync.Mutex
+	seq    [2]uint32 // next sequence number from the client and from the server
+	budget int       // bytes left of TapConnBytes
+	closed bool
+}
+
+// record copies data read from the client (in) or written to it.
+func (s *tapStream) record(in bool, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dir := 1
+	if in {
+		dir = 0
+	}
+	switch {
+	case s.closed || len(data) > s.budget:
+		// Leave a gap in the sequence, and copy nothing more.
+		s.budget = 0
+		s.seq[dir] += uint32(len(data))
+		return
+	case !s.tap.allow(len(data)):
+		// Leave a gap for this chunk only; later ones may fit the rate.
+		s.seq[dir] += uint32(len(data))
+		return
+	}
+	s.budget -= len(data)
+
+	data = append([]byte(nil), data...)
+	tapRedactLock.Lock()
+	fns := tapRedactors
+	tapRedactLock.Unlock()
+	for _, fn := range fns {
+		if redacted := fn(data); len(redacted) == len(data) {
+			data = redacted
+		}
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxTapSegment {
+			n = maxTapSegment
+		}
+		s.packet(in, tcpPSH|tcpACK, data[:n])
+		s.seq[dir] += uint32(n)
+		data = data[n:]
+	}
+}
+
+// close records the end of the connection.
+func (s *tapStream) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.packet(false, tcpFIN|tcpACK, nil)
+	s.seq[1]++
+	s.packet(true, tcpFIN|tcpACK, nil)
+	s.seq[0]++
+}
+
+// Largest payload of a synthetic packet, which fits in an IPv6 packet.
+const maxTapSegment = 65535 - 60
+
+// packet queues a packet from the client (in) or the server with s.lock held.
+func (s *tapStream) packet(in bool, flags byte, payload []byte) {
+	src, dst, seq, ack := s.client, s.server, s.seq[0], s.seq[1]
+	if !in {
+		src, dst, seq, ack = s.server, s.client, s.seq[1], s.seq[0]
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+	v4 := src.IP.To4() != nil
+
+	ipLen := 40
+	if v4 {
+		ipLen = 20
+	}
+	size := ipLen + 20 + len(payload)
+	now := now()
+	rec := make([]byte, 16+size)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(size))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(size))
+
+	ip := rec[16:]
+	if v4 {
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(size))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+		ip[8], ip[9] = 64, 6                       // TTL, TCP
+		copy(ip[12:], src.IP.To4())
+		copy(ip[16:], dst.IP.To4())
+		binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip[:20]))
+	} else {
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(20+len(payload)))
+		ip[6], ip[7] = 6, 64 // TCP, hop limit
+		copy(ip[8:], src.IP.To16())
+		copy(ip[24:], dst.IP.To16())
+	}
+
+	tcp := ip[ipLen:]
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12], tcp[13] = 5<<4, flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	copy(tcp[20:], payload)
+	s.tap.sink.send(rec)
+}
+
+// pcapHeader returns the header of a capture of raw IP packets.
+func pcapHeader() []byte {
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4) // microsecond timestamps
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], 65535) // snapshot length
+	binary.LittleEndian.PutUint32(h[20:], 101)   // LINKTYPE_RAW
+	return h
+}
+
+// ipChecksum returns the checksum of an IPv4 header.
+func ipChecksum(h []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(h); i += 2 {
+		sum += uint32(h[i])<<8 | uint32(h[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,169 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A HandshakeFailure classifies a failed TLS handshake.
+type HandshakeFailure string
+
+// Classes of TLS handshake failure, as counted by HandshakeFailures.
+const (
+	HandshakeTimedOut   HandshakeFailure = "timeout"     // The client did not finish in time
+	HandshakeEOF        HandshakeFailure = "eof"         // The client went away
+	HandshakeProtocol   HandshakeFailure = "protocol"    // Not TLS, or no common version or cipher
+	HandshakeSNI        HandshakeFailure = "sni"         // No certificate for the requested name
+	HandshakeClientCert HandshakeFailure = "client_cert" // The client certificate was rejected
+	HandshakeOther      HandshakeFailure = "other"
+)
+
+func classifyHandshake(err error) HandshakeFailure {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return HandshakeTimedOut
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return HandshakeEOF
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "certificate") && strings.Contains(msg, "client"),
+		strings.Contains(msg, "bad certificate"),
+		strings.Contains(msg, "failed to verify"):
+		return HandshakeClientCert
+	case strings.Contains(msg, "no certificates"),
+		strings.Contains(msg, "server name"),
+		strings.Contains(msg, "unrecognized name"):
+		return HandshakeSNI
+	case strings.Contains(msg, "version"),
+		strings.Contains(msg, "cipher"),
+		strings.Contains(msg, "does not look like a TLS handshake"),
+		strings.Contains(msg, "protocol"):
+		return HandshakeProtocol
+	}
+	return HandshakeOther
+}
+
+// tlsState holds the state of a WaitListener with TLS enabled.
+type tlsState struct {
+	start      sync.Once
+	accepted   chan acceptResult // closed once stopped and handshakes are done
+	handshakes sync.WaitGroup    // in progress
+
+	lock     sync.Mutex
+	failures map[HandshakeFailure]uint64
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// acceptTLS returns the next connection which has completed its handshake.
+// Handshakes are performed in their own goroutines so that slow clients do
+// not hold up the accept loop.  Those which complete after the listener is
+// stopped are still returned, so that they drain like any other connection,
+// and ErrStopped is returned once there are none left.
+func (w *WaitListener) acceptTLS() (net.Conn, error) {
+	w.tls.start.Do(func() {
+		w.tls.accepted = make(chan acceptResult)
+		go w.handshakeLoop()
+	})
+	res, ok := <-w.tls.accepted
+	if !ok {
+		return nil, ErrStopped
+	}
+	return res.conn, res.err
+}
+
+func (w *WaitListener) handshakeLoop() {
+	for {
+		conn, err := w.acceptRaw()
+		if err == ErrStopped {
+			w.tls.handshakes.Wait()
+			close(w.tls.accepted)
+			return
+		}
+		if err != nil {
+			select {
+			case w.tls.accepted <- acceptResult{nil, err}:
+			case <-w.stop:
+			}
+			continue
+		}
+		w.tls.handshakes.Add(1)
+		go w.handshake(conn)
+	}
+}
+
+func (w *WaitListener) handshake(conn net.Conn) {
+	defer w.tls.handshakes.Done()
+	timeout := w.config.handshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+
+	tconn := tls.Server(conn, w.config.tls)
+	conn.SetDeadline(time.Now().Add(timeout))
+	err := tconn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		select {
+		case <-w.stop:
+			// Probably the noop connection from Restart
+		default:
+			class := classifyHandshake(err)
+			w.tls.lock.Lock()
+			if w.tls.failures == nil {
+				w.tls.failures = make(map[HandshakeFailure]uint64)
+			}
+			w.tls.failures[class]++
+			w.tls.lock.Unlock()
+			metrics.Counter(metricHandshakeFailed, "TLS handshakes which failed",
+				"listener", w.name(), "reason", string(class)).Add(1)
+			Verbose.Printf("TLS handshake from %s failed (%s): %s", conn.RemoteAddr(), class, err)
+		}
+		conn.Close()
+		return
+	}
+
+	if m := Meta(conn); m != nil {
+		m.Set(tlsStateKey{}, tconn.ConnectionState())
+		m.Set(tlsConnKey{}, tconn)
+	}
+	w.tls.accepted <- acceptResult{tconn, nil}
+}
+
+// HandshakeFailures returns the number of failed TLS handshakes on this
+// listener, by class.  It returns nil if the listener does not use TLS.
+func (w *WaitListener) HandshakeFailures() map[HandshakeFailure]uint64 {
+	if w.tls == nil {
+		return nil
+	}
+	w.tls.lock.Lock()
+	defer w.tls.lock.Unlock()
+	failures := make(map[HandshakeFailure]uint64, len(w.tls.failures))
+	for class, n := range w.tls.failures {
+		failures[class] = n
+	}
+	return failures
+}
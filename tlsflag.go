@@ -0,0 +1,67 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+)
+
+// keyPairFiles are the files of the key pair of a TLSListenFlag.
+type keyPairFiles struct {
+	cert, key string
+}
+
+// TLSListenFlag is like ListenFlag for a TCP listener which serves TLS (see
+// TLS) with the key pair in certFile and keyFile, which can be changed with
+// the flags name.cert and name.key.  The key pair is loaded by Listen, so
+// that a missing or invalid file is reported by ListenAll along with any
+// other misconfigured listener, and since the underlying TCP socket is passed
+// on by Restart, the new generation loads the files again.  A TLS option in
+// opts configures everything but the certificate; if its config (or one
+// given with tls= in the flag value) already has a certificate, the files are
+// not loaded at all.
+func TLSListenFlag(name, addr, certFile, keyFile string, opts ...ListenOption) Listenable {
+	files := &keyPairFiles{cert: certFile, key: keyFile}
+	flag.StringVar(&files.cert, name+".cert", certFile, fmt.Sprintf("Certificate file for --%s", name))
+	flag.StringVar(&files.key, name+".key", keyFile, fmt.Sprintf("Private key file for --%s", name))
+	opts = append([]ListenOption{func(c *listenConfig) {
+		c.keyPair = files
+	}}, opts...)
+	return ListenFlag(name, "tcp", addr, "TLS", opts...)
+}
+
+// loadKeyPair loads the key pair of a TLSListenFlag into the listener's TLS
+// config, if it needs one.
+func (c *listenConfig) loadKeyPair() error {
+	if c.keyPair == nil {
+		return nil
+	}
+	if c.tls != nil && (len(c.tls.Certificates) > 0 || c.tls.GetCertificate != nil) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.keyPair.cert, c.keyPair.key)
+	if err != nil {
+		return fmt.Errorf("key pair: %s", err)
+	}
+	config := new(tls.Config)
+	if c.tls != nil {
+		config = c.tls.Clone()
+	}
+	config.Certificates = []tls.Certificate{cert}
+	c.tls = config
+	return nil
+}
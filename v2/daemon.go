@@ -0,0 +1,129 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package daemon is version 2 of kylelemons.net/go/daemon, whose surface is
+// built around the Daemon type: listeners and logs belong to a Daemon, Run
+// takes a context, and mistakes which version 1 reports by panicking, such as
+// a duplicate name, are returned as errors.
+//
+// Both versions operate on the same process, so a program can import them
+// side by side and migrate gradually: the types here are those of version 1,
+// the package-level functions of version 1 act on Default, and whatever has
+// no counterpart here yet is used from version 1 directly.  For example,
+//
+//	d := daemon.Default()               // was: the package-level functions
+//	d.ListenFlag("http", "tcp", ":80", "http")
+//	flag.Parse()
+//	if err := d.ListenAll(true); err != nil { ... }
+//	err := d.Run(ctx)                   // was: daemon.Run()
+package daemon
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	v1 "kylelemons.net/go/daemon"
+)
+
+// The types of version 1, which are shared by both versions.
+type (
+	Daemon         = v1.Daemon
+	Listenable     = v1.Listenable
+	ListenOption   = v1.ListenOption
+	WaitListener   = v1.WaitListener
+	Handler        = v1.Handler
+	HandlerFunc    = v1.HandlerFunc
+	Logger         = v1.Logger
+	Reason         = v1.Reason
+	Status         = v1.Status
+	ListenerStatus = v1.ListenerStatus
+	LifecycleError = v1.LifecycleError
+	ErrorCode      = v1.ErrorCode
+	Providers      = v1.Providers
+	Clock          = v1.Clock
+	Rand           = v1.Rand
+)
+
+// Log levels, as in version 1.
+const (
+	Error   = v1.Error
+	Warning = v1.Warning
+	Info    = v1.Info
+	Verbose = v1.Verbose
+	Exit    = v1.Exit
+	Fatal   = v1.Fatal
+)
+
+// ErrShutdown and ErrRestarted are returned (possibly wrapped) by Run when
+// the daemon has finished a Shutdown or a Restart, respectively.
+var (
+	ErrShutdown  = v1.ErrShutdown
+	ErrRestarted = v1.ErrRestarted
+)
+
+// New returns a Daemon with the given name, which must be unique within the
+// process and not empty (the empty name is reserved for Default).
+func New(name string) (d *Daemon, err error) {
+	defer catch(&err)
+	return v1.New(name), nil
+}
+
+// Default returns the process's default Daemon, whose flags are named
+// without a prefix and which owns the listeners created through version 1.
+func Default() *Daemon {
+	return v1.Default()
+}
+
+// Run runs the Default Daemon until ctx is cancelled or the process stops;
+// see Daemon.Run.
+func Run(ctx context.Context) error {
+	return Default().Run(ctx)
+}
+
+// SetProviders replaces the process's providers of time, randomness and
+// identity, which are shared by every Daemon, as in version 1.
+func SetProviders(p Providers) {
+	v1.SetProviders(p)
+}
+
+// NewListener returns a Listenable configured entirely by its options, as in
+// version 1, or an error if its name is already in use.
+func NewListener(opts ...ListenOption) (l Listenable, err error) {
+	defer catch(&err)
+	return v1.NewListener(opts...), nil
+}
+
+// Options for NewListener and ListenFlag, as in version 1.
+var (
+	Addr      = v1.Addr
+	Name      = v1.Name
+	TLS       = v1.TLS
+	ServeWith = v1.ServeWith
+	MaxConns  = v1.MaxConns
+)
+
+// catch turns a panic of version 1 which reports a mistake by the caller
+// into an error.
+func catch(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if s, ok := r.(string); ok && strings.HasPrefix(s, "daemon: ") {
+		*err = errors.New(s)
+		return
+	}
+	panic(r)
+}
@@ -0,0 +1,86 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"flag"
+	"time"
+)
+
+// WarmUp, if positive, is how long a process started by Restart takes to
+// ramp up to full traffic, so that the new generation's cold caches are not
+// hit with the full load at once.  During the warm-up, which starts when the
+// process starts, the minimum interval between connections accepted by each
+// listener begins at 1/WarmUpRate seconds and shrinks linearly to nothing;
+// connections beyond the rate wait in the kernel's backlog.  The Status
+// reports WarmingUp until it is over, so that load balancers can take it into
+// account.
+var WarmUp time.Duration
+
+// WarmUpRate is the rate, in connections per second per listener, at which a
+// WarmUp begins.
+var WarmUpRate = 10.0
+
+// WarmUpFlag registers a flag with the given name which sets WarmUp.
+func WarmUpFlag(name string) *time.Duration {
+	flag.DurationVar(&WarmUp, name, WarmUp, "Time over which to ramp up the accept rate after a restart (0 to disable)")
+	return &WarmUp
+}
+
+// WarmingUp returns true while the WarmUp after a Restart is in progress.
+func WarmingUp() bool {
+	return warmth(time.Now()) < 1
+}
+
+// warmth returns how far through its WarmUp the process is at now, from 0
+// to 1.
+func warmth(now time.Time) float64 {
+	if WarmUp <= 0 || Generation() == 0 {
+		return 1
+	}
+	f := float64(now.Sub(startTime)) / float64(WarmUp)
+	if f > 1 {
+		return 1
+	}
+	return f
+}
+
+// warmUp waits until the listener may accept another connection during the
+// WarmUp, or until it is stopped.
+func (w *WaitListener) warmUp() {
+	now := time.Now()
+	f := warmth(now)
+	if f >= 1 || WarmUpRate <= 0 {
+		return
+	}
+	interval := time.Duration((1 - f) / WarmUpRate * float64(time.Second))
+
+	w.warmLock.Lock()
+	next := w.warmNext
+	if next.Before(now) {
+		next = now
+	}
+	w.warmNext = next.Add(interval)
+	w.warmLock.Unlock()
+
+	if d := next.Sub(now); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-w.stop:
+		}
+	}
+}
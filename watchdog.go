@@ -0,0 +1,166 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"sync"
+	"time"
+)
+
+// Watchdog, if positive, causes Run and RunContext to start a watchdog which
+// pings the signal loop and every function registered with OnWatchdog this
+// often.  Anything which does not respond within the same interval is
+// considered wedged, and is handled according to WatchdogPolicy.  This
+// catches a daemon which is deadlocked but still holds its ports.
+var Watchdog time.Duration
+
+// A WatchdogAction determines what the watchdog does when a ping fails.
+type WatchdogAction int
+
+const (
+	// WatchdogLog logs an Error with a stack dump of all goroutines.
+	WatchdogLog WatchdogAction = iota
+
+	// WatchdogExit logs to Fatal, which dumps the stacks and exits, so that
+	// the supervisor can start a fresh process.
+	WatchdogExit
+)
+
+// WatchdogPolicy is the action taken when a watchdog ping fails.
+var WatchdogPolicy = WatchdogLog
+
+// A watchCheck is something to be pinged by the watchdog.
+type watchCheck struct {
+	name string
+	ping func() error
+
+	busy bool // a ping is still outstanding
+}
+
+var (
+	watchLock   sync.Mutex
+	watchChecks []*watchCheck
+	watchOnce   sync.Once
+	metricsOnce sync.Once
+
+	// loopPing is answered by Run and RunContext; loopRunning counts how
+	// many of them are currently answering.
+	loopPing    = make(chan chan struct{})
+	loopRunning int
+)
+
+// OnWatchdog registers a function which the watchdog calls to check that the
+// named component is responsive.  The component is considered wedged if ping
+// returns an error or does not return within Watchdog.
+func OnWatchdog(name string, ping func() error) {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	watchChecks = append(watchChecks, &watchCheck{name: name, ping: ping})
+}
+
+// enterLoop is called by Run and RunContext when they start answering
+// loopPing, and the returned function when they stop.  It also starts the
+// periodic checks which are enabled.
+func enterLoop() (leave func()) {
+	watchLock.Lock()
+	loopRunning++
+	watchLock.Unlock()
+
+	if Watchdog > 0 {
+		watchOnce.Do(func() { go watchdog() })
+	}
+	if FDCheck > 0 {
+		fdOnce.Do(func() { go watchFDs() })
+	}
+	if MemoryCheck > 0 {
+		memoryOnce.Do(func() { go watchMemory() })
+	}
+	if AnomalyCheck > 0 {
+		anomalyOnce.Do(func() { go watchAnomalies() })
+	}
+	if metricsSet {
+		metricsOnce.Do(func() { go reportMetrics() })
+	}
+	if MaxUptime > 0 || RestartWindow != "" {
+		scheduleOnce.Do(func() { go scheduleRestart() })
+	}
+	startLogSchedule()
+	return func() {
+		watchLock.Lock()
+		defer watchLock.Unlock()
+		loopRunning--
+	}
+}
+
+// pingLoop checks that the signal loop is responding.
+func pingLoop() error {
+	ack := make(chan struct{})
+	loopPing <- ack
+	<-ack
+	return nil
+}
+
+func watchdog() {
+	loop := &watchCheck{name: "signal loop", ping: pingLoop}
+	for range time.Tick(Watchdog) {
+		watchLock.Lock()
+		checks := append([]*watchCheck(nil), watchChecks...)
+		if loopRunning > 0 {
+			checks = append(checks, loop)
+		}
+		watchLock.Unlock()
+
+		for _, c := range checks {
+			if err := c.check(Watchdog); err != nil {
+				watchdogFailed(c.name, err)
+			}
+		}
+	}
+}
+
+// check pings c, waiting up to timeout for the result.  If an earlier ping
+// has still not returned, c is not pinged again.
+func (c *watchCheck) check(timeout time.Duration) error {
+	watchLock.Lock()
+	if c.busy {
+		watchLock.Unlock()
+		return ErrTimeout
+	}
+	c.busy = true
+	watchLock.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := c.ping()
+		watchLock.Lock()
+		c.busy = false
+		watchLock.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+}
+
+func watchdogFailed(name string, err error) {
+	if WatchdogPolicy == WatchdogExit {
+		Fatal.Printf("Watchdog: %s failed: %s", name, err)
+	}
+	Error.Printf("Watchdog: %s failed: %s\nStack dump:\n%s", name, err, stack())
+}